@@ -0,0 +1,146 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DigestImmediate = "immediate"
+	DigestHourly    = "hourly"
+	DigestDaily     = "daily"
+)
+
+const quietHoursLayout = "15:04"
+
+// QuietHours is a daily window, in the account's timezone, during which
+// bulk sends that respect quiet hours are held back. It wraps past
+// midnight when End is before Start (e.g. 22:00 to 07:00).
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (q *QuietHours) Validate() error {
+	start, err := time.Parse(quietHoursLayout, q.Start)
+	if err != nil {
+		return fmt.Errorf("Invalid quiet_hours start %q, want HH:MM", q.Start)
+	}
+	end, err := time.Parse(quietHoursLayout, q.End)
+	if err != nil {
+		return fmt.Errorf("Invalid quiet_hours end %q, want HH:MM", q.End)
+	}
+	if start.Equal(end) {
+		return errors.New("quiet_hours start and end must differ")
+	}
+	return nil
+}
+
+// Minutes returns the start and end of the window in minutes past
+// midnight. q must be valid.
+func (q *QuietHours) Minutes() (start, end int) {
+	s, _ := time.Parse(quietHoursLayout, q.Start)
+	e, _ := time.Parse(quietHoursLayout, q.End)
+	return s.Hour()*60 + s.Minute(), e.Hour()*60 + e.Minute()
+}
+
+func ValidateTimezone(tz string) error {
+	if tz == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return fmt.Errorf("Unknown timezone %q", tz)
+	}
+	return nil
+}
+
+func ValidateDigestMode(mode string) error {
+	switch mode {
+	case "", DigestImmediate, DigestHourly, DigestDaily:
+		return nil
+	}
+	return fmt.Errorf("Invalid digest_mode %q, want %s, %s or %s",
+		mode, DigestImmediate, DigestHourly, DigestDaily)
+}
+
+type CreateEmailAccountRequest struct {
+	Email  string `json:"email"`
+	PubKey string `json:"pubkey,omitempty"`
+
+	// Create the account as pending and send a confirmation link
+	Verify bool `json:"verify,omitempty"`
+
+	Timezone   string      `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	DigestMode string      `json:"digest_mode,omitempty"`
+}
+
+func (car *CreateEmailAccountRequest) Validate() error {
+	if err := ValidateTimezone(car.Timezone); err != nil {
+		return err
+	}
+	if err := ValidateDigestMode(car.DigestMode); err != nil {
+		return err
+	}
+	if car.QuietHours != nil {
+		return car.QuietHours.Validate()
+	}
+	return nil
+}
+
+type CreateEmailAccountResponse struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type LookupEmailAccountRequest struct {
+	Email string `json:"email"`
+}
+
+type LookupEmailAccountResponse struct {
+	Id string `json:"id"`
+}
+
+type GetEmailAccountResponse struct {
+	Id        string    `json:"id"`
+	Email     string    `json:"email"`
+	PubKey    string    `json:"pubkey,omitempty"`
+	HasPubKey bool      `json:"has_pubkey"`
+	Created   time.Time `json:"created"`
+
+	Timezone   string      `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	DigestMode string      `json:"digest_mode"`
+}
+
+type UpdateEmailAccountRequest struct {
+	Email  string `json:"email,omitempty"`
+	PubKey string `json:"pubkey,omitempty"`
+
+	// An empty timezone resets it to UTC, and empty quiet hours ({})
+	// remove them
+	Timezone   *string     `json:"timezone,omitempty"`
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+
+	DigestMode string `json:"digest_mode,omitempty"`
+}
+
+func (uar *UpdateEmailAccountRequest) Validate() error {
+	if uar.Email == "" && uar.PubKey == "" && uar.Timezone == nil && uar.QuietHours == nil &&
+		uar.DigestMode == "" {
+		return errors.New("Request must include a new email, pubkey, timezone, quiet_hours or digest_mode")
+	}
+	if err := ValidateDigestMode(uar.DigestMode); err != nil {
+		return err
+	}
+	if uar.Timezone != nil {
+		if err := ValidateTimezone(*uar.Timezone); err != nil {
+			return err
+		}
+	}
+	if uar.QuietHours != nil && *uar.QuietHours != (QuietHours{}) {
+		return uar.QuietHours.Validate()
+	}
+	return nil
+}
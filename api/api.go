@@ -0,0 +1,7 @@
+// Package api holds the JSON request and response types of PursueMail's
+// HTTP API, shared by the server and the Go client.
+package api
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
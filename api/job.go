@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	JobKindSend     = "send"
+	JobKindBulkSend = "bulksend"
+
+	JobScheduled   = "scheduled"
+	JobDispatching = "dispatching"
+	JobSent        = "sent"
+	JobFailed      = "failed"
+	JobCancelled   = "cancelled"
+)
+
+// EmailJob is a send request persisted to run at SendAt. Request is
+// left out of responses since it may contain attachments.
+type EmailJob struct {
+	Id        string          `json:"job_id"`
+	Kind      string          `json:"kind"`
+	AccountId string          `json:"account_id,omitempty"`
+	Request   json.RawMessage `json:"-"`
+	Status    string          `json:"status"`
+	SendAt    time.Time       `json:"send_at"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Created   time.Time       `json:"created"`
+	Updated   time.Time       `json:"updated"`
+}
+
+// Done reports whether the job has finished, one way or another.
+func (job *EmailJob) Done() bool {
+	return job.Status != JobScheduled && job.Status != JobDispatching
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type EmailData struct {
+	// TODO: Have a default from email
+	From    string `json:"from,omitempty"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	HTML    string `json:"html,omitempty"`
+
+	// Name of a stored EmailTemplate to render Subject, Body and HTML
+	// from, using Vars. TemplateVersion pins a version; the current one
+	// is used if it's 0.
+	Template        string                 `json:"template,omitempty"`
+	TemplateVersion int                    `json:"template_version,omitempty"`
+	Vars            map[string]interface{} `json:"vars,omitempty"`
+
+	// Encrypted along with the body when the recipient has a key
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is a file sent along with an email. Data is base64 in JSON.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// Schedule is embedded in send requests to deliver them later instead
+// of right away. At most one of its fields may be set.
+type Schedule struct {
+	SendAt       *time.Time `json:"send_at,omitempty"`
+	DelaySeconds int        `json:"delay_seconds,omitempty"`
+}
+
+func (s Schedule) Validate() error {
+	if s.SendAt != nil && s.DelaySeconds != 0 {
+		return errors.New("send_at and delay_seconds are mutually exclusive")
+	}
+	if s.DelaySeconds < 0 {
+		return errors.New("delay_seconds cannot be negative")
+	}
+	return nil
+}
+
+// When returns when to send, and false if that's now (or already past).
+func (s Schedule) When(now time.Time) (time.Time, bool) {
+	sendAt := now
+	if s.SendAt != nil {
+		sendAt = *s.SendAt
+	} else if s.DelaySeconds > 0 {
+		sendAt = now.Add(time.Duration(s.DelaySeconds) * time.Second)
+	}
+	return sendAt, sendAt.After(now)
+}
+
+type SendEmailRequest struct {
+	EmailData       EmailData `json:"email_data"`
+	SecureOnly      bool      `json:"secure_only,omitempty"`
+	AllowUnverified bool      `json:"allow_unverified,omitempty"`
+
+	// Send right away even if the account gets digests
+	Urgent bool `json:"urgent,omitempty"`
+
+	Schedule
+}
+
+// SendEmailResponse is returned, with 202 Accepted, when an email was
+// added to the account's digest rather than sent
+type SendEmailResponse struct {
+	DigestMode string `json:"digest_mode"`
+}
+
+func (ser *SendEmailRequest) Validate() error {
+	if ser == nil {
+		return fmt.Errorf("Got nil *SendEmailRequest!")
+	}
+	if ser.EmailData.Body == "" && ser.EmailData.HTML == "" && ser.EmailData.Template == "" {
+		return fmt.Errorf("Email cannot have an empty body!")
+	}
+	if ser.EmailData.From == "" {
+		return fmt.Errorf("Email cannot have an empty 'from' address!")
+	}
+	return ser.Schedule.Validate()
+}
+
+type SendBulkEmailRequest struct {
+	Ids        []string  `json:"ids,omitempty"`
+	Emails     []string  `json:"emails,omitempty"`
+	EmailData  EmailData `json:"email_data"`
+	SecureOnly bool      `json:"secure_only,omitempty"`
+
+	AllowUnverified bool `json:"allow_unverified,omitempty"`
+
+	// Hold each account's email until its quiet hours are over
+	RespectQuietHours bool `json:"respect_quiet_hours,omitempty"`
+
+	// Per-recipient template variables, keyed by ID (or by address when
+	// sending to Emails)
+	Vars map[string]map[string]interface{} `json:"vars,omitempty"`
+
+	Schedule
+}
+
+func (bulkReq *SendBulkEmailRequest) Validate() error {
+	if len(bulkReq.Ids) != 0 && len(bulkReq.Emails) != 0 {
+		return errors.New("Request body includes both emails and ids, parameters that are mutually exclusive")
+	}
+	return bulkReq.Schedule.Validate()
+}
+
+type SendBulkEmailResponse struct {
+	FailedIds []string `json:"failed_emails"`
+
+	// Why each failed recipient failed, keyed like FailedIds
+	Errors map[string]string `json:"errors,omitempty"`
+
+	// Jobs holding emails until recipients' quiet hours end, by ID
+	Scheduled map[string]string `json:"scheduled_jobs,omitempty"`
+}
@@ -0,0 +1,356 @@
+// Package client is a Go client for PursueMail's HTTP API.
+//
+//	c := client.New("http://127.0.0.1:9080", os.Getenv("PURSUEMAIL_ADMIN_TOKEN"))
+//	account, err := c.CreateAccount(ctx, &api.CreateEmailAccountRequest{Email: addr})
+//	...
+//	_, err = c.Send(ctx, account.Id, &api.SendEmailRequest{EmailData: emailData})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// Responses bigger than this are cut off
+	maxRespBodyBytes = 10 << 20
+)
+
+// Client calls a PursueMail server. Its fields may be changed before
+// it's first used.
+type Client struct {
+	// Where the server is, e.g. "http://127.0.0.1:9080"
+	BaseURL string
+
+	// Sent as a bearer token when set; needed for privileged endpoints
+	Token string
+
+	HTTPClient *http.Client
+
+	// How many times idempotent calls are retried after a network error
+	// or a 429, 502, 503 or 504 response, waiting RetryWait before the
+	// first retry and twice as long before each one after that
+	MaxRetries int
+	RetryWait  time.Duration
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+		MaxRetries: 3,
+		RetryWait:  500 * time.Millisecond,
+	}
+}
+
+// Error is an error response from the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pursuemail: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server, e.g. for an
+// unknown account or job.
+func IsNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+// IsGone reports whether err is a 410 from the server, which it sends
+// for deleted accounts.
+func IsGone(err error) bool {
+	return statusCode(err) == http.StatusGone
+}
+
+func statusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// CreateAccount maps an address to an account ID, creating the account
+// if need be. It's sent with an Idempotency-Key, so it's safe to retry.
+func (c *Client) CreateAccount(ctx context.Context, req *api.CreateEmailAccountRequest) (*api.CreateEmailAccountResponse, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.CreateEmailAccountResponse{}
+	_, err = c.do(ctx, "POST", "/api/v1/email", key, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetAccount returns the account with the given ID.
+func (c *Client) GetAccount(ctx context.Context, id string) (*api.GetEmailAccountResponse, error) {
+	resp := &api.GetEmailAccountResponse{}
+	_, err := c.do(ctx, "GET", "/api/v1/email/"+url.PathEscape(id), "", nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SendResult says what happened to an email that wasn't sent right
+// away. Both fields are nil if it was.
+type SendResult struct {
+	// Set if the email was added to the account's digest
+	Digest *api.SendEmailResponse
+
+	// Set if the email was scheduled for later
+	Job *api.EmailJob
+}
+
+// Send sends an email to the account with the given ID. It's never
+// retried, since the server can't tell a retry from a second email.
+func (c *Client) Send(ctx context.Context, id string, req *api.SendEmailRequest) (*SendResult, error) {
+	var body json.RawMessage
+	status, err := c.do(ctx, "POST", "/api/v1/email/"+url.PathEscape(id)+"/send", "", req, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SendResult{}
+	if status != http.StatusAccepted {
+		return result, nil
+	}
+	if isJob(body) {
+		result.Job = &api.EmailJob{}
+		err = json.Unmarshal(body, result.Job)
+	} else {
+		result.Digest = &api.SendEmailResponse{}
+		err = json.Unmarshal(body, result.Digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BulkSendResult says what happened to a bulk send. Both fields are nil
+// if every email was sent.
+type BulkSendResult struct {
+	// Set if some recipients failed or had their email held for their
+	// quiet hours
+	Response *api.SendBulkEmailResponse
+
+	// Set if the whole send was scheduled for later
+	Job *api.EmailJob
+}
+
+// BulkSendByIDs sends req's email to the accounts with the given IDs.
+// Like Send, it's never retried.
+func (c *Client) BulkSendByIDs(ctx context.Context, ids []string, req api.SendBulkEmailRequest) (*BulkSendResult, error) {
+	req.Ids, req.Emails = ids, nil
+	return c.bulkSend(ctx, &req)
+}
+
+// BulkSendByEmails sends req's email to the given addresses, whether or
+// not they have accounts. Like Send, it's never retried.
+func (c *Client) BulkSendByEmails(ctx context.Context, emails []string, req api.SendBulkEmailRequest) (*BulkSendResult, error) {
+	req.Ids, req.Emails = nil, emails
+	return c.bulkSend(ctx, &req)
+}
+
+func (c *Client) bulkSend(ctx context.Context, req *api.SendBulkEmailRequest) (*BulkSendResult, error) {
+	var body json.RawMessage
+	status, err := c.do(ctx, "POST", "/api/v1/email/bulksend", "", req, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BulkSendResult{}
+	if status == http.StatusNoContent {
+		return result, nil
+	}
+	if isJob(body) {
+		result.Job = &api.EmailJob{}
+		err = json.Unmarshal(body, result.Job)
+	} else {
+		result.Response = &api.SendBulkEmailResponse{}
+		err = json.Unmarshal(body, result.Response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetJob returns the scheduled send with the given ID.
+func (c *Client) GetJob(ctx context.Context, id string) (*api.EmailJob, error) {
+	job := &api.EmailJob{}
+	_, err := c.do(ctx, "GET", "/api/v1/jobs/"+url.PathEscape(id), "", nil, job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// WaitForJob polls the job every interval until it's sent, failed or
+// cancelled, or ctx is done.
+func (c *Client) WaitForJob(ctx context.Context, id string, interval time.Duration) (*api.EmailJob, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// CancelJob cancels a job that hasn't been sent yet. The server responds
+// 409 Conflict if it's too late.
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/jobs/"+url.PathEscape(id), "", nil, nil)
+	return err
+}
+
+// do sends a request with reqBody (if non-nil) as JSON, and decodes a
+// successful response into respBody (if non-nil).
+// Requests are retried if they're GETs or DELETEs, or carry an
+// idempotency key.
+func (c *Client) do(ctx context.Context, method, path, idempotencyKey string, reqBody interface{}, respBody interface{}) (int, error) {
+	var body []byte
+	if reqBody != nil {
+		var err error
+		if body, err = json.Marshal(reqBody); err != nil {
+			return 0, err
+		}
+	}
+
+	retries := 0
+	if method == "GET" || method == "DELETE" || idempotencyKey != "" {
+		retries = c.MaxRetries
+	}
+
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		status, err := c.try(ctx, method, path, idempotencyKey, body, respBody)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return status, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) try(ctx context.Context, method, path, idempotencyKey string, body []byte, respBody interface{}) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRespBodyBytes))
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var errResp api.ErrorResponse
+		if json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+			apiErr.Message = errResp.Error
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return resp.StatusCode, apiErr
+	}
+
+	if respBody == nil || resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	}
+	if err = json.Unmarshal(data, respBody); err != nil {
+		return resp.StatusCode, fmt.Errorf("pursuemail: error decoding %d response: %v", resp.StatusCode, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a call that failed with err may succeed if
+// it's tried again.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		// Couldn't connect, or the connection dropped
+		return true
+	case *Error:
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// isJob tells an EmailJob apart from the other bodies sent with 202
+// Accepted.
+func isJob(body json.RawMessage) bool {
+	var probe struct {
+		JobId string `json:"job_id"`
+	}
+	return json.Unmarshal(body, &probe) == nil && probe.JobId != ""
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
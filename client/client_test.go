@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+)
+
+// fakeServer answers each request with the next of its responses,
+// repeating the last one, and keeps the requests it got.
+type fakeServer struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	requests  []*http.Request
+}
+
+type fakeResponse struct {
+	status int
+	body   interface{}
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	resp := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	if resp.body != nil {
+		json.NewEncoder(w).Encode(resp.body)
+	}
+}
+
+func (s *fakeServer) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// newTestClient returns a Client for a server giving responses, which
+// retries almost straight away.
+func newTestClient(t *testing.T, responses ...fakeResponse) (*Client, *fakeServer) {
+	srv := &fakeServer{responses: responses}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	c := New(ts.URL, "token")
+	c.RetryWait = time.Millisecond
+	return c, srv
+}
+
+var unavailable = fakeResponse{http.StatusServiceUnavailable, api.ErrorResponse{Error: "Try again later"}}
+
+func TestError(t *testing.T) {
+	c, _ := newTestClient(t, fakeResponse{http.StatusNotFound, api.ErrorResponse{Error: "Email account not found"}})
+	_, err := c.GetAccount(context.Background(), "abc")
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusNotFound || e.Message != "Email account not found" {
+		t.Fatalf("err = %#v", err)
+	}
+	if !IsNotFound(err) || IsGone(err) {
+		t.Errorf("IsNotFound = %v, IsGone = %v", IsNotFound(err), IsGone(err))
+	}
+
+	c, _ = newTestClient(t, fakeResponse{http.StatusBadRequest, "not JSON"})
+	_, err = c.GetAccount(context.Background(), "abc")
+	if e, ok := err.(*Error); !ok || e.Message != `"not JSON"` {
+		t.Errorf("Non-JSON error = %#v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	account := api.GetEmailAccountResponse{Id: "abc"}
+	c, srv := newTestClient(t, unavailable, unavailable, fakeResponse{http.StatusOK, account})
+	resp, err := c.GetAccount(context.Background(), "abc")
+	if err != nil || resp.Id != "abc" {
+		t.Fatalf("GetAccount = %+v, %v", resp, err)
+	}
+	if n := len(srv.Requests()); n != 3 {
+		t.Errorf("GET sent %d times, want 3", n)
+	}
+
+	c, srv = newTestClient(t, unavailable)
+	if _, err := c.GetAccount(context.Background(), "abc"); statusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(srv.Requests()); n != c.MaxRetries+1 {
+		t.Errorf("GET sent %d times, want %d", n, c.MaxRetries+1)
+	}
+}
+
+func TestCreateAccountRetriesWithSameKey(t *testing.T) {
+	created := api.CreateEmailAccountResponse{Id: "abc", Status: "created"}
+	c, srv := newTestClient(t, unavailable, fakeResponse{http.StatusCreated, created})
+	resp, err := c.CreateAccount(context.Background(), &api.CreateEmailAccountRequest{Email: "someone@example.com"})
+	if err != nil || resp.Id != "abc" {
+		t.Fatalf("CreateAccount = %+v, %v", resp, err)
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("POST sent %d times, want 2", len(reqs))
+	}
+	key := reqs[0].Header.Get(idempotencyKeyHeader)
+	if key == "" || reqs[1].Header.Get(idempotencyKeyHeader) != key {
+		t.Errorf("Idempotency keys %q and %q", key, reqs[1].Header.Get(idempotencyKeyHeader))
+	}
+}
+
+func TestSendIsNotRetried(t *testing.T) {
+	c, srv := newTestClient(t, unavailable, fakeResponse{http.StatusNoContent, nil})
+	_, err := c.Send(context.Background(), "abc", &api.SendEmailRequest{EmailData: api.EmailData{Subject: "Hi", Body: "Hello"}})
+	if statusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("Send sent %d times, want 1", n)
+	}
+}
+
+func TestSendResult(t *testing.T) {
+	req := &api.SendEmailRequest{EmailData: api.EmailData{Subject: "Hi", Body: "Hello"}}
+
+	c, _ := newTestClient(t, fakeResponse{http.StatusAccepted, api.EmailJob{Id: "job", Status: api.JobScheduled}})
+	result, err := c.Send(context.Background(), "abc", req)
+	if err != nil || result.Job == nil || result.Job.Id != "job" || result.Digest != nil {
+		t.Errorf("Scheduled send = %+v, %v", result, err)
+	}
+
+	c, _ = newTestClient(t, fakeResponse{http.StatusAccepted, api.SendEmailResponse{DigestMode: api.DigestDaily}})
+	result, err = c.Send(context.Background(), "abc", req)
+	if err != nil || result.Digest == nil || result.Digest.DigestMode != api.DigestDaily || result.Job != nil {
+		t.Errorf("Digested send = %+v, %v", result, err)
+	}
+
+	c, _ = newTestClient(t, fakeResponse{http.StatusNoContent, nil})
+	result, err = c.Send(context.Background(), "abc", req)
+	if err != nil || result.Digest != nil || result.Job != nil {
+		t.Errorf("Sent send = %+v, %v", result, err)
+	}
+}
+
+func TestWaitForJobStopsOnCancel(t *testing.T) {
+	c, srv := newTestClient(t, fakeResponse{http.StatusOK, api.EmailJob{Id: "job", Status: api.JobScheduled}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.WaitForJob(ctx, "job", 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(srv.Requests()); n < 2 {
+		t.Errorf("Job polled %d times", n)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/server"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	StorePostgres = "postgres"
+	StoreMemory   = "memory"
+)
+
+type Config struct {
+	Server    server.Config
+	Mailer    mailer.Config
+	Transport mailer.TransportConfig
+
+	// Where accounts, templates and queued email are kept: postgres, or
+	// memory for small deployments that can lose them on restart
+	Store string
+
+	// How the service connects to Postgres, and how migrations do
+	Postgres store.PostgresConfig
+	Migrator store.PostgresConfig
+
+	// Whether to apply pending schema migrations at startup
+	Migrate bool
+
+	// logrus level, output format (json or text), and how email
+	// addresses are logged (redact, hash or plain)
+	LogLevel  string
+	LogFormat string
+	LogEmails string
+
+	// Where spans go (otlp, stdout, or "" for nowhere), the OTLP/HTTP
+	// traces endpoint, and the fraction of new traces to record
+	TraceExporter    string
+	OTLPEndpoint     string
+	TraceSampleRatio float64
+
+	// How often to check for scheduled emails that are due
+	SchedulerInterval time.Duration
+}
+
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		Server: server.Config{
+			Addr:           getenvDefault("PURSUEMAIL_ADDR", "127.0.0.1:9080"),
+			AdminToken:     os.Getenv("PURSUEMAIL_ADMIN_TOKEN"),
+			SandboxAddress: os.Getenv("PURSUEMAIL_SANDBOX_ADDRESS"),
+		},
+		Mailer: mailer.Config{
+			SystemFrom: os.Getenv("PURSUEMAIL_FROM"),
+		},
+		Transport: mailer.TransportConfig{
+			Transport:    getenvDefault("PURSUEMAIL_TRANSPORT", mailer.TransportSMTP),
+			SMTPServer:   os.Getenv("SMTP_SERVER"),
+			SMTPLogin:    os.Getenv("SMTP_LOGIN"),
+			SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+			RelaysFile:   os.Getenv("PURSUEMAIL_RELAYS_FILE"),
+			SendmailPath: getenvDefault("PURSUEMAIL_SENDMAIL_PATH", "/usr/sbin/sendmail"),
+			MailPath:     os.Getenv("PURSUEMAIL_MAIL_PATH"),
+			HTTPAPIURL:   os.Getenv("PURSUEMAIL_HTTP_API_URL"),
+			HTTPAPIKey:   os.Getenv("PURSUEMAIL_HTTP_API_KEY"),
+			DNSServer:    getenvDefault("PURSUEMAIL_DNS_SERVER", "127.0.0.1:53"),
+			DirectPort:   getenvDefault("PURSUEMAIL_DIRECT_PORT", "25"),
+			DKIMFile:     os.Getenv("PURSUEMAIL_DKIM_FILE"),
+		},
+		Store:         getenvDefault("PURSUEMAIL_STORE", StorePostgres),
+		LogLevel:      getenvDefault("PURSUEMAIL_LOG_LEVEL", "info"),
+		LogFormat:     getenvDefault("PURSUEMAIL_LOG_FORMAT", telemetry.LogFormatJSON),
+		LogEmails:     getenvDefault("PURSUEMAIL_LOG_EMAILS", telemetry.LogEmailsRedact),
+		TraceExporter: os.Getenv("PURSUEMAIL_TRACE_EXPORTER"),
+		OTLPEndpoint:  getenvDefault("PURSUEMAIL_OTLP_ENDPOINT", "http://127.0.0.1:4318/v1/traces"),
+	}
+	cfg.Mailer.PublicURL = getenvDefault("PURSUEMAIL_PUBLIC_URL", "http://"+cfg.Server.Addr)
+
+	cfg.Transport.HELOName = os.Getenv("PURSUEMAIL_HELO_NAME")
+	if cfg.Transport.HELOName == "" {
+		cfg.Transport.HELOName, _ = os.Hostname()
+	}
+
+	var err error
+
+	cfg.Mailer.RequireVerification, err = getenvBool("PURSUEMAIL_REQUIRE_VERIFICATION", false)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := []byte(os.Getenv("PURSUEMAIL_VERIFY_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	cfg.Mailer.VerifySecret = deriveKey(secret, "pursuemail verification token")
+
+	// Set up logging before anything else is logged
+	err = telemetry.ConfigureLogging(cfg.LogLevel, cfg.LogFormat, cfg.LogEmails,
+		deriveKey(secret, "pursuemail log email hash"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid logging config: %v", err)
+	}
+	if os.Getenv("PURSUEMAIL_VERIFY_SECRET") == "" {
+		// Links signed with a random secret would stop working when
+		// PursueMail restarts
+		if cfg.Mailer.SystemFrom != "" || cfg.Mailer.RequireVerification {
+			return nil, errors.New("PURSUEMAIL_VERIFY_SECRET must be set to send confirmation emails")
+		}
+		if cfg.LogEmails == telemetry.LogEmailsHash {
+			log.Warn("PURSUEMAIL_VERIFY_SECRET not set; hashed addresses in " +
+				"logs will change when PursueMail restarts")
+		}
+	}
+
+	switch cfg.Store {
+	case StorePostgres:
+	case StoreMemory:
+		log.Warn("Using the memory store; accounts, templates and queued " +
+			"email will be lost when PursueMail restarts")
+	default:
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_STORE %q: must be %s or %s",
+			cfg.Store, StorePostgres, StoreMemory)
+	}
+
+	cfg.Migrate, err = getenvBool("PURSUEMAIL_MIGRATE", true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = loadPostgresConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.Mailer.VerifyTTL, err = time.ParseDuration(getenvDefault("PURSUEMAIL_VERIFY_TTL", "48h"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_VERIFY_TTL: %v", err)
+	}
+
+	cfg.Server.MaxAttachmentBytes, err = getenvInt64("PURSUEMAIL_MAX_ATTACHMENT_BYTES", 10<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Server.AttachmentTypes = server.DefaultAttachmentTypes
+	if types := os.Getenv("PURSUEMAIL_ATTACHMENT_TYPES"); types != "" {
+		cfg.Server.AttachmentTypes = splitList(types)
+	}
+
+	cfg.SchedulerInterval, err = time.ParseDuration(
+		getenvDefault("PURSUEMAIL_SCHEDULER_INTERVAL", "10s"))
+	if err == nil && cfg.SchedulerInterval <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_SCHEDULER_INTERVAL: %v", err)
+	}
+
+	cfg.Server.CORSOrigins = splitList(os.Getenv("PURSUEMAIL_CORS_ORIGINS"))
+
+	cfg.Server.CORSMaxAge, err = time.ParseDuration(getenvDefault("PURSUEMAIL_CORS_MAX_AGE", "10m"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_CORS_MAX_AGE: %v", err)
+	}
+
+	cfg.Server.HSTSMaxAge, err = time.ParseDuration(getenvDefault("PURSUEMAIL_HSTS_MAX_AGE", "8760h"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_HSTS_MAX_AGE: %v", err)
+	}
+
+	cfg.TraceSampleRatio, err = strconv.ParseFloat(getenvDefault("PURSUEMAIL_TRACE_SAMPLE_RATIO", "1"), 64)
+	if err != nil || cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_TRACE_SAMPLE_RATIO: must be between 0 and 1")
+	}
+
+	cfg.Transport.SMTPTimeout, err = time.ParseDuration(getenvDefault("PURSUEMAIL_SMTP_TIMEOUT", "15s"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PURSUEMAIL_SMTP_TIMEOUT: %v", err)
+	}
+
+	cfg.Transport.SMTPTLS = mailer.TLSPolicy{
+		Mode:       getenvDefault("PURSUEMAIL_SMTP_TLS", mailer.TLSOpportunistic),
+		CAFile:     os.Getenv("PURSUEMAIL_SMTP_CA_FILE"),
+		ClientCert: os.Getenv("PURSUEMAIL_SMTP_CLIENT_CERT"),
+		ClientKey:  os.Getenv("PURSUEMAIL_SMTP_CLIENT_KEY"),
+		ServerName: os.Getenv("PURSUEMAIL_SMTP_TLS_SERVER_NAME"),
+		MinVersion: os.Getenv("PURSUEMAIL_SMTP_TLS_MIN_VERSION"),
+	}
+	if err = cfg.Transport.SMTPTLS.Validate(); err != nil {
+		return nil, err
+	}
+	// Existing deployments may rely on relays without STARTTLS, so
+	// requiring it is opt-in
+	if os.Getenv("PURSUEMAIL_SMTP_TLS") == "" && cfg.Transport.Transport == mailer.TransportSMTP {
+		log.Warn("PURSUEMAIL_SMTP_TLS not set; email goes out in plaintext to SMTP " +
+			"servers that don't offer STARTTLS. Set it to required to refuse them")
+	}
+
+	return cfg, nil
+}
+
+func loadPostgresConfig(cfg *Config) error {
+	cfg.Postgres = store.PostgresConfig{
+		DSN:         os.Getenv("PURSUEMAIL_DATABASE_URL"),
+		Host:        getenvDefault("PURSUEMAIL_PG_HOST", "127.0.0.1"),
+		Port:        getenvDefault("PURSUEMAIL_PG_PORT", "5432"),
+		User:        getenvDefault("PURSUEMAIL_PG_USER", "pursuemail"),
+		Password:    os.Getenv("PGPASSWORD"),
+		Database:    getenvDefault("PURSUEMAIL_PG_DATABASE", "pursuemail"),
+		SSLMode:     getenvDefault("PURSUEMAIL_PG_SSLMODE", store.SSLDisable),
+		SSLRootCert: os.Getenv("PURSUEMAIL_PG_SSLROOTCERT"),
+		SSLCert:     os.Getenv("PURSUEMAIL_PG_SSLCERT"),
+		SSLKey:      os.Getenv("PURSUEMAIL_PG_SSLKEY"),
+	}
+
+	maxOpen, err := getenvInt64("PURSUEMAIL_PG_MAX_OPEN_CONNS", 20)
+	if err != nil {
+		return err
+	}
+	maxIdle, err := getenvInt64("PURSUEMAIL_PG_MAX_IDLE_CONNS", 5)
+	if err != nil {
+		return err
+	}
+	cfg.Postgres.MaxOpenConns, cfg.Postgres.MaxIdleConns = int(maxOpen), int(maxIdle)
+
+	cfg.Postgres.ConnMaxLifetime, err = time.ParseDuration(
+		getenvDefault("PURSUEMAIL_PG_CONN_MAX_LIFETIME", "30m"))
+	if err != nil {
+		return fmt.Errorf("Invalid PURSUEMAIL_PG_CONN_MAX_LIFETIME: %v", err)
+	}
+	cfg.Postgres.ConnMaxIdleTime, err = time.ParseDuration(
+		getenvDefault("PURSUEMAIL_PG_CONN_MAX_IDLE_TIME", "5m"))
+	if err != nil {
+		return fmt.Errorf("Invalid PURSUEMAIL_PG_CONN_MAX_IDLE_TIME: %v", err)
+	}
+
+	// Migrations connect to the same server as the role that owns the
+	// schema
+	cfg.Migrator = cfg.Postgres
+	cfg.Migrator.DSN = os.Getenv("PURSUEMAIL_MIGRATOR_DATABASE_URL")
+	cfg.Migrator.User = getenvDefault("PURSUEMAIL_MIGRATOR_USER", "pursuemail_migrator")
+	cfg.Migrator.Password = os.Getenv("PURSUEMAIL_MIGRATOR_PASSWORD")
+
+	if cfg.Store != StorePostgres {
+		return nil
+	}
+	if err = cfg.Postgres.Validate(); err != nil {
+		return err
+	}
+	return cfg.Migrator.Validate()
+}
+
+// deriveKey derives a key for one use from secret, so that no two uses
+// share a key.
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func getenvDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getenvBool(key string, defaultValue bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s: %v", key, err)
+	}
+	return b, nil
+}
+
+func getenvInt64(key string, defaultValue int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %v", key, err)
+	}
+	return n, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
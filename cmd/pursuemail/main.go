@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/server"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+)
+
+func main() {
+	// TODO - Handle basic signals
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	exporter, err := telemetry.NewSpanExporter(cfg.TraceExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	if exporter != nil {
+		telemetry.ConfigureTracing(exporter, cfg.TraceSampleRatio)
+		defer exporter.Shutdown()
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := RunMigrate(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("Error migrating: %v", err)
+		}
+		return
+	}
+
+	var st store.Store
+	if cfg.Store == StoreMemory {
+		st = store.NewMemory()
+	} else {
+		if cfg.Migrate {
+			migrateAtStartup(cfg)
+		}
+
+		db := MustGetDb(&cfg.Postgres)
+		defer db.Close()
+
+		pg := store.NewPostgres(db)
+		if err := pg.CheckRuntimeRole(context.Background()); err != nil {
+			log.Fatalf("Refusing to start: %v. Connect as a role with only the "+
+				"grants in store/migrations", err)
+		}
+		st = pg
+	}
+
+	transport, err := mailer.NewTransport(&cfg.Transport)
+	if err != nil {
+		log.Fatalf("Error setting up %s transport: %v", cfg.Transport.Transport, err)
+	}
+	defer transport.Close()
+
+	m := mailer.New(st, transport, cfg.Mailer)
+	if err := m.CheckSystemKey(); err != nil {
+		log.Warnf("Confirmations and digests to accounts with a public key "+
+			"will fail until PURSUEMAIL_FROM has a private key. Err: %s", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go mailer.NewScheduler(m, cfg.SchedulerInterval).Run(stop)
+	go server.ExpireIdempotencyKeys(st, server.IdempotencyExpiryInterval, stop)
+
+	server.RegisterQueueMetrics(st)
+
+	srv := server.NewServer(&cfg.Server, st, m)
+	log.Infof("Listening on %s", cfg.Server.Addr)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// migrateAtStartup applies pending migrations as the migrator role.
+func migrateAtStartup(cfg *Config) {
+	db := MustGetMigratorDb(cfg)
+	defer db.Close()
+
+	n, err := store.NewPostgres(db).Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Error migrating: %v", err)
+	}
+	log.Infof("Applied %d migrations", n)
+}
+
+// MustGetMigratorDb connects as the role that owns the schema.
+func MustGetMigratorDb(cfg *Config) *sql.DB {
+	if cfg.Postgres.DSN != "" && cfg.Migrator.DSN == "" {
+		log.Fatal("PURSUEMAIL_MIGRATOR_DATABASE_URL must be set to migrate " +
+			"when PURSUEMAIL_DATABASE_URL is")
+	}
+	return MustGetDb(&cfg.Migrator)
+}
+
+func MustGetDb(pgCfg *store.PostgresConfig) *sql.DB {
+	log.Debugf("Connecting to Postgres `%s`", store.RedactConnString(pgCfg.ConnString()))
+	db, err := store.OpenPostgres(pgCfg)
+	if err != nil {
+		log.Fatalf("Error connecting to db. Err: %s", err)
+	}
+	return db
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+const migrateUsage = "Usage: pursuemail migrate up | down [steps] | status"
+
+// RunMigrate handles `pursuemail migrate`: applying pending migrations,
+// reverting the latest ones (one by default), or listing them all.
+func RunMigrate(cfg *Config, args []string) error {
+	if cfg.Store != StorePostgres {
+		return fmt.Errorf("The %s store has no schema to migrate", cfg.Store)
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db := MustGetMigratorDb(cfg)
+	defer db.Close()
+	pg := store.NewPostgres(db)
+	ctx := context.Background()
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		n, err := pg.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", n)
+
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New("Steps must be a positive number")
+			}
+		}
+		n, err := pg.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migrations\n", n)
+
+	case args[0] == "status" && len(args) == 1:
+		statuses, err := pg.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied != nil {
+				applied = status.Applied.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
-package main
+// Package crypto encrypts email with OpenPGP, using the keys in the local
+// GnuPG keyrings.
+package crypto
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
@@ -22,8 +26,10 @@ func (buf *Buffer) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func encryptEmailBody(from, to, body string) (enc []byte, err error) {
-	var buf Buffer
+// EncryptMessage encrypts msg to the public key of `to`, signed with the
+// private key of `from`, and returns it ASCII-armored.
+func EncryptMessage(from, to string, msg []byte) (enc []byte, err error) {
+	var buf bytes.Buffer
 
 	privKey, err := GetEntityFrom(from, PRIVATE_KEYRING_FILENAME)
 	if err != nil {
@@ -34,7 +40,7 @@ func encryptEmailBody(from, to, body string) (enc []byte, err error) {
 	pubKey, err := GetEntityFrom(to, PUBLIC_KEYRING_FILENAME)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting public key for %s from %s: %v",
-			to, PRIVATE_KEYRING_FILENAME, err)
+			to, PUBLIC_KEYRING_FILENAME, err)
 	}
 
 	// Produce new writer to... write encrypted messages to?
@@ -42,7 +48,6 @@ func encryptEmailBody(from, to, body string) (enc []byte, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error from armor.Encode: %v", err)
 	}
-	defer w.Close()
 
 	// Encrypt message from ME to recipient
 	plaintext, err := openpgp.Encrypt(w, []*openpgp.Entity{pubKey},
@@ -50,15 +55,21 @@ func encryptEmailBody(from, to, body string) (enc []byte, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error from openpgp.Encrypt: %v", err)
 	}
-	defer plaintext.Close()
 
 	// Write message to `plaintext` WriteCloser
-	_, err = fmt.Fprintf(plaintext, body)
-	if err != nil {
+	if _, err = plaintext.Write(msg); err != nil {
 		return nil, fmt.Errorf("Error writing to plaintext: %v", err)
 	}
 
-	return []byte(buf), nil
+	// Both writers must be closed before the output is complete
+	if err = plaintext.Close(); err != nil {
+		return nil, fmt.Errorf("Error closing plaintext: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		return nil, fmt.Errorf("Error closing armor: %v", err)
+	}
+
+	return buf.Bytes(), nil
 }
 
 // TODO: We can make this a lot better. Memoization, etc
@@ -77,7 +88,7 @@ func GetEntityFrom(email, sourceFile string) (*openpgp.Entity, error) {
 	var key *openpgp.Entity
 	for _, entity := range ring {
 		for _, ident := range entity.Identities {
-			if ident.UserId.Email == email {
+			if strings.EqualFold(ident.UserId.Email, email) {
 				key = entity
 			}
 		}
@@ -90,3 +101,12 @@ func GetEntityFrom(email, sourceFile string) (*openpgp.Entity, error) {
 
 	return key, nil
 }
+
+// CheckPrivKey returns an error if there's no private key for email in the
+// private keyring, which EncryptMessage needs to sign from that address.
+func CheckPrivKey(email string) error {
+	if _, err := GetEntityFrom(email, PRIVATE_KEYRING_FILENAME); err != nil {
+		return fmt.Errorf("No private key for %s in %s: %v", email, PRIVATE_KEYRING_FILENAME, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// HasPubKey reports whether the public keyring has a key for email.
+func HasPubKey(email string) bool {
+	_, err := GetEntityFrom(email, PUBLIC_KEYRING_FILENAME)
+	if err != nil {
+		log.Debugf("Entity not found for %s. Err: %s", email, err)
+		return false
+	}
+	return true
+}
+
+// ArmoredPubKey returns the public key for email from the keyring in
+// ASCII-armored form.
+func ArmoredPubKey(email string) (string, error) {
+	entity, err := GetEntityFrom(email, PUBLIC_KEYRING_FILENAME)
+	if err != nil {
+		return "", err
+	}
+
+	var buf Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err = entity.Serialize(w); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// CheckPubKeyFor makes sure armored is a single public key with an
+// identity for email and none for other addresses. Keys are looked up by
+// address in a shared keyring, so importing one that names another
+// address would change which key that address's mail is encrypted to.
+func CheckPubKeyFor(email, armored string) error {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return fmt.Errorf("Invalid public key: %v", err)
+	}
+	if len(entities) != 1 {
+		return fmt.Errorf("Expected one public key, got %d", len(entities))
+	}
+
+	found := false
+	for _, ident := range entities[0].Identities {
+		if !strings.EqualFold(ident.UserId.Email, email) {
+			return fmt.Errorf("Public key has an identity for another address, %q", ident.UserId.Email)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("Public key has no identity for %s", email)
+	}
+	return nil
+}
+
+// SamePubKey reports whether armored is the key the keyring has for
+// email.
+func SamePubKey(email, armored string) bool {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil || len(entities) != 1 {
+		return false
+	}
+	stored, err := GetEntityFrom(email, PUBLIC_KEYRING_FILENAME)
+	if err != nil {
+		return false
+	}
+	return stored.PrimaryKey.Fingerprint == entities[0].PrimaryKey.Fingerprint
+}
+
+func ImportPublicKey(pubkey string) error {
+	// TODO - make tempfile directory configurable
+	tmpfile, err := ioutil.TempFile("", "pubkey-import")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+
+	// Save pubkey to temp file
+	if _, err := tmpfile.Write([]byte(pubkey)); err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	cmd := "gpg"
+	args := []string{"--import", tmpfile.Name()}
+	if err := exec.Command(cmd, args...).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func DeletePublicKey(email string) error {
+	// "<email>" makes gpg match the address exactly rather than as a
+	// substring of every user ID
+	cmd := "gpg"
+	args := []string{"--batch", "--yes", "--delete-keys", "<" + email + ">"}
+	if err := exec.Command(cmd, args...).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CheckKeyrings makes sure both keyrings parse. A keyring that doesn't
+// exist yet is fine: no keys have been imported.
+func CheckKeyrings() error {
+	for _, filename := range []string{PUBLIC_KEYRING_FILENAME, PRIVATE_KEYRING_FILENAME} {
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = openpgp.ReadKeyRing(f)
+		f.Close()
+		if err != nil {
+			return errors.New("Error reading " + filename + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -7,19 +7,10 @@ if [ "`uname -s`" != "Linux" ]; then
 fi
 
 source ../.env
-psql -d postgres -c "CREATE USER pursuemail WITH PASSWORD '$PGPASSWORD';" || true
-psql -d postgres -f sql/pre.sql
-export PGHOST=localhost
-export PGUSER=pursuemail
-export PGDATABASE=pursuemail
+psql -d postgres -v ON_ERROR_STOP=1 \
+    -v runtime_password="$PGPASSWORD" \
+    -v migrator_password="$PURSUEMAIL_MIGRATOR_PASSWORD" \
+    -f sql/pre.sql
 
-# More initialization
-for file in sql/init*.sql; do
-    psql -f "$file"
-done
-# Create tables
-for file in sql/table*.sql; do
-    psql -f "$file"
-done
-
-/bin/bash migrate.sh sql/migration*.sql
+# Tables are created by pursuemail's migrations, which run as
+# pursuemail_migrator
@@ -1,4 +1,30 @@
-CREATE DATABASE pursuemail OWNER pursuemail ENCODING 'UTF8';
-GRANT ALL ON DATABASE pursuemail TO pursuemail;
-ALTER USER pursuemail WITH CREATEDB;
-ALTER USER pursuemail WITH SUPERUSER;
+/* pursuemail_migrator owns the database and schema and runs migrations.
+   pursuemail is what the service connects as; it only gets the row-level
+   grants of pursuemail_runtime. Safe to re-run, which also moves
+   databases set up when pursuemail was a superuser over to these roles. */
+SELECT 'CREATE ROLE pursuemail_migrator'
+  WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'pursuemail_migrator')\gexec
+SELECT 'CREATE ROLE pursuemail_runtime'
+  WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'pursuemail_runtime')\gexec
+SELECT 'CREATE ROLE pursuemail'
+  WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'pursuemail')\gexec
+
+ALTER ROLE pursuemail_migrator WITH LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE
+  PASSWORD :'migrator_password';
+ALTER ROLE pursuemail_runtime WITH NOLOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE;
+ALTER ROLE pursuemail WITH LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE
+  PASSWORD :'runtime_password';
+GRANT pursuemail_runtime TO pursuemail;
+
+SELECT 'CREATE DATABASE pursuemail OWNER pursuemail_migrator ENCODING ''UTF8'''
+  WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = 'pursuemail')\gexec
+ALTER DATABASE pursuemail OWNER TO pursuemail_migrator;
+REVOKE ALL ON DATABASE pursuemail FROM PUBLIC, pursuemail;
+GRANT CONNECT ON DATABASE pursuemail TO pursuemail_runtime;
+
+\connect pursuemail
+REASSIGN OWNED BY pursuemail TO pursuemail_migrator;
+/* Needs more than the migrator's rights on older Postgres versions */
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+REVOKE CREATE ON SCHEMA public FROM PUBLIC;
+GRANT CREATE, USAGE ON SCHEMA public TO pursuemail_migrator;
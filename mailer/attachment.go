@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"bytes"
+	"path"
+	"strings"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	emailLib "github.com/jordan-wright/email"
+)
+
+// SanitizeFilename strips directories and characters that would break
+// out of a quoted MIME header parameter.
+func SanitizeFilename(filename string) string {
+	filename = path.Base(strings.Replace(filename, `\`, "/", -1))
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, filename)
+}
+
+func attachAll(em *emailLib.Email, attachments []api.Attachment) error {
+	for _, a := range attachments {
+		_, err := em.Attach(bytes.NewReader(a.Data), SanitizeFilename(a.Filename), a.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
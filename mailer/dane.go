@@ -0,0 +1,131 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSA certificate usages that apply to SMTP (RFC 7672). The PKIX ones
+// (0 and 1) aren't usable there.
+const (
+	tlsaUsageDANETA = 2
+	tlsaUsageDANEEE = 3
+)
+
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+func (r *tlsaRecord) usable() bool {
+	return (r.Usage == tlsaUsageDANETA || r.Usage == tlsaUsageDANEEE) &&
+		r.Selector <= 1 && r.MatchingType <= 2
+}
+
+// matches reports whether cert is the one the record describes.
+func (r *tlsaRecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// lookupTLSA returns the usable TLSA records for SMTP on host, and
+// whether any TLSA records were found with DNSSEC at all. Records the
+// resolver didn't validate are ignored.
+func (c *dnsClient) lookupTLSA(host, port string) (records []tlsaRecord, secure bool, err error) {
+	resp, err := c.query("_"+port+"._tcp."+host, dnsTypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.Rcode == dnsRcodeNXDomain || !resp.Authenticated {
+		return nil, false, nil
+	}
+	if resp.Rcode != dnsRcodeSuccess {
+		return nil, false, fmt.Errorf("TLSA lookup for %s failed with rcode %d", host, resp.Rcode)
+	}
+
+	for _, answer := range resp.Answers {
+		if answer.Type != dnsTypeTLSA {
+			continue
+		}
+		data := resp.data(answer)
+		if len(data) < 4 {
+			continue
+		}
+		secure = true
+		record := tlsaRecord{Usage: data[0], Selector: data[1], MatchingType: data[2], Data: data[3:]}
+		if record.usable() {
+			records = append(records, record)
+		}
+	}
+	return records, secure, nil
+}
+
+// daneVerifier checks the server's certificate chain against records
+// instead of the usual WebPKI checks. A DANE-EE record pins the server
+// certificate itself, regardless of name or expiry; a DANE-TA record
+// names a trust anchor that must have issued a certificate for host.
+func daneVerifier(host string, records []tlsaRecord) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("DANE: server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		for _, record := range records {
+			if record.Usage == tlsaUsageDANEEE && record.matches(certs[0]) {
+				return nil
+			}
+		}
+
+		for _, record := range records {
+			if record.Usage != tlsaUsageDANETA {
+				continue
+			}
+			for _, anchor := range certs {
+				if !record.matches(anchor) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(anchor)
+				intermediates := x509.NewCertPool()
+				for _, cert := range certs[1:] {
+					intermediates.AddCert(cert)
+				}
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       strings.TrimSuffix(host, "."),
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("DANE: certificate for %s matches none of its TLSA records", host)
+	}
+}
@@ -0,0 +1,162 @@
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert returns a certificate for host issued by parent, or a
+// self-signed CA if parent is nil.
+func newTestCert(t *testing.T, host string, parent *testCert, notAfter time.Time) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	issuer, signer := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{host}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func TestTLSARecordMatches(t *testing.T) {
+	cert := newTestCert(t, "ca", nil, time.Now().Add(time.Hour)).cert
+	other := newTestCert(t, "ca", nil, time.Now().Add(time.Hour)).cert
+
+	certSHA256 := sha256.Sum256(cert.Raw)
+	certSHA512 := sha512.Sum512(cert.Raw)
+	spkiSHA256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	spkiSHA512 := sha512.Sum512(cert.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name   string
+		record tlsaRecord
+		want   bool
+	}{
+		{"full cert", tlsaRecord{3, 0, 0, cert.Raw}, true},
+		{"cert sha256", tlsaRecord{3, 0, 1, certSHA256[:]}, true},
+		{"cert sha512", tlsaRecord{3, 0, 2, certSHA512[:]}, true},
+		{"full spki", tlsaRecord{3, 1, 0, cert.RawSubjectPublicKeyInfo}, true},
+		{"spki sha256", tlsaRecord{3, 1, 1, spkiSHA256[:]}, true},
+		{"spki sha512", tlsaRecord{3, 1, 2, spkiSHA512[:]}, true},
+		{"cert hash as spki", tlsaRecord{3, 1, 1, certSHA256[:]}, false},
+		{"sha256 as sha512", tlsaRecord{3, 0, 2, certSHA256[:]}, false},
+		{"truncated hash", tlsaRecord{3, 0, 1, certSHA256[:31]}, false},
+		{"other cert", tlsaRecord{3, 0, 0, other.Raw}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.record.matches(cert); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTLSARecordUsable(t *testing.T) {
+	tests := []struct {
+		record tlsaRecord
+		want   bool
+	}{
+		{tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1}, true},
+		{tlsaRecord{Usage: 2, Selector: 0, MatchingType: 2}, true},
+		{tlsaRecord{Usage: 2, Selector: 0, MatchingType: 0}, true},
+		// PKIX-TA and PKIX-EE don't apply to SMTP
+		{tlsaRecord{Usage: 0, Selector: 1, MatchingType: 1}, false},
+		{tlsaRecord{Usage: 1, Selector: 1, MatchingType: 1}, false},
+		{tlsaRecord{Usage: 4, Selector: 1, MatchingType: 1}, false},
+		{tlsaRecord{Usage: 3, Selector: 2, MatchingType: 1}, false},
+		{tlsaRecord{Usage: 3, Selector: 1, MatchingType: 3}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.record.usable(); got != tt.want {
+			t.Errorf("%+v usable = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestDANEVerifier(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, time.Now().Add(time.Hour))
+	leaf := newTestCert(t, "mx.example.com", ca, time.Now().Add(time.Hour))
+	expired := newTestCert(t, "mx.example.com", ca, time.Now().Add(-time.Minute))
+	otherCA := newTestCert(t, "ca", nil, time.Now().Add(time.Hour))
+
+	spki := func(c *testCert) []byte {
+		sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+		return sum[:]
+	}
+	chain := func(certs ...*testCert) [][]byte {
+		var raw [][]byte
+		for _, c := range certs {
+			raw = append(raw, c.cert.Raw)
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		records []tlsaRecord
+		chain   [][]byte
+		ok      bool
+	}{
+		{"EE match", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(leaf)}}, chain(leaf), true},
+		// DANE-EE ignores the name and expiry
+		{"EE other name", "mx.example.org", []tlsaRecord{{3, 1, 1, spki(leaf)}}, chain(leaf), true},
+		{"EE expired", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(expired)}}, chain(expired), true},
+		{"EE pins the CA", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(ca)}}, chain(leaf, ca), false},
+		{"EE mismatch", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(otherCA)}}, chain(leaf), false},
+		{"TA match", "mx.example.com", []tlsaRecord{{2, 1, 1, spki(ca)}}, chain(leaf, ca), true},
+		{"TA trailing dot", "mx.example.com.", []tlsaRecord{{2, 1, 1, spki(ca)}}, chain(leaf, ca), true},
+		{"TA wrong host", "mx.example.org", []tlsaRecord{{2, 1, 1, spki(ca)}}, chain(leaf, ca), false},
+		{"TA expired leaf", "mx.example.com", []tlsaRecord{{2, 1, 1, spki(ca)}}, chain(expired, ca), false},
+		{"TA not sent", "mx.example.com", []tlsaRecord{{2, 1, 1, spki(ca)}}, chain(leaf), false},
+		{"TA other CA", "mx.example.com", []tlsaRecord{{2, 1, 1, spki(otherCA)}}, chain(leaf, otherCA), false},
+		{"second record matches", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(otherCA)}, {2, 1, 1, spki(ca)}}, chain(leaf, ca), true},
+		{"no records", "mx.example.com", nil, chain(leaf, ca), false},
+		{"no certificate", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(leaf)}}, nil, false},
+		{"garbage certificate", "mx.example.com", []tlsaRecord{{3, 1, 1, spki(leaf)}}, [][]byte{{1, 2, 3}}, false},
+	}
+	for _, tt := range tests {
+		err := daneVerifier(tt.host, tt.records)(tt.chain, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
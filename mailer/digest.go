@@ -0,0 +1,132 @@
+package mailer
+
+import (
+	"context"
+	htmlTemplate "html/template"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Digests are rendered with the stored template of this name if there
+// is one, and with builtinDigestTemplate otherwise. Either gets these
+// vars: "items" (each with "from", "subject", "body", "html" and
+// "created"), "count" and "mode".
+const digestTemplateName = "digest"
+
+var builtinDigestTemplate = mustCompileTemplate(&store.EmailTemplate{
+	Name:    digestTemplateName,
+	Subject: `{{.count}} new notification{{if ne .count 1}}s{{end}}`,
+	Text: `{{range .items}}== {{.subject}} ==
+
+{{.body}}
+
+{{end}}`,
+	HTML: `{{range .items}}<h3>{{.subject}}</h3>
+{{if .html}}{{.html}}{{else}}<pre>{{.body}}</pre>{{end}}
+<hr>
+{{end}}`,
+})
+
+func mustCompileTemplate(t *store.EmailTemplate) *CompiledTemplate {
+	ct, err := Compile(t)
+	if err != nil {
+		panic(err)
+	}
+	return ct
+}
+
+// FlushDueDigests sends a digest to every account whose oldest queued
+// item has waited a full interval. Items queued for accounts since
+// switched to immediate mode are sent right away.
+func (m *Mailer) FlushDueDigests() {
+	ids, err := m.Store.DueDigests()
+	if err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		ctx, span := telemetry.StartSpan(context.Background(), "FlushDigest")
+		span.SetAttribute("pursuemail.account_id", id)
+		err := m.flushDigest(ctx, id)
+		span.RecordError(err)
+		span.Finish()
+		if err != nil {
+			log.Errorf("Error sending digest to %s: %v", id, err)
+		}
+	}
+}
+
+// flushDigest sends the account's queued items as one email. They're
+// only removed if it's sent, so a failed digest is retried later, unless
+// the recipient's server rejected it outright.
+func (m *Mailer) flushDigest(ctx context.Context, accountId string) error {
+	emailAccount, err := m.GetEmailAccount(ctx, accountId)
+	if err != nil {
+		return err
+	}
+
+	return m.Store.ClaimDigestItems(accountId, func(items []*store.DigestItem) error {
+		// Don't send secure-only items in the clear if the key has since
+		// been removed
+		if !hasPubKey(ctx, emailAccount) {
+			kept := items[:0]
+			for _, item := range items {
+				if item.SecureOnly {
+					secureOnlyRejectionsTotal.Inc("digest")
+					log.Warnf("Dropping SecureOnly digest item for %s - no pub key", accountId)
+					continue
+				}
+				kept = append(kept, item)
+			}
+			items = kept
+		}
+
+		if len(items) == 0 {
+			return nil
+		}
+		emailData, err := m.renderDigest(emailAccount.DigestMode, items)
+		if err != nil {
+			return err
+		}
+		err = m.Deliver(ctx, emailAccount, emailData)
+		if isPermanentSMTPError(err) {
+			return &store.UndeliverableError{Err: err}
+		}
+		return err
+	})
+}
+
+func (m *Mailer) renderDigest(mode string, items []*store.DigestItem) (api.EmailData, error) {
+	tmpl, err := LoadCompiledTemplate(m.Store, digestTemplateName, 0)
+	if err == store.ErrTemplateNotFound {
+		tmpl, err = builtinDigestTemplate, nil
+	}
+	if err != nil {
+		return api.EmailData{}, err
+	}
+
+	emailData := api.EmailData{From: m.Config.SystemFrom}
+	vars := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		vars = append(vars, map[string]interface{}{
+			"from":    item.EmailData.From,
+			"subject": item.EmailData.Subject,
+			"body":    item.EmailData.Body,
+			"html":    htmlTemplate.HTML(item.EmailData.HTML),
+			"created": item.Created,
+		})
+		emailData.Attachments = append(emailData.Attachments, item.EmailData.Attachments...)
+	}
+	if emailData.From == "" {
+		emailData.From = items[len(items)-1].EmailData.From
+	}
+
+	return tmpl.Render(emailData, map[string]interface{}{
+		"items": vars,
+		"count": len(items),
+		"mode":  mode,
+	})
+}
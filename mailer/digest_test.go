@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+// failingTransport fails every send with err.
+type failingTransport struct {
+	err error
+}
+
+func (t *failingTransport) Send(msg *Message) error {
+	return t.err
+}
+
+func (t *failingTransport) Close() error {
+	return nil
+}
+
+func TestFlushDueDigestsDropsRejectedDigests(t *testing.T) {
+	dir := t.TempDir()
+	pubring, secring := crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME
+	crypto.PUBLIC_KEYRING_FILENAME = filepath.Join(dir, "pubring.gpg")
+	crypto.PRIVATE_KEYRING_FILENAME = filepath.Join(dir, "secring.gpg")
+	defer func() {
+		crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME = pubring, secring
+	}()
+
+	tests := []struct {
+		name    string
+		err     error
+		dropped bool
+	}{
+		{"temporary failure", rejected(&textproto.Error{Code: 451, Msg: "Try again later"}), false},
+		{"connection failure", errors.New("Connection refused"), false},
+		{"rejected", rejected(&textproto.Error{Code: 550, Msg: "No such user"}), true},
+	}
+	for _, tt := range tests {
+		st := store.NewMemory()
+		account := &store.EmailAccount{Email: "someone@example.com", DigestMode: api.DigestImmediate}
+		if _, err := st.SaveEmailAccount(account); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.QueueDigestItem(account, api.EmailData{From: "sender@example.org", Subject: "Hi", Body: "Hello"}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		m := New(st, &failingTransport{tt.err}, Config{})
+		m.FlushDueDigests()
+		if _, queued, _ := st.QueueDepth(); (queued == 0) != tt.dropped {
+			t.Errorf("%s: %d items still queued, want dropped = %v", tt.name, queued, tt.dropped)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var ErrNullMX = errors.New("Domain doesn't accept email (null MX)")
+
+// DirectTransport delivers email straight to each recipient domain's MX
+// hosts rather than through a relay.
+//
+// TLS is used whenever the MX host offers it. It's required, with the
+// certificate checked against the host's TLSA records, when those and
+// the host's MX and address records are DNSSEC-signed (DANE, RFC 7672).
+// Failing that, a domain's MTA-STS policy (RFC 8461) in enforce mode
+// limits delivery to the MX hosts it lists, over TLS verified the usual
+// way.
+type DirectTransport struct {
+	dns *dnsClient
+	sts *mtaSTSCache
+
+	heloName string
+	port     string
+	timeout  time.Duration
+}
+
+// NewDirectTransport looks up records with the DNS server at dnsServer
+// ("host:port"), which should be a DNSSEC-validating resolver reached
+// over a trusted path. heloName is how PursueMail introduces itself to
+// MX hosts, and port is normally 25.
+func NewDirectTransport(dnsServer, heloName, port string, timeout time.Duration) *DirectTransport {
+	dialer := &net.Dialer{Timeout: timeout}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, dnsServer)
+		},
+	}
+	return &DirectTransport{
+		dns:      &dnsClient{server: dnsServer, timeout: timeout},
+		sts:      newMTASTSCache(resolver, timeout),
+		heloName: heloName,
+		port:     port,
+		timeout:  timeout,
+	}
+}
+
+// Send delivers msg to each recipient domain in turn.
+func (t *DirectTransport) Send(msg *Message) error {
+	var domains []string
+	byDomain := map[string][]string{}
+	for _, rcpt := range msg.To {
+		domain := strings.ToLower(addressDomain(rcpt))
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	var errs []string
+	var lastErr error
+	for _, domain := range domains {
+		if err := t.deliver(domain, byDomain[domain], msg); err != nil {
+			errs = append(errs, domain+": "+err.Error())
+			lastErr = err
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return lastErr
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+func (t *DirectTransport) deliver(domain string, rcpts []string, msg *Message) error {
+	mxs, secure, err := t.lookupMX(domain)
+	if err != nil {
+		return err
+	}
+
+	policy, err := t.sts.Policy(domain)
+	if err != nil {
+		log.Warnf("Error getting MTA-STS policy for %s: %v", domain, err)
+	}
+	if policy != nil && policy.Mode == mtaSTSNone {
+		policy = nil
+	}
+
+	lastErr := fmt.Errorf("No MX host for %s", domain)
+	for _, mx := range mxs {
+		if policy != nil && !policy.allows(mx) {
+			if policy.Mode == mtaSTSEnforce {
+				lastErr = fmt.Errorf("MX host %s isn't allowed by %s's MTA-STS policy", mx, domain)
+				continue
+			}
+			log.Warnf("MX host %s isn't allowed by %s's MTA-STS policy (testing mode)", mx, domain)
+		}
+
+		// DANE only applies if the MX host's addresses are DNSSEC-signed
+		// too, or they could have been swapped for an attacker's
+		addrs, secureAddrs, err := t.lookupAddrs(mx)
+		var tlsConfig *tls.Config
+		var required bool
+		if err == nil {
+			tlsConfig, required, err = t.tlsFor(mx, secure && secureAddrs, policy)
+		}
+		if err == nil {
+			start := time.Now()
+			err = t.deliverTo(mx, addrs, tlsConfig, required, msg.From, rcpts, msg.Data)
+			// Labelled by transport rather than MX host, which would give
+			// away recipient domains
+			smtpSendSeconds.ObserveSince(start, TransportDirect, outcome(err))
+		}
+		if err == nil {
+			return nil
+		}
+		if isPermanentSMTPError(err) {
+			return err
+		}
+		log.Warnf("Error delivering to MX host %s: %v", mx, err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+// lookupMX returns domain's MX hosts, most preferred first, and whether
+// the answer was DNSSEC-validated. A domain without MX records is its
+// own MX host.
+func (t *DirectTransport) lookupMX(domain string) (hosts []string, secure bool, err error) {
+	resp, err := t.dns.query(domain, dnsTypeMX)
+	if err != nil {
+		return nil, false, err
+	}
+	switch resp.Rcode {
+	case dnsRcodeSuccess:
+	case dnsRcodeNXDomain:
+		return nil, false, fmt.Errorf("Domain %s doesn't exist", domain)
+	default:
+		return nil, false, fmt.Errorf("MX lookup for %s failed with rcode %d", domain, resp.Rcode)
+	}
+
+	type mx struct {
+		pref uint16
+		host string
+	}
+	var mxs []mx
+	for _, answer := range resp.Answers {
+		if answer.Type != dnsTypeMX || answer.length < 3 {
+			continue
+		}
+		host, _, err := readDNSName(resp.msg, answer.offset+2)
+		if err != nil {
+			return nil, false, err
+		}
+		mxs = append(mxs, mx{binary.BigEndian.Uint16(resp.data(answer)), host})
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, resp.Authenticated, nil
+	}
+	if len(mxs) == 1 && mxs[0].host == "." {
+		return nil, false, ErrNullMX
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].pref < mxs[j].pref })
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.host, "."))
+	}
+	return hosts, resp.Authenticated, nil
+}
+
+// lookupAddrs returns host's IPv4 and IPv6 addresses, and whether all of
+// them were DNSSEC-validated. Failing to look up one kind is only an
+// error if there are none of the other.
+func (t *DirectTransport) lookupAddrs(host string) (addrs []net.IP, secure bool, err error) {
+	secure = true
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		resp, queryErr := t.dns.query(host, qtype)
+		if queryErr == nil && resp.Rcode != dnsRcodeSuccess {
+			queryErr = fmt.Errorf("Address lookup for %s failed with rcode %d", host, resp.Rcode)
+		}
+		if queryErr != nil {
+			secure, err = false, queryErr
+			continue
+		}
+		secure = secure && resp.Authenticated
+		for _, answer := range resp.Answers {
+			data := resp.data(answer)
+			if (answer.Type == dnsTypeA && len(data) == net.IPv4len) ||
+				(answer.Type == dnsTypeAAAA && len(data) == net.IPv6len) {
+				addrs = append(addrs, net.IP(append([]byte(nil), data...)))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if err == nil {
+			err = fmt.Errorf("MX host %s has no addresses", host)
+		}
+		return nil, false, err
+	}
+	return addrs, secure, nil
+}
+
+// tlsFor decides how to secure the connection to mx, and whether to
+// refuse to deliver without TLS.
+func (t *DirectTransport) tlsFor(mx string, secureMX bool, policy *mtaSTSPolicy) (*tls.Config, bool, error) {
+	if secureMX {
+		records, secureTLSA, err := t.dns.lookupTLSA(mx, t.port)
+		if err != nil {
+			return nil, false, err
+		}
+		if secureTLSA {
+			tlsConfig := &tls.Config{ServerName: mx, InsecureSkipVerify: true}
+			if len(records) > 0 {
+				tlsConfig.VerifyPeerCertificate = daneVerifier(mx, records)
+			}
+			return tlsConfig, true, nil
+		}
+	}
+
+	if policy != nil && policy.Mode == mtaSTSEnforce {
+		return &tls.Config{ServerName: mx}, true, nil
+	}
+
+	// Without a policy, encryption is still better than none even if the
+	// certificate can't be checked
+	return &tls.Config{ServerName: mx, InsecureSkipVerify: true}, false, nil
+}
+
+// deliverTo connects to the first of host's addresses that answers, and
+// delivers to it.
+func (t *DirectTransport) deliverTo(host string, addrs []net.IP, tlsConfig *tls.Config, requireTLS bool, from string, rcpts []string, data []byte) error {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	var conn net.Conn
+	err := fmt.Errorf("MX host %s has no addresses", host)
+	for _, addr := range addrs {
+		if conn, err = dialer.Dial("tcp", net.JoinHostPort(addr.String(), t.port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(5 * t.timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Hello(t.heloName); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	} else if requireTLS {
+		return ErrStartTLSRequired
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err = c.Rcpt(rcpt); err != nil {
+			return rejected(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return rejected(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return rejected(err)
+	}
+	return c.Quit()
+}
+
+func (t *DirectTransport) Close() error {
+	return nil
+}
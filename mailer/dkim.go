@@ -0,0 +1,333 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DKIMAlgorithmRSA     = "rsa-sha256"
+	DKIMAlgorithmEd25519 = "ed25519-sha256"
+)
+
+// Header fields signed when present, in this order. From is always
+// signed.
+var dkimSignedHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-Id", "In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// DKIMConfig is the JSON file listing the DKIM keys to sign outgoing
+// email with (see PURSUEMAIL_DKIM_FILE).
+type DKIMConfig struct {
+	Keys []DKIMKeyConfig `json:"keys"`
+}
+
+// DKIMKeyConfig is a signing key for a domain. A domain may have several,
+// e.g. an RSA and an Ed25519 key, in which case every email is signed
+// with each of them.
+type DKIMKeyConfig struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+
+	// PEM file holding an RSA (PKCS #1 or #8) or Ed25519 (PKCS #8)
+	// private key
+	PrivateKeyFile string `json:"private_key_file"`
+}
+
+type dkimKey struct {
+	domain    string
+	selector  string
+	algorithm string
+	signer    crypto.Signer
+}
+
+// DKIMSigner adds DKIM signatures (RFC 6376, and RFC 8463 for Ed25519)
+// to messages, with relaxed/relaxed canonicalization.
+type DKIMSigner struct {
+	// Keys by lowercase domain
+	keys map[string][]*dkimKey
+}
+
+func LoadDKIMSigner(path string) (*DKIMSigner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dc DKIMConfig
+	if err = json.Unmarshal(b, &dc); err != nil {
+		return nil, fmt.Errorf("Invalid DKIM file %s: %v", path, err)
+	}
+	if len(dc.Keys) == 0 {
+		return nil, fmt.Errorf("DKIM file %s lists no keys", path)
+	}
+
+	s := &DKIMSigner{keys: map[string][]*dkimKey{}}
+	for i, kc := range dc.Keys {
+		if kc.Domain == "" || kc.Selector == "" || kc.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("DKIM key #%d in %s needs a domain, selector and private_key_file", i+1, path)
+		}
+		key, err := loadDKIMKey(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM key #%d in %s: %v", i+1, path, err)
+		}
+		key.domain = strings.ToLower(strings.TrimSuffix(kc.Domain, "."))
+		key.selector = kc.Selector
+		s.keys[key.domain] = append(s.keys[key.domain], key)
+	}
+	return s, nil
+}
+
+func loadDKIMKey(path string) (*dkimKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("RSA key in %s is shorter than 1024 bits", path)
+		}
+		return &dkimKey{algorithm: DKIMAlgorithmRSA, signer: k}, nil
+	case ed25519.PrivateKey:
+		return &dkimKey{algorithm: DKIMAlgorithmEd25519, signer: k}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T in %s", parsed, path)
+}
+
+// keysFor returns the keys for from's domain, or failing that for the
+// closest parent domain that has any.
+func (s *DKIMSigner) keysFor(from string) []*dkimKey {
+	domain := strings.ToLower(addressDomain(from))
+	for domain != "" {
+		if keys := s.keys[domain]; len(keys) > 0 {
+			return keys
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return nil
+}
+
+// Sign returns data with a DKIM-Signature header prepended for each of
+// the keys for from's domain, or data unchanged if there are none.
+func (s *DKIMSigner) Sign(from string, data []byte) ([]byte, error) {
+	keys := s.keysFor(from)
+	if len(keys) == 0 {
+		return data, nil
+	}
+
+	header, body := splitMessage(data)
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	fields := parseHeaderFields(header)
+
+	// Only the last instance of a repeated field is signed, as that's the
+	// one verifiers pick first
+	var names, signed []string
+	for _, name := range dkimSignedHeaders {
+		key := strings.ToLower(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].key == key {
+				names = append(names, key)
+				signed = append(signed, fields[i].raw)
+				break
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return nil, errors.New("Message has no From header to sign")
+	}
+
+	var sigs bytes.Buffer
+	for _, key := range keys {
+		sig, err := key.sign(names, signed, bodyHash[:])
+		if err != nil {
+			return nil, err
+		}
+		sigs.WriteString(sig)
+	}
+	return append(sigs.Bytes(), data...), nil
+}
+
+// sign returns the DKIM-Signature header field, CRLF included, covering
+// the signed fields (raw, under the given lowercase names) and the body
+// hash.
+func (k *dkimKey) sign(names, signed []string, bodyHash []byte) (string, error) {
+	value := "v=1; a=" + k.algorithm + "; c=relaxed/relaxed; d=" + k.domain +
+		"; s=" + k.selector + ";\r\n\tt=" + strconv.FormatInt(time.Now().Unix(), 10) +
+		"; h=" + strings.Join(names, ":") + ";\r\n\tbh=" +
+		base64.StdEncoding.EncodeToString(bodyHash) + ";\r\n\tb="
+
+	h := sha256.New()
+	for _, field := range signed {
+		h.Write([]byte(relaxedHeader(field)))
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: "+value), "\r\n")))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k.algorithm {
+	case DKIMAlgorithmRSA:
+		sig, err = k.signer.Sign(rand.Reader, digest, crypto.SHA256)
+	case DKIMAlgorithmEd25519:
+		// RFC 8463 signs the SHA-256 hash itself with PureEdDSA
+		sig, err = k.signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b := base64.StdEncoding.EncodeToString(sig)
+	var folded []string
+	for len(b) > 72 {
+		folded = append(folded, b[:72])
+		b = b[72:]
+	}
+	folded = append(folded, b)
+	return "DKIM-Signature: " + value + strings.Join(folded, "\r\n\t") + "\r\n", nil
+}
+
+type headerField struct {
+	// Lowercase field name
+	key string
+
+	// The field as it appears in the message, continuation lines and
+	// final CRLF included
+	raw string
+}
+
+// splitMessage splits data at the blank line after the header. Bare LFs
+// are treated as CRLFs.
+func splitMessage(data []byte) (header, body string) {
+	s := strings.Replace(string(data), "\r\n", "\n", -1)
+	s = strings.Replace(s, "\n", "\r\n", -1)
+	if i := strings.Index(s, "\r\n\r\n"); i >= 0 {
+		return s[:i+2], s[i+4:]
+	}
+	return s, ""
+}
+
+func parseHeaderFields(header string) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, headerField{strings.ToLower(strings.TrimSpace(name)), line})
+	}
+	return fields
+}
+
+// relaxedHeader canonicalizes a header field the "relaxed" way: name
+// lowercased, value unfolded with runs of whitespace collapsed, and no
+// whitespace around the colon or at the end.
+func relaxedHeader(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes a body the "relaxed" way: trailing
+// whitespace dropped from each line, other runs of whitespace collapsed,
+// and trailing empty lines removed.
+func relaxedBody(body string) []byte {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		var b strings.Builder
+		inWSP := false
+		for _, r := range line {
+			if isWSP(r) {
+				inWSP = true
+				continue
+			}
+			if inWSP {
+				b.WriteByte(' ')
+				inWSP = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// DKIMTransport signs each message before handing it to another
+// Transport. Since it only sees finished messages, PGP/MIME ones are
+// signed as they're sent, outer headers and encrypted body alike.
+type DKIMTransport struct {
+	Transport
+	signer *DKIMSigner
+}
+
+func NewDKIMTransport(transport Transport, signer *DKIMSigner) *DKIMTransport {
+	return &DKIMTransport{Transport: transport, signer: signer}
+}
+
+func (t *DKIMTransport) Send(msg *Message) error {
+	data, err := t.signer.Sign(msg.From, msg.Data)
+	if err != nil {
+		return err
+	}
+	signed := *msg
+	signed.Data = data
+	return t.Transport.Send(&signed)
+}
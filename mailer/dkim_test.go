@@ -0,0 +1,289 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// The Ed25519 key from RFC 8463, appendix A.1
+const rfc8463Seed = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+
+// The message from RFC 8463, appendix A.2
+const rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func rfc8463Key(t *testing.T) ed25519.PrivateKey {
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  string
+	}{
+		// RFC 6376, section 3.4.5
+		{"rfc6376 A", "A: X\r\n", "a:X\r\n"},
+		{"rfc6376 B", "B : Y\t\r\n\tZ  \r\n", "b:Y Z\r\n"},
+		{"lowercases name only", "SUBJECT: Hello World\r\n", "subject:Hello World\r\n"},
+		{"collapses runs", "To:  a@example.com, \t b@example.com\r\n", "to:a@example.com, b@example.com\r\n"},
+		{"unfolds", "Subject: one\r\n two\r\n\tthree\r\n", "subject:one two three\r\n"},
+		{"empty value", "X-Empty:   \r\n", "x-empty:\r\n"},
+		{"no colon", "garbage\r\n", ""},
+	}
+	for _, tt := range tests {
+		if got := relaxedHeader(tt.field); got != tt.want {
+			t.Errorf("%s: relaxedHeader(%q) = %q, want %q", tt.name, tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestRelaxedBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		// RFC 6376, section 3.4.5
+		{"rfc6376", " C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+		{"empty", "", ""},
+		{"only empty lines", "\r\n\r\n", ""},
+		{"adds final CRLF", "Hi", "Hi\r\n"},
+		{"keeps inner empty lines", "a\r\n\r\nb\r\n", "a\r\n\r\nb\r\n"},
+		{"trailing whitespace", "a \t\r\nb\t\r\n", "a\r\nb\r\n"},
+		{"whitespace-only line", "a\r\n \t\r\nb\r\n", "a\r\n\r\nb\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(relaxedBody(tt.body)); got != tt.want {
+			t.Errorf("%s: relaxedBody(%q) = %q, want %q", tt.name, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRelaxedBodyHash(t *testing.T) {
+	_, rfcBody := splitMessage([]byte(rfc8463Message))
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		// The bh= of both signatures in RFC 8463, appendix A.3
+		{"rfc8463", rfcBody, "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="},
+		// RFC 6376, section 3.4.4: an empty body is hashed as nothing
+		{"empty", "", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		{"empty lines", "\r\n\r\n", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+	for _, tt := range tests {
+		sum := sha256.Sum256(relaxedBody(tt.body))
+		if got := base64.StdEncoding.EncodeToString(sum[:]); got != tt.want {
+			t.Errorf("%s: body hash = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		data   string
+		header string
+		body   string
+	}{
+		{"A: 1\r\nB: 2\r\n\r\nbody\r\n", "A: 1\r\nB: 2\r\n", "body\r\n"},
+		{"A: 1\nB: 2\n\nbody\n", "A: 1\r\nB: 2\r\n", "body\r\n"},
+		{"A: 1\r\n", "A: 1\r\n", ""},
+		{"A: 1\r\n\r\n", "A: 1\r\n", ""},
+	}
+	for _, tt := range tests {
+		header, body := splitMessage([]byte(tt.data))
+		if header != tt.header || body != tt.body {
+			t.Errorf("splitMessage(%q) = %q, %q, want %q, %q", tt.data, header, body, tt.header, tt.body)
+		}
+	}
+}
+
+// The Ed25519 signature in RFC 8463, appendix A.3, must verify with our
+// canonicalization
+func TestRFC8463Signature(t *testing.T) {
+	sig, err := base64.StdEncoding.DecodeString("/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := splitMessage([]byte(rfc8463Message))
+	fields := parseHeaderFields(header)
+
+	h := sha256.New()
+	// h=from:to:subject:date:message-id, then from, subject and date
+	// again, which aren't repeated so add nothing
+	for _, field := range fields {
+		h.Write([]byte(relaxedHeader(field.raw)))
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader("DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n"+
+		" d=football.example.com; i=@football.example.com;\r\n"+
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n"+
+		" subject : date : message-id : from : subject : date;\r\n"+
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n"+
+		" b="), "\r\n")))
+
+	pub := rfc8463Key(t).Public().(ed25519.PublicKey)
+	if !ed25519.Verify(pub, h.Sum(nil), sig) {
+		t.Fatal("RFC 8463 signature doesn't verify")
+	}
+}
+
+// verifyDKIM checks the DKIM-Signature field at index i of data's
+// header against pub, the way a relaxed/relaxed verifier would.
+func verifyDKIM(t *testing.T, data []byte, i int, pub crypto.PublicKey) {
+	t.Helper()
+	header, body := splitMessage(data)
+	fields := parseHeaderFields(header)
+	if i >= len(fields) || fields[i].key != "dkim-signature" {
+		t.Fatalf("Field %d isn't a DKIM-Signature: %+v", i, fields)
+	}
+	sigField := fields[i].raw
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(relaxedHeader(sigField)[len("dkim-signature:"):], ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = strings.Replace(kv[1], " ", "", -1)
+		}
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("bh=%s doesn't match the body", tags["bh"])
+	}
+
+	// Each listed field is taken from the bottom up, skipping the
+	// signatures themselves
+	used := map[int]bool{}
+	h := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		for j := len(fields) - 1; j >= 0; j-- {
+			if fields[j].key == name && !used[j] && fields[j].key != "dkim-signature" {
+				used[j] = true
+				h.Write([]byte(relaxedHeader(fields[j].raw)))
+				break
+			}
+		}
+	}
+	bStart := strings.Index(sigField, "\tb=")
+	if bStart < 0 {
+		t.Fatalf("No b= tag in %q", sigField)
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader(sigField[:bStart+3]), "\r\n")))
+	digest := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("Bad b= tag: %v", err)
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, sig) {
+			t.Error("Ed25519 signature doesn't verify")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig); err != nil {
+			t.Errorf("RSA signature doesn't verify: %v", err)
+		}
+	default:
+		t.Fatalf("Unexpected key type %T", pub)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	edKey := rfc8463Key(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DKIMSigner{keys: map[string][]*dkimKey{
+		"football.example.com": {
+			{domain: "football.example.com", selector: "brisbane", algorithm: DKIMAlgorithmEd25519, signer: edKey},
+			{domain: "football.example.com", selector: "test", algorithm: DKIMAlgorithmRSA, signer: rsaKey},
+		},
+	}}
+
+	signed, err := s.Sign("joe@football.example.com", []byte(rfc8463Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(signed), rfc8463Message) {
+		t.Error("Signing changed the message")
+	}
+	for _, want := range []string{"a=ed25519-sha256", "a=rsa-sha256", "d=football.example.com",
+		"s=brisbane", "h=from:subject:date:to:message-id;", "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="} {
+		if !strings.Contains(string(signed), want) {
+			t.Errorf("Signed message lacks %q", want)
+		}
+	}
+	verifyDKIM(t, signed, 0, edKey.Public())
+	verifyDKIM(t, signed, 1, &rsaKey.PublicKey)
+
+	// Only the last of a repeated field is signed, and the signature
+	// still verifies once a verifier skips the earlier one
+	repeated := "Subject: first\r\n" + rfc8463Message
+	signed, err = s.Sign("joe@football.example.com", []byte(repeated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyDKIM(t, signed, 0, edKey.Public())
+
+	// Bare LFs are signed as CRLFs
+	lf := strings.Replace(rfc8463Message, "\r\n", "\n", -1)
+	signed, err = s.Sign("joe@football.example.com", []byte(lf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyDKIM(t, signed, 0, edKey.Public())
+}
+
+func TestDKIMSignKeysFor(t *testing.T) {
+	key := &dkimKey{domain: "example.com", selector: "s", algorithm: DKIMAlgorithmEd25519, signer: rfc8463Key(t)}
+	s := &DKIMSigner{keys: map[string][]*dkimKey{"example.com": {key}}}
+
+	tests := []struct {
+		from   string
+		signed bool
+	}{
+		{"a@example.com", true},
+		{"a@EXAMPLE.com", true},
+		{"a@mail.example.com", true},
+		{"a@example.org", false},
+		{"a@notexample.com", false},
+	}
+	for _, tt := range tests {
+		msg := []byte("From: " + tt.from + "\r\nSubject: hi\r\n\r\nbody\r\n")
+		signed, err := s.Sign(tt.from, msg)
+		if err != nil {
+			t.Errorf("Sign(%s): %v", tt.from, err)
+			continue
+		}
+		if got := strings.HasPrefix(string(signed), "DKIM-Signature:"); got != tt.signed {
+			t.Errorf("Sign(%s) signed = %v, want %v", tt.from, got, tt.signed)
+		}
+	}
+
+	if _, err := s.Sign("a@example.com", []byte("Subject: no from\r\n\r\nbody\r\n")); err == nil {
+		t.Error("Sign without a From header succeeded")
+	}
+}
@@ -0,0 +1,278 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Just enough of a DNS client to look up MX, address and TLSA records and see
+// whether the resolver validated them with DNSSEC (the AD bit), which
+// net.Resolver doesn't expose. The AD bit is only as trustworthy as the
+// path to the resolver, so point it at a validating resolver on
+// localhost.
+
+const (
+	dnsTypeA    = 1
+	dnsTypeMX   = 15
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+	dnsTypeTLSA = 52
+
+	dnsClassIN = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	// EDNS0 UDP payload size, small enough to avoid fragmentation
+	dnsUDPSize = 1232
+)
+
+var (
+	errDNSMalformed = errors.New("Malformed DNS response")
+	errDNSMismatch  = errors.New("DNS response doesn't answer the query")
+)
+
+type dnsClient struct {
+	server  string
+	timeout time.Duration
+}
+
+type dnsAnswer struct {
+	Name string
+	Type uint16
+
+	// Offset of the record's data in msg, for names compressed against
+	// the rest of the message
+	offset int
+	length int
+}
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsResponse struct {
+	msg []byte
+
+	Rcode int
+
+	// Whether the resolver validated the answer with DNSSEC
+	Authenticated bool
+
+	Questions []dnsQuestion
+	Answers   []dnsAnswer
+}
+
+// answers reports whether the response is to a query for name's records
+// of qtype. Anything else, such as a spoofed reply to another query,
+// can't be trusted, whatever its AD bit says.
+func (r *dnsResponse) answers(name string, qtype uint16) bool {
+	if len(r.Questions) != 1 {
+		return false
+	}
+	q := r.Questions[0]
+	return strings.EqualFold(q.Name, strings.TrimSuffix(name, ".")+".") &&
+		q.Type == qtype && q.Class == dnsClassIN
+}
+
+func (r *dnsResponse) data(a dnsAnswer) []byte {
+	return r.msg[a.offset : a.offset+a.length]
+}
+
+// query asks the server for name's records of qtype, over UDP and then
+// over TCP if the answer was truncated.
+func (c *dnsClient) query(name string, qtype uint16) (*dnsResponse, error) {
+	req, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange("udp", req, id)
+	if err == nil && resp.msg[2]&0x02 != 0 {
+		resp, err = c.exchange("tcp", req, id)
+	}
+	if err == nil && !resp.answers(name, qtype) {
+		err = errDNSMismatch
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DNS query for %s: %v", name, err)
+	}
+	return resp, nil
+}
+
+func (c *dnsClient) exchange(network string, req []byte, id uint16) (*dnsResponse, error) {
+	conn, err := net.DialTimeout(network, c.server, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var msg []byte
+	if network == "tcp" {
+		framed := make([]byte, 2, 2+len(req))
+		binary.BigEndian.PutUint16(framed, uint16(len(req)))
+		if _, err = conn.Write(append(framed, req...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		msg, err = ioutil.ReadAll(io.LimitReader(conn, int64(binary.BigEndian.Uint16(length[:]))))
+	} else {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		var n int
+		n, err = conn.Read(buf)
+		msg = buf[:n]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, errDNSMalformed
+	}
+	return parseDNSResponse(msg)
+}
+
+// newDNSQuery builds a recursive query asking for DNSSEC validation: the
+// AD bit set in the header and the DO bit in an EDNS0 OPT record.
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0120) // RD, AD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:], 1)     // ARCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("Invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype)
+	msg = appendUint16(msg, dnsClassIN)
+
+	// OPT: root name, type, UDP size as class, DO bit in the TTL, no data
+	msg = append(msg, 0)
+	msg = appendUint16(msg, dnsTypeOPT)
+	msg = appendUint16(msg, dnsUDPSize)
+	msg = append(msg, 0, 0, 0x80, 0)
+	msg = appendUint16(msg, 0)
+	return msg, id, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// parseDNSResponse parses msg, which must be a response (QR set) to a
+// standard query (opcode 0).
+func parseDNSResponse(msg []byte) (*dnsResponse, error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 || msg[2]&0x78 != 0 {
+		return nil, errDNSMalformed
+	}
+	resp := &dnsResponse{
+		msg:           msg,
+		Rcode:         int(msg[3] & 0x0f),
+		Authenticated: msg[3]&0x20 != 0,
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+		if off > len(msg) {
+			return nil, errDNSMalformed
+		}
+		resp.Questions = append(resp.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next:]),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errDNSMalformed
+		}
+		answer := dnsAnswer{
+			Name:   name,
+			Type:   binary.BigEndian.Uint16(msg[off:]),
+			offset: off + 10,
+			length: int(binary.BigEndian.Uint16(msg[off+8:])),
+		}
+		off = answer.offset + answer.length
+		if off > len(msg) {
+			return nil, errDNSMalformed
+		}
+		resp.Answers = append(resp.Answers, answer)
+	}
+	return resp, nil
+}
+
+// readDNSName reads the possibly compressed name at off, returning it
+// and the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
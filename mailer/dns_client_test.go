@@ -0,0 +1,315 @@
+package mailer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// dnsName encodes name as uncompressed labels.
+func dnsName(labels ...string) []byte {
+	var b []byte
+	for _, label := range labels {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsHeader(id uint16, flags uint16, qdcount, ancount int) []byte {
+	b := appendUint16(nil, id)
+	b = appendUint16(b, flags)
+	b = appendUint16(b, uint16(qdcount))
+	b = appendUint16(b, uint16(ancount))
+	return append(b, 0, 0, 0, 0)
+}
+
+// dnsRR appends a resource record with the given (possibly compressed)
+// name.
+func dnsRR(b, name []byte, rtype uint16, data []byte) []byte {
+	b = append(b, name...)
+	b = appendUint16(b, rtype)
+	b = appendUint16(b, dnsClassIN)
+	b = append(b, 0, 0, 0x0e, 0x10)
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// mxResponse answers an MX query for example.com with two records whose
+// names point back at the question.
+func mxResponse(id uint16, flags uint16) []byte {
+	msg := dnsHeader(id, flags, 1, 2)
+	msg = append(msg, dnsName("example", "com")...)
+	msg = appendUint16(msg, dnsTypeMX)
+	msg = appendUint16(msg, dnsClassIN)
+
+	// Offset 12 is the question's name
+	ptr := []byte{0xc0, 12}
+	msg = dnsRR(msg, ptr, dnsTypeMX, append([]byte{0, 20}, append([]byte{4, 'm', 'x', '2', '0'}, ptr...)...))
+	msg = dnsRR(msg, ptr, dnsTypeMX, append([]byte{0, 10}, append([]byte{4, 'm', 'x', '1', '0'}, ptr...)...))
+	return msg
+}
+
+// answerQuery answers req, echoing its question, with a record of rtype
+// for each of rdatas.
+func answerQuery(req []byte, flags uint16, rtype uint16, rdatas ...[]byte) []byte {
+	_, next, err := readDNSName(req, 12)
+	if err != nil {
+		return nil
+	}
+	msg := dnsHeader(binary.BigEndian.Uint16(req), flags, 1, len(rdatas))
+	msg = append(msg, req[12:next+4]...)
+	for _, rdata := range rdatas {
+		msg = dnsRR(msg, []byte{0xc0, 12}, rtype, rdata)
+	}
+	return msg
+}
+
+func TestReadDNSName(t *testing.T) {
+	header := make([]byte, 12)
+	tests := []struct {
+		name string
+		msg  []byte
+		off  int
+		want string
+		next int
+		err  bool
+	}{
+		{"plain", append(header, dnsName("mx", "example", "com")...), 12, "mx.example.com.", 28, false},
+		{"root", append(header, 0), 12, ".", 13, false},
+		{"pointer only", append(append(header, dnsName("example", "com")...), 0xc0, 12), 25, "example.com.", 27, false},
+		{"label then pointer", append(append(header, dnsName("example", "com")...), 2, 'm', 'x', 0xc0, 12), 25, "mx.example.com.", 30, false},
+		{"pointer to pointer", append(append(append(header, dnsName("com")...), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0xc0, 12), 0xc0, 17), 27, "example.com.", 29, false},
+		{"truncated label", append(header, 7, 'e', 'x', 'a'), 12, "", 0, true},
+		{"missing terminator", append(header, 3, 'c', 'o', 'm'), 12, "", 0, true},
+		{"truncated pointer", append(header, 0xc0), 12, "", 0, true},
+		{"pointer past end", append(header, 0xc0, 0xff), 12, "", 0, true},
+		{"pointer loop", append(header, 0xc0, 12), 12, "", 0, true},
+		{"offset past end", header, 12, "", 0, true},
+	}
+	for _, tt := range tests {
+		got, next, err := readDNSName(tt.msg, tt.off)
+		if tt.err {
+			if err != errDNSMalformed {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, errDNSMalformed)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || next != tt.next {
+			t.Errorf("%s: readDNSName = %q, %d, %v, want %q, %d", tt.name, got, next, err, tt.want, tt.next)
+		}
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	msg := mxResponse(0x1234, 0x81a0)
+	resp, err := parseDNSResponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dnsRcodeSuccess || !resp.Authenticated || len(resp.Answers) != 2 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	for _, answer := range resp.Answers {
+		if answer.Name != "example.com." || answer.Type != dnsTypeMX {
+			t.Errorf("Unexpected answer %+v", answer)
+		}
+	}
+	host, _, err := readDNSName(msg, resp.Answers[1].offset+2)
+	if err != nil || host != "mx10.example.com." {
+		t.Errorf("MX host = %q, %v", host, err)
+	}
+	if pref := binary.BigEndian.Uint16(resp.data(resp.Answers[1])); pref != 10 {
+		t.Errorf("MX preference = %d, want 10", pref)
+	}
+
+	nx := dnsHeader(1, 0x8183, 0, 0)
+	if resp, err := parseDNSResponse(nx); err != nil || resp.Rcode != dnsRcodeNXDomain || resp.Authenticated {
+		t.Errorf("NXDOMAIN parsed as %+v, %v", resp, err)
+	}
+
+	malformed := map[string][]byte{
+		"not a response":     dnsHeader(1, 0x0100, 0, 0),
+		"not a query":        dnsHeader(1, 0x8900, 0, 0),
+		"truncated question": append(dnsHeader(1, 0x8180, 1, 0), dnsName("example", "com")...),
+		"short header":       msg[:11],
+		"truncated rdata":    msg[:len(msg)-1],
+		"truncated record":   msg[:len(msg)-12],
+		"missing answers":    append(dnsHeader(1, 0x8180, 0, 3), msg[12:]...),
+		"bad question":       append(dnsHeader(1, 0x8180, 1, 0), 0xc0),
+	}
+	for name, msg := range malformed {
+		if _, err := parseDNSResponse(msg); err != errDNSMalformed {
+			t.Errorf("%s: err = %v, want %v", name, err, errDNSMalformed)
+		}
+	}
+}
+
+func TestNewDNSQuery(t *testing.T) {
+	msg, id, err := newDNSQuery("example.com.", dnsTypeTLSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		t.Error("Query ID doesn't match")
+	}
+	name, next, err := readDNSName(msg, 12)
+	if err != nil || name != "example.com." {
+		t.Fatalf("Question name = %q, %v", name, err)
+	}
+	if qtype := binary.BigEndian.Uint16(msg[next:]); qtype != dnsTypeTLSA {
+		t.Errorf("Question type = %d", qtype)
+	}
+
+	for _, name := range []string{"", "a..b", string(make([]byte, 64)) + ".com"} {
+		if _, _, err := newDNSQuery(name, dnsTypeMX); err == nil {
+			t.Errorf("newDNSQuery(%q) succeeded", name)
+		}
+	}
+}
+
+// fakeDNSServer answers every query over UDP with a truncated, empty
+// response, and over TCP with what respond returns, on the same port.
+func fakeDNSServer(t *testing.T, respond func(req []byte) []byte) string {
+	var udp net.PacketConn
+	var tcp net.Listener
+	for i := 0; ; i++ {
+		var err error
+		udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Skipf("Can't listen on UDP: %v", err)
+		}
+		tcp, err = net.Listen("tcp", udp.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		udp.Close()
+		if i == 10 {
+			t.Skipf("Can't listen on TCP: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n >= 12 {
+				// QR, TC, RD, RA
+				udp.WriteTo(dnsHeader(binary.BigEndian.Uint16(buf), 0x8380, 0, 0), addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			req := make([]byte, 512)
+			if _, err := io.ReadFull(conn, length[:]); err == nil {
+				req = req[:binary.BigEndian.Uint16(length[:])]
+				if _, err := io.ReadFull(conn, req); err == nil {
+					resp := respond(req)
+					conn.Write(append(appendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return udp.LocalAddr().String()
+}
+
+func TestDNSQueryFallsBackToTCP(t *testing.T) {
+	server := fakeDNSServer(t, func(req []byte) []byte {
+		return mxResponse(binary.BigEndian.Uint16(req), 0x81a0)
+	})
+	tr := &DirectTransport{dns: &dnsClient{server: server, timeout: 2 * time.Second}}
+
+	hosts, secure, err := tr.lookupMX("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"mx10.example.com", "mx20.example.com"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("MX hosts = %v, want %v", hosts, want)
+	}
+	if !secure {
+		t.Error("Authenticated answer not reported as secure")
+	}
+}
+
+func TestDNSQueryChecksQuestion(t *testing.T) {
+	server := fakeDNSServer(t, func(req []byte) []byte {
+		// Always the answer to an MX query for example.com
+		return mxResponse(binary.BigEndian.Uint16(req), 0x81a0)
+	})
+	c := &dnsClient{server: server, timeout: 2 * time.Second}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		ok    bool
+	}{
+		{"example.com", dnsTypeMX, true},
+		{"EXAMPLE.com.", dnsTypeMX, true},
+		{"example.org", dnsTypeMX, false},
+		{"example.com", dnsTypeTLSA, false},
+	}
+	for _, tt := range tests {
+		_, err := c.query(tt.name, tt.qtype)
+		if (err == nil) != tt.ok {
+			t.Errorf("query(%s, %d) err = %v, want ok = %v", tt.name, tt.qtype, err, tt.ok)
+		}
+	}
+}
+
+func TestLookupAddrs(t *testing.T) {
+	tests := []struct {
+		name   string
+		flagsA uint16
+		a      [][]byte
+		aaaa   [][]byte
+		addrs  []string
+		secure bool
+		err    bool
+	}{
+		{"both validated", 0x81a0, [][]byte{{192, 0, 2, 1}}, [][]byte{net.ParseIP("2001:db8::1")},
+			[]string{"192.0.2.1", "2001:db8::1"}, true, false},
+		{"A not validated", 0x8180, [][]byte{{192, 0, 2, 1}}, nil, []string{"192.0.2.1"}, false, false},
+		{"A fails", 0x8182, nil, [][]byte{net.ParseIP("2001:db8::1")}, []string{"2001:db8::1"}, false, false},
+		{"no addresses", 0x81a0, nil, nil, nil, false, true},
+	}
+	for _, tt := range tests {
+		server := fakeDNSServer(t, func(req []byte) []byte {
+			_, next, _ := readDNSName(req, 12)
+			if binary.BigEndian.Uint16(req[next:]) == dnsTypeA {
+				return answerQuery(req, tt.flagsA, dnsTypeA, tt.a...)
+			}
+			return answerQuery(req, 0x81a0, dnsTypeAAAA, tt.aaaa...)
+		})
+		tr := &DirectTransport{dns: &dnsClient{server: server, timeout: 2 * time.Second}}
+
+		addrs, secure, err := tr.lookupAddrs("mx.example.com")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if !reflect.DeepEqual(got, tt.addrs) || secure != tt.secure {
+			t.Errorf("%s: lookupAddrs = %v, %v, want %v, %v", tt.name, got, secure, tt.addrs, tt.secure)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Package mailer renders PursueMail's emails, encrypts them to the
+// recipient's public key if there is one, and hands them to a Transport.
+// It can be embedded in other services by giving New a Store and a
+// Transport:
+//
+//	m := mailer.New(store.NewPostgres(db), transport, mailer.Config{SystemFrom: from})
+//	digested, err := m.Send(ctx, account, &api.SendEmailRequest{EmailData: emailData})
+package mailer
+
+import (
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+// Store is what the mailer needs to look up recipients and templates,
+// and to queue email for later. Any store.Store implements it.
+type Store interface {
+	GetEmailAccount(id string) (*store.EmailAccount, error)
+	GetEmailAccounts(ids []string) ([]*store.EmailAccount, error)
+
+	GetEmailTemplate(name string) (*store.EmailTemplate, error)
+	GetEmailTemplateVersion(name string, version int) (*store.EmailTemplate, error)
+
+	QueueDigestItem(e *store.EmailAccount, emailData api.EmailData, secureOnly bool) error
+	DueDigests() ([]string, error)
+	ClaimDigestItems(accountId string, send func(items []*store.DigestItem) error) error
+
+	ScheduleEmailJob(kind, accountId string, req interface{}, sendAt time.Time) (*api.EmailJob, error)
+	ClaimDueJobs(limit int) ([]*api.EmailJob, error)
+	FinishEmailJob(id, status string, result []byte) error
+	RenewJobLease(id string) error
+	FailInterruptedJobs(leaseTimeout time.Duration) (int64, error)
+}
+
+type Config struct {
+	// From address of emails the mailer sends on its own behalf
+	// (confirmations and digests)
+	SystemFrom string
+
+	// If set, only verified accounts can be sent to
+	RequireVerification bool
+
+	// Base URL that confirmation links point to
+	PublicURL string
+
+	// Key used to sign address confirmation tokens, and how long they
+	// stay valid
+	VerifySecret []byte
+	VerifyTTL    time.Duration
+}
+
+// Mailer sends email to accounts in Store through Transport.
+type Mailer struct {
+	Store     Store
+	Transport Transport
+	Config    Config
+}
+
+func New(st Store, transport Transport, cfg Config) *Mailer {
+	return &Mailer{Store: st, Transport: transport, Config: cfg}
+}
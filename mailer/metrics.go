@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PursuanceProject/pursuemail/telemetry"
+)
+
+var (
+	emailsTotal = telemetry.NewCounterVec("pursuemail_emails_total",
+		"Emails handed to the transport, by outcome (sent or failed) and encryption (pgp or none).",
+		"outcome", "encryption")
+	secureOnlyRejectionsTotal = telemetry.NewCounterVec("pursuemail_secure_only_rejections_total",
+		"secure_only emails not sent because the recipient has no public key, by kind of send.",
+		"kind")
+	smtpSendSeconds = telemetry.NewHistogramVec("pursuemail_smtp_send_duration_seconds",
+		"Time taken to hand an email to an SMTP server, by server and outcome.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		"server", "outcome")
+)
+
+const (
+	outcomeSent   = "sent"
+	outcomeFailed = "failed"
+)
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailed
+	}
+	return outcomeSent
+}
+
+var smtpPools struct {
+	mu    sync.Mutex
+	pools map[*SMTPPool]bool
+}
+
+func init() {
+	smtpPools.pools = map[*SMTPPool]bool{}
+	telemetry.NewGaugeFunc("pursuemail_smtp_pool_connections",
+		"SMTP pool connections by server and state: in_use, idle, or max (the pool's limit).",
+		func() []telemetry.GaugeSample {
+			smtpPools.mu.Lock()
+			defer smtpPools.mu.Unlock()
+			var samples []telemetry.GaugeSample
+			for p := range smtpPools.pools {
+				open, idle := len(p.slots), len(p.idle)
+				samples = append(samples,
+					telemetry.GaugeSample{LabelValues: []string{p.addr, "in_use"}, Value: float64(open - idle)},
+					telemetry.GaugeSample{LabelValues: []string{p.addr, "idle"}, Value: float64(idle)},
+					telemetry.GaugeSample{LabelValues: []string{p.addr, "max"}, Value: float64(cap(p.slots))})
+			}
+			sort.Slice(samples, func(i, j int) bool {
+				return strings.Join(samples[i].LabelValues, ",") < strings.Join(samples[j].LabelValues, ",")
+			})
+			return samples
+		}, "server", "state")
+}
+
+func trackSMTPPool(p *SMTPPool, open bool) {
+	smtpPools.mu.Lock()
+	defer smtpPools.mu.Unlock()
+	if open {
+		smtpPools.pools[p] = true
+	} else {
+		delete(smtpPools.pools, p)
+	}
+}
@@ -0,0 +1,212 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mtaSTSEnforce = "enforce"
+	mtaSTSTesting = "testing"
+	mtaSTSNone    = "none"
+
+	// Policies are cached for no longer than a year, in seconds (RFC 8461)
+	mtaSTSMaxAge = 31557600
+
+	mtaSTSMaxPolicyBytes = 64 << 10
+)
+
+// mtaSTSPolicy is a domain's MTA-STS policy (RFC 8461): which MX hosts
+// may receive its email, and whether they must be reached over
+// verified TLS.
+type mtaSTSPolicy struct {
+	Mode    string
+	MX      []string
+	id      string
+	expires time.Time
+}
+
+// allows reports whether mx is one of the policy's MX patterns, which
+// may start with a "*." wildcard for one label.
+func (p *mtaSTSPolicy) allows(mx string) bool {
+	mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.Index(mx, ".")
+			if i > 0 && mx[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if mx == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// mtaSTSCache fetches MTA-STS policies and keeps them for their max_age.
+// A cached policy is refetched when the domain's _mta-sts TXT record
+// announces a new id, and is kept if the TXT record or the policy
+// becomes unavailable, as the RFC intends.
+type mtaSTSCache struct {
+	resolver *net.Resolver
+	client   *http.Client
+
+	// Where a domain's policy is fetched from
+	policyURL func(domain string) string
+
+	mu       sync.Mutex
+	policies map[string]*mtaSTSPolicy
+}
+
+func newMTASTSCache(resolver *net.Resolver, timeout time.Duration) *mtaSTSCache {
+	return &mtaSTSCache{
+		resolver: resolver,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{Timeout: timeout, Resolver: resolver}).DialContext,
+			},
+			// Policies must not be fetched through redirects
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		policyURL: func(domain string) string {
+			return "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+		},
+		policies: map[string]*mtaSTSPolicy{},
+	}
+}
+
+// Policy returns domain's policy, or nil if it has none.
+func (c *mtaSTSCache) Policy(domain string) (*mtaSTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	c.mu.Lock()
+	cached := c.policies[domain]
+	c.mu.Unlock()
+	if cached != nil && time.Now().After(cached.expires) {
+		cached = nil
+	}
+
+	id, err := c.lookupID(domain)
+	if err != nil || id == "" || (cached != nil && cached.id == id) {
+		return cached, err
+	}
+
+	policy, err := c.fetch(domain)
+	if err != nil {
+		return cached, err
+	}
+	policy.id = id
+
+	c.mu.Lock()
+	c.policies[domain] = policy
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// lookupID returns the id from domain's _mta-sts TXT record, or "" if
+// it doesn't have exactly one.
+func (c *mtaSTSCache) lookupID(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(context.Background(), "_mta-sts."+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1;") && txt != "v=STSv1" {
+			continue
+		}
+		for _, field := range strings.Split(txt, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "id" {
+				ids = append(ids, kv[1])
+			}
+		}
+	}
+	if len(ids) != 1 {
+		return "", nil
+	}
+	return ids[0], nil
+}
+
+func (c *mtaSTSCache) fetch(domain string) (*mtaSTSPolicy, error) {
+	resp, err := c.client.Get(c.policyURL(domain))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MTA-STS policy for %s: %s", domain, resp.Status)
+	}
+	return parseMTASTSPolicy(io.LimitReader(resp.Body, mtaSTSMaxPolicyBytes))
+}
+
+func parseMTASTSPolicy(r io.Reader) (*mtaSTSPolicy, error) {
+	policy := &mtaSTSPolicy{}
+	var version string
+	var maxAge int64 = -1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid MTA-STS max_age %q", value)
+			}
+			maxAge = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, errors.New("MTA-STS policy isn't version STSv1")
+	}
+	switch policy.Mode {
+	case mtaSTSEnforce, mtaSTSTesting:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("MTA-STS policy lists no mx")
+		}
+	case mtaSTSNone:
+	default:
+		return nil, fmt.Errorf("Invalid MTA-STS mode %q", policy.Mode)
+	}
+	if maxAge < 0 {
+		return nil, errors.New("MTA-STS policy has no max_age")
+	}
+
+	if maxAge > mtaSTSMaxAge {
+		maxAge = mtaSTSMaxAge
+	}
+	policy.expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	return policy, nil
+}
@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		mode   string
+		mx     []string
+		maxAge time.Duration
+		err    bool
+	}{
+		// RFC 8461, section 3.2
+		{"rfc8461", "version: STSv1\nmode: enforce\nmx: mail.example.com\nmx: *.example.net\nmx: backupmx.example.com\nmax_age: 604800\n",
+			mtaSTSEnforce, []string{"mail.example.com", "*.example.net", "backupmx.example.com"}, 604800 * time.Second, false},
+		{"CRLF and spacing", "version:STSv1\r\nmode :  testing\r\nmx:mx.example.com\r\nmax_age: 86400\r\n",
+			mtaSTSTesting, []string{"mx.example.com"}, 86400 * time.Second, false},
+		{"none needs no mx", "version: STSv1\nmode: none\nmax_age: 86400\n", mtaSTSNone, nil, 86400 * time.Second, false},
+		{"unknown keys ignored", "version: STSv1\nmode: none\nfoo: bar\nnot a field\nmax_age: 0\n", mtaSTSNone, nil, 0, false},
+		{"max_age capped", "version: STSv1\nmode: none\nmax_age: 99999999999\n", mtaSTSNone, nil, mtaSTSMaxAge * time.Second, false},
+		{"wrong version", "version: STSv2\nmode: none\nmax_age: 86400\n", "", nil, 0, true},
+		{"no version", "mode: none\nmax_age: 86400\n", "", nil, 0, true},
+		{"bad mode", "version: STSv1\nmode: Enforce\nmx: mx.example.com\nmax_age: 86400\n", "", nil, 0, true},
+		{"enforce without mx", "version: STSv1\nmode: enforce\nmax_age: 86400\n", "", nil, 0, true},
+		{"testing without mx", "version: STSv1\nmode: testing\nmax_age: 86400\n", "", nil, 0, true},
+		{"no max_age", "version: STSv1\nmode: none\n", "", nil, 0, true},
+		{"negative max_age", "version: STSv1\nmode: none\nmax_age: -1\n", "", nil, 0, true},
+		{"bad max_age", "version: STSv1\nmode: none\nmax_age: 1d\n", "", nil, 0, true},
+		{"empty", "", "", nil, 0, true},
+	}
+	for _, tt := range tests {
+		before := time.Now()
+		policy, err := parseMTASTSPolicy(strings.NewReader(tt.policy))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parsed as %+v, want an error", tt.name, policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if policy.Mode != tt.mode || !reflect.DeepEqual(policy.MX, tt.mx) {
+			t.Errorf("%s: parsed as %+v, want mode %s, mx %v", tt.name, policy, tt.mode, tt.mx)
+		}
+		if policy.expires.Before(before.Add(tt.maxAge)) || policy.expires.After(time.Now().Add(tt.maxAge)) {
+			t.Errorf("%s: expires %v, want max_age %v", tt.name, policy.expires, tt.maxAge)
+		}
+	}
+}
+
+func TestMTASTSPolicyAllows(t *testing.T) {
+	policy := &mtaSTSPolicy{Mode: mtaSTSEnforce, MX: []string{"mail.example.com", "*.Example.NET"}}
+	tests := []struct {
+		mx   string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.example.com.", true},
+		{"mx1.example.net", true},
+		{"mx1.example.net.", true},
+		{"example.net", false},
+		{"a.mx1.example.net", false},
+		{".example.net", false},
+		{"mx1.notexample.net", false},
+		{"backup.example.com", false},
+		{"mail.example.com.evil", false},
+	}
+	for _, tt := range tests {
+		if got := policy.allows(tt.mx); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.mx, got, tt.want)
+		}
+	}
+}
+
+func TestMTASTSFetch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 86400\n"))
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok/", http.StatusFound)
+	})
+	mux.HandleFunc("/huge/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("version: STSv1\nmode: enforce\nmx: mx.example.com\n"))
+		w.Write([]byte(strings.Repeat("x", mtaSTSMaxPolicyBytes)))
+		w.Write([]byte("\nmax_age: 86400\n"))
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	c := newMTASTSCache(nil, 5*time.Second)
+	client := srv.Client()
+	client.CheckRedirect = c.client.CheckRedirect
+	c.client = client
+	c.policyURL = func(domain string) string {
+		return srv.URL + "/" + domain + "/"
+	}
+
+	policy, err := c.fetch("ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != mtaSTSEnforce || !policy.allows("mx.example.com") {
+		t.Errorf("Fetched %+v", policy)
+	}
+
+	for _, domain := range []string{"redirect", "missing", "huge"} {
+		if policy, err := c.fetch(domain); err == nil {
+			t.Errorf("Fetching %s gave %+v, want an error", domain, policy)
+		}
+	}
+}
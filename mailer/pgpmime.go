@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/crypto"
+	emailLib "github.com/jordan-wright/email"
+)
+
+// NewEncryptedMessage builds a PGP/MIME (RFC 3156) message to `to`. The
+// entire MIME body of em -- text, HTML and attachments alike -- is
+// encrypted as one entity, so nothing but the outer headers is sent in
+// the clear.
+func NewEncryptedMessage(em *emailLib.Email, to string) (*Message, error) {
+	inner, err := em.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := crypto.EncryptMessage(em.From, to, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	msgId, err := newMessageId()
+	if err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", em.From)
+	header.Set("To", strings.Join(em.To, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("UTF-8", em.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-Id", msgId)
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", `multipart/encrypted; protocol="application/pgp-encrypted";`+
+		"\r\n boundary="+w.Boundary())
+	writeHeader(&buf, header)
+	io.WriteString(&buf, "\r\n")
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(part, "Version: 1\r\n")
+
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(bytes.Replace(encrypted, []byte("\n"), []byte("\r\n"), -1))
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return newMessage(em.From, em.To, buf.Bytes())
+}
+
+// writeHeader writes header in a stable order, which makes messages
+// easier to read and to test.
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, field := range []string{"From", "To", "Subject", "Date", "Message-Id",
+		"MIME-Version", "Content-Type"} {
+		for _, value := range header[textproto.CanonicalMIMEHeaderKey(field)] {
+			fmt.Fprintf(buf, "%s: %s\r\n", field, value)
+		}
+	}
+}
+
+func newMessageId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost.localdomain"
+	}
+	return "<" + hex.EncodeToString(b) + "@" + host + ">", nil
+}
+
+func parseAddress(address string) (string, error) {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
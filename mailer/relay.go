@@ -0,0 +1,385 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RelaysConfig is the JSON file listing the SMTP relays to send through
+// (see PURSUEMAIL_RELAYS_FILE).
+type RelaysConfig struct {
+	Relays []RelayConfig `json:"relays"`
+
+	// Consecutive failures after which a relay is considered unhealthy
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+
+	// How often unhealthy relays are checked for recovery
+	HealthCheckInterval Duration `json:"health_check_interval,omitempty"`
+}
+
+type RelayConfig struct {
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Login    string `json:"login,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Environment variable to read the password from instead, to keep it
+	// out of the file
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// Fields left unset default to the PURSUEMAIL_SMTP_TLS* settings
+	TLSPolicy
+
+	// Relays with the lowest priority are tried first; among them, each
+	// is picked in proportion to its weight (default 1)
+	Priority int `json:"priority,omitempty"`
+	Weight   int `json:"weight,omitempty"`
+
+	// If either is set, the relay only carries email from these sender
+	// domains or to these recipient domains. Email matching no such
+	// relay goes through the ones with neither set.
+	SenderDomains    []string `json:"sender_domains,omitempty"`
+	RecipientDomains []string `json:"recipient_domains,omitempty"`
+}
+
+// Duration is a time.Duration written as a string ("30s") in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func LoadRelaysConfig(path string) (*RelaysConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rc RelaysConfig
+	if err = json.Unmarshal(b, &rc); err != nil {
+		return nil, fmt.Errorf("Invalid relays file %s: %v", path, err)
+	}
+	if len(rc.Relays) == 0 {
+		return nil, fmt.Errorf("Relays file %s lists no relays", path)
+	}
+	if rc.FailureThreshold < 1 {
+		rc.FailureThreshold = 3
+	}
+	if rc.HealthCheckInterval <= 0 {
+		rc.HealthCheckInterval = Duration(30 * time.Second)
+	}
+	for i := range rc.Relays {
+		r := &rc.Relays[i]
+		if r.Server == "" {
+			return nil, fmt.Errorf("Relay #%d in %s has no server", i+1, path)
+		}
+		if r.Name == "" {
+			r.Name = r.Server
+		}
+		if r.Weight < 1 {
+			r.Weight = 1
+		}
+		if r.PasswordEnv != "" {
+			r.Password = os.Getenv(r.PasswordEnv)
+		}
+	}
+	return &rc, nil
+}
+
+type relay struct {
+	RelayConfig
+	pool *SMTPPool
+
+	mu       sync.Mutex
+	failures int
+	healthy  bool
+}
+
+func (r *relay) isHealthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.healthy
+}
+
+func (r *relay) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.healthy {
+		log.Infof("SMTP relay %s has recovered", r.Name)
+	}
+	r.failures = 0
+	r.healthy = true
+}
+
+func (r *relay) failed(threshold int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	if r.healthy && r.failures >= threshold {
+		log.Warnf("SMTP relay %s is unhealthy after %d consecutive failures", r.Name, r.failures)
+		r.healthy = false
+	}
+}
+
+func (r *relay) handles(sender string, recipients []string) bool {
+	for _, domain := range r.SenderDomains {
+		if strings.EqualFold(domain, addressDomain(sender)) {
+			return true
+		}
+	}
+	for _, domain := range r.RecipientDomains {
+		for _, rcpt := range recipients {
+			if strings.EqualFold(domain, addressDomain(rcpt)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *relay) general() bool {
+	return len(r.SenderDomains) == 0 && len(r.RecipientDomains) == 0
+}
+
+// RelayTransport is a Transport that spreads email across several SMTP
+// relays, failing over to the next one when a relay can't take a
+// message. Relays that keep failing are skipped until a health check
+// reaches them again.
+type RelayTransport struct {
+	relays    []*relay
+	threshold int
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	stop chan struct{}
+}
+
+// NewRelayTransport connects to each relay with its own TLS policy,
+// filled in from defaultTLS.
+func NewRelayTransport(rc *RelaysConfig, defaultTLS TLSPolicy, timeout time.Duration) (*RelayTransport, error) {
+	t := &RelayTransport{
+		threshold: rc.FailureThreshold,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:      make(chan struct{}),
+	}
+	for _, cfg := range rc.Relays {
+		host := strings.SplitN(cfg.Server, ":", 2)[0]
+		var auth smtp.Auth
+		if cfg.Login != "" {
+			auth = smtp.PlainAuth("", cfg.Login, cfg.Password, host)
+		}
+		tlsPolicy := cfg.TLSPolicy.WithDefaults(defaultTLS)
+		pool, err := NewSMTPPool(cfg.Server, cfg.MaxConnections, auth, &tlsPolicy, timeout)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("Relay %s: %v", cfg.Name, err)
+		}
+		t.relays = append(t.relays, &relay{RelayConfig: cfg, pool: pool, healthy: true})
+	}
+
+	go t.checkHealth(time.Duration(rc.HealthCheckInterval))
+	return t, nil
+}
+
+func NewRelayTransportFromFile(path string, defaultTLS TLSPolicy, timeout time.Duration) (*RelayTransport, error) {
+	rc, err := LoadRelaysConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRelayTransport(rc, defaultTLS, timeout)
+}
+
+// Send tries the relays for msg in order until one accepts it. A
+// permanent (5xx) rejection of a recipient or the message isn't the
+// relay's fault, so it's returned right away rather than retried
+// elsewhere; any other error counts against the relay.
+func (t *RelayTransport) Send(msg *Message) error {
+	relays := t.route(msg)
+	if len(relays) == 0 {
+		return errors.New("No SMTP relay handles this email")
+	}
+
+	var err error
+	for _, r := range relays {
+		err = r.pool.Send(msg)
+		if err == nil {
+			r.succeeded()
+			return nil
+		}
+		if isPermanentSMTPError(err) {
+			return err
+		}
+		log.Warnf("Error sending through SMTP relay %s: %v", r.Name, err)
+		r.failed(t.threshold)
+	}
+	return err
+}
+
+// route returns the relays to try for msg: those routed to by domain if
+// any are, otherwise the general ones. Healthy relays come first, by
+// priority and then weighted at random; unhealthy ones are only a last
+// resort.
+func (t *RelayTransport) route(msg *Message) []*relay {
+	var matched, general []*relay
+	for _, r := range t.relays {
+		if r.handles(msg.From, msg.To) {
+			matched = append(matched, r)
+		} else if r.general() {
+			general = append(general, r)
+		}
+	}
+	candidates := matched
+	if len(candidates) == 0 {
+		candidates = general
+	}
+
+	var healthy, unhealthy []*relay
+	for _, r := range candidates {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		} else {
+			unhealthy = append(unhealthy, r)
+		}
+	}
+	return append(t.order(healthy), t.order(unhealthy)...)
+}
+
+// order sorts relays by priority, shuffling each priority level so that
+// relays are picked first in proportion to their weight.
+func (t *RelayTransport) order(relays []*relay) []*relay {
+	byPriority := map[int][]*relay{}
+	var priorities []int
+	for _, r := range relays {
+		if _, ok := byPriority[r.Priority]; !ok {
+			priorities = append(priorities, r.Priority)
+		}
+		byPriority[r.Priority] = append(byPriority[r.Priority], r)
+	}
+	sort.Ints(priorities)
+
+	t.randMu.Lock()
+	defer t.randMu.Unlock()
+
+	ordered := make([]*relay, 0, len(relays))
+	for _, p := range priorities {
+		level := byPriority[p]
+		for len(level) > 0 {
+			total := 0
+			for _, r := range level {
+				total += r.Weight
+			}
+			n := t.rand.Intn(total)
+			for i, r := range level {
+				if n < r.Weight {
+					ordered = append(ordered, r)
+					level = append(level[:i:i], level[i+1:]...)
+					break
+				}
+				n -= r.Weight
+			}
+		}
+	}
+	return ordered
+}
+
+func (t *RelayTransport) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, r := range t.relays {
+			if r.isHealthy() {
+				continue
+			}
+			if err := r.pool.Ping(context.Background()); err != nil {
+				log.Debugf("SMTP relay %s still unhealthy: %v", r.Name, err)
+				continue
+			}
+			r.succeeded()
+		}
+	}
+}
+
+// Ping succeeds if any relay can be reached, since sends fail over to
+// whichever one is up.
+func (t *RelayTransport) Ping(ctx context.Context) error {
+	var err error
+	for _, r := range t.relays {
+		if err = r.pool.Ping(ctx); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("No SMTP relay reachable (last error: %v)", err)
+}
+
+func (t *RelayTransport) Close() error {
+	close(t.stop)
+	for _, r := range t.relays {
+		r.pool.Close()
+	}
+	return nil
+}
+
+// rejectedError is a server's reply to RCPT TO or DATA. Those are the
+// only replies about the message itself; errors while connecting, at
+// HELO, STARTTLS or AUTH, or at MAIL FROM are about the server.
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func rejected(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &rejectedError{err}
+}
+
+// isPermanentSMTPError reports whether err is a 5xx reply to RCPT TO or
+// DATA, which another server would give too. Other 5xx replies, like a
+// 535 to AUTH, mean the server can't be used, so the next one is tried.
+func isPermanentSMTPError(err error) bool {
+	rejErr, ok := err.(*rejectedError)
+	if !ok {
+		return false
+	}
+	tpErr, ok := rejErr.err.(*textproto.Error)
+	return ok && tpErr.Code >= 500 && tpErr.Code < 600
+}
+
+func addressDomain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
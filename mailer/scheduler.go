@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+)
+
+// How many due jobs the scheduler claims per poll
+const schedulerBatchSize = 100
+
+// A dispatching job's lease is renewed every jobLeaseRenewal while it
+// runs. Jobs whose lease hasn't been renewed for jobLeaseTimeout were
+// left by an instance that stopped, and are failed.
+const (
+	jobLeaseRenewal = time.Minute
+	jobLeaseTimeout = 5 * time.Minute
+)
+
+// Scheduler runs scheduled email jobs once they're due, and sends due
+// digests.
+type Scheduler struct {
+	mailer   *Mailer
+	interval time.Duration
+}
+
+func NewScheduler(m *Mailer, interval time.Duration) *Scheduler {
+	return &Scheduler{mailer: m, interval: interval}
+}
+
+// Run polls for due jobs and digests every interval until stop is
+// closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.failInterrupted()
+		s.runDue()
+		s.mailer.FlushDueDigests()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// failInterrupted marks jobs whose lease has run out as failed, whichever
+// instance left them dispatching. Some of their emails may have gone
+// out, so retrying them could send duplicates.
+func (s *Scheduler) failInterrupted() {
+	n, err := s.mailer.Store.FailInterruptedJobs(jobLeaseTimeout)
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		log.Warnf("Marked %d interrupted email jobs as failed", n)
+	}
+}
+
+func (s *Scheduler) runDue() {
+	for {
+		jobs, err := s.mailer.Store.ClaimDueJobs(schedulerBatchSize)
+		if err != nil {
+			return
+		}
+		for _, job := range jobs {
+			s.run(job)
+		}
+		if len(jobs) < schedulerBatchSize {
+			return
+		}
+	}
+}
+
+func (s *Scheduler) run(job *api.EmailJob) {
+	log.Debugf("Dispatching %s job %s scheduled for %s", job.Kind, job.Id, job.SendAt)
+
+	// Each job is the root of its own trace
+	ctx, span := telemetry.StartSpan(context.Background(), "EmailJob "+job.Kind)
+	span.SetAttribute("pursuemail.job_id", job.Id)
+	done := make(chan struct{})
+	go s.renewLease(job.Id, done)
+	result, err := s.dispatch(ctx, job)
+	close(done)
+	span.RecordError(err)
+	span.Finish()
+	status := api.JobSent
+	if err != nil {
+		log.Errorf("Error running email_job %s: %v", job.Id, err)
+		status = api.JobFailed
+		result = map[string]string{"error": err.Error()}
+	}
+
+	var resultJSON []byte
+	if result != nil {
+		if resultJSON, err = json.Marshal(result); err != nil {
+			log.Errorf("Error marshalling result of email_job %s: %v", job.Id, err)
+		}
+	}
+
+	s.mailer.Store.FinishEmailJob(job.Id, status, resultJSON)
+}
+
+// renewLease keeps renewing the job's lease until done is closed.
+func (s *Scheduler) renewLease(id string, done <-chan struct{}) {
+	ticker := time.NewTicker(jobLeaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mailer.Store.RenewJobLease(id)
+		}
+	}
+}
+
+// dispatch sends the job's request and returns what to record as its
+// result.
+func (s *Scheduler) dispatch(ctx context.Context, job *api.EmailJob) (interface{}, error) {
+	switch job.Kind {
+	case api.JobKindSend:
+		var req api.SendEmailRequest
+		if err := json.Unmarshal(job.Request, &req); err != nil {
+			return nil, err
+		}
+		emailAccount, err := s.mailer.GetEmailAccount(ctx, job.AccountId)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.mailer.Send(ctx, emailAccount, &req)
+		return nil, err
+
+	case api.JobKindBulkSend:
+		var req api.SendBulkEmailRequest
+		if err := json.Unmarshal(job.Request, &req); err != nil {
+			return nil, err
+		}
+		resp, err := s.mailer.BulkSend(ctx, &req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.FailedIds) == 0 && len(resp.Scheduled) == 0 {
+			return nil, nil
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("Unknown job kind %q", job.Kind)
+}
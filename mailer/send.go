@@ -0,0 +1,364 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+	emailLib "github.com/jordan-wright/email"
+)
+
+var (
+	errNotVerified = errors.New("address not verified")
+	errNoPubKey    = errors.New("no pub key")
+)
+
+// SendError is an error from sending that should be reported to the
+// caller with the given HTTP status code.
+type SendError struct {
+	Code int
+	Err  error
+}
+
+func (se *SendError) Error() string {
+	return se.Err.Error()
+}
+
+// Send renders the request's email and sends it to emailAccount,
+// refusing unverified accounts and (if SecureOnly) accounts without a
+// key. Non-urgent email to an account in digest mode is queued for its
+// next digest instead, and digested is true.
+func (m *Mailer) Send(ctx context.Context, emailAccount *store.EmailAccount, sendEmailReq *api.SendEmailRequest) (digested bool, err error) {
+	if !sendEmailReq.AllowUnverified && !emailAccount.CanReceive(m.Config.RequireVerification) {
+		errStr := fmt.Sprintf("Refusing to email %s - address not verified", emailAccount.Id)
+		log.Warn(errStr)
+		return false, &SendError{http.StatusForbidden, errors.New(errStr)}
+	}
+
+	if sendEmailReq.SecureOnly && !hasPubKey(ctx, emailAccount) {
+		secureOnlyRejectionsTotal.Inc(api.JobKindSend)
+		errStr := fmt.Sprintf("Failed SecureOnly Email to %s - no pub key", emailAccount.Id)
+		log.Warn(errStr)
+		return false, &SendError{http.StatusBadRequest, errors.New(errStr)}
+	}
+
+	emailData := sendEmailReq.EmailData
+	if emailData.Template != "" {
+		tmpl, err := m.loadCompiledTemplate(ctx, emailData.Template, emailData.TemplateVersion)
+		if err != nil {
+			return false, &SendError{http.StatusBadRequest, err}
+		}
+		emailData, err = renderEmail(ctx, emailData, tmpl, nil)
+		if err != nil {
+			return false, &SendError{http.StatusBadRequest,
+				errors.New("Error rendering template: " + err.Error())}
+		}
+	}
+
+	if emailAccount.Digests() && !sendEmailReq.Urgent {
+		return true, m.Store.QueueDigestItem(emailAccount, emailData, sendEmailReq.SecureOnly)
+	}
+
+	return false, m.Deliver(ctx, emailAccount, emailData)
+}
+
+// PinTemplateVersion sets emailData's TemplateVersion to the current
+// version of its template if it doesn't give one, so that an email
+// scheduled for later isn't changed by the template being edited or
+// deleted in the meantime.
+func (m *Mailer) PinTemplateVersion(ctx context.Context, emailData *api.EmailData) error {
+	if emailData.Template == "" || emailData.TemplateVersion != 0 {
+		return nil
+	}
+	tmpl, err := m.loadCompiledTemplate(ctx, emailData.Template, 0)
+	if err != nil {
+		return &SendError{http.StatusBadRequest, err}
+	}
+	emailData.TemplateVersion = tmpl.Version
+	return nil
+}
+
+// BulkSend looks up the request's recipients and template and sends to
+// all of them with SendBulkEmail.
+func (m *Mailer) BulkSend(ctx context.Context, sendBulkEmailReq *api.SendBulkEmailRequest) (*api.SendBulkEmailResponse, error) {
+	var err error
+	emailAccounts := []*store.EmailAccount{}
+	if len(sendBulkEmailReq.Ids) > 0 {
+		// TODO - If SecureOnly is true, should filter out in db query
+		// TODO - support returning 500 as well
+		_, span := telemetry.StartSpan(ctx, "GetEmailAccounts")
+		span.SetAttribute("pursuemail.ids", len(sendBulkEmailReq.Ids))
+		emailAccounts, err = m.Store.GetEmailAccounts(sendBulkEmailReq.Ids)
+		span.RecordError(err)
+		span.Finish()
+		if err != nil {
+			return nil, &SendError{http.StatusNotFound, err}
+		}
+	} else if len(sendBulkEmailReq.Emails) > 0 {
+		for _, email := range sendBulkEmailReq.Emails {
+			emailAccounts = append(emailAccounts, &store.EmailAccount{Email: email})
+		}
+	}
+
+	var tmpl *CompiledTemplate
+	if sendBulkEmailReq.EmailData.Template != "" {
+		tmpl, err = m.loadCompiledTemplate(ctx, sendBulkEmailReq.EmailData.Template,
+			sendBulkEmailReq.EmailData.TemplateVersion)
+		if err != nil {
+			return nil, &SendError{http.StatusBadRequest, err}
+		}
+	}
+
+	resp := &api.SendBulkEmailResponse{}
+	if sendBulkEmailReq.RespectQuietHours {
+		emailAccounts = m.holdForQuietHours(emailAccounts, sendBulkEmailReq, tmpl, resp)
+	}
+
+	failedIds, errs := m.SendBulkEmail(ctx, emailAccounts, sendBulkEmailReq, tmpl)
+	resp.FailedIds = append(resp.FailedIds, failedIds...)
+	if resp.Errors == nil {
+		resp.Errors = errs
+	} else {
+		for key, err := range errs {
+			resp.Errors[key] = err
+		}
+	}
+	return resp, nil
+}
+
+// holdForQuietHours schedules a separate job for each account that's in
+// its quiet hours, recording it in resp, and returns the accounts that
+// can be sent to now. Held emails keep the recipient's vars and the
+// template version everyone else gets.
+func (m *Mailer) holdForQuietHours(emailAccounts []*store.EmailAccount, sendBulkEmailReq *api.SendBulkEmailRequest, tmpl *CompiledTemplate, resp *api.SendBulkEmailResponse) []*store.EmailAccount {
+	now := time.Now()
+	sendNow := []*store.EmailAccount{}
+	for _, email := range emailAccounts {
+		sendAt := email.NextDeliveryTime(now)
+		if email.Id == "" || !sendAt.After(now) {
+			sendNow = append(sendNow, email)
+			continue
+		}
+
+		key := recipientKey(email)
+		emailData := sendBulkEmailReq.EmailData
+		if tmpl != nil {
+			emailData.TemplateVersion = tmpl.Version
+			emailData.Vars = make(map[string]interface{})
+			for k, v := range sendBulkEmailReq.EmailData.Vars {
+				emailData.Vars[k] = v
+			}
+			for k, v := range sendBulkEmailReq.Vars[key] {
+				emailData.Vars[k] = v
+			}
+		}
+
+		job, err := m.Store.ScheduleEmailJob(api.JobKindSend, email.Id, &api.SendEmailRequest{
+			EmailData:       emailData,
+			SecureOnly:      sendBulkEmailReq.SecureOnly,
+			AllowUnverified: sendBulkEmailReq.AllowUnverified,
+		}, sendAt)
+		if err != nil {
+			resp.FailedIds = append(resp.FailedIds, key)
+			if resp.Errors == nil {
+				resp.Errors = map[string]string{}
+			}
+			resp.Errors[key] = err.Error()
+			continue
+		}
+
+		if resp.Scheduled == nil {
+			resp.Scheduled = map[string]string{}
+		}
+		resp.Scheduled[key] = job.Id
+	}
+	return sendNow
+}
+
+type bulkSendResult struct {
+	key string
+	err error
+}
+
+// recipientKey identifies a recipient in SendBulkEmailRequest.Vars and
+// in the failures reported back: its ID, or its address when sending to
+// bare addresses.
+func recipientKey(email *store.EmailAccount) string {
+	if email.Id != "" {
+		return email.Id
+	}
+	return email.Email
+}
+
+// SendBulkEmail sends to every account concurrently, rendering tmpl (if
+// non-nil) separately for each one. It returns the keys of the
+// recipients that failed, along with why.
+func (m *Mailer) SendBulkEmail(ctx context.Context, emailAccounts []*store.EmailAccount, sendBulkEmailReq *api.SendBulkEmailRequest, tmpl *CompiledTemplate) (failedIds []string, errs map[string]string) {
+	errs = map[string]string{}
+	fail := func(key string, err error) {
+		failedIds = append(failedIds, key)
+		errs[key] = err.Error()
+	}
+
+	resultsChan := make(chan bulkSendResult)
+	var total int
+	wg := new(sync.WaitGroup)
+	for i, email := range emailAccounts {
+		key := recipientKey(email)
+		if !sendBulkEmailReq.AllowUnverified && !email.CanReceive(m.Config.RequireVerification) {
+			fail(key, errNotVerified)
+			continue
+		}
+		if sendBulkEmailReq.SecureOnly && !hasPubKey(ctx, email) {
+			secureOnlyRejectionsTotal.Inc(api.JobKindBulkSend)
+			fail(key, errNoPubKey)
+			continue
+		}
+
+		total++
+		wg.Add(1)
+		go func(i int, email *store.EmailAccount, key string) {
+			result := bulkSendResult{key: key}
+			log.Debugf("Sending bulk email #%v", i+1)
+
+			emailData := sendBulkEmailReq.EmailData
+			if tmpl != nil {
+				emailData, result.err = renderEmail(ctx, emailData, tmpl, sendBulkEmailReq.Vars[key])
+				if result.err != nil {
+					log.Errorf("Error rendering (instance of bulk) email: %v", result.err)
+				}
+			}
+			if result.err == nil {
+				result.err = m.Deliver(ctx, email, emailData)
+				if result.err != nil {
+					log.Errorf("Error sending (instance of bulk) email: %v", result.err)
+				}
+			}
+			wg.Done()
+			resultsChan <- result
+		}(i, email, key)
+	}
+
+	log.Debugf("SendBulkEmailRequest: waiting for %v email(s) to send", total)
+	wg.Wait()
+
+	var result bulkSendResult
+	for i := 0; i < total; i++ {
+		result = <-resultsChan
+		if result.err != nil {
+			fail(result.key, result.err)
+		}
+	}
+
+	return failedIds, errs
+}
+
+// GetEmailAccount is Store.GetEmailAccount in a span of its own.
+func (m *Mailer) GetEmailAccount(ctx context.Context, id string) (*store.EmailAccount, error) {
+	_, span := telemetry.StartSpan(ctx, "GetEmailAccount")
+	defer span.Finish()
+	span.SetAttribute("pursuemail.account_id", id)
+	emailAccount, err := m.Store.GetEmailAccount(id)
+	span.RecordError(err)
+	return emailAccount, err
+}
+
+// loadCompiledTemplate is LoadCompiledTemplate in a span of its own.
+func (m *Mailer) loadCompiledTemplate(ctx context.Context, name string, version int) (*CompiledTemplate, error) {
+	_, span := telemetry.StartSpan(ctx, "LoadCompiledTemplate")
+	defer span.Finish()
+	span.SetAttribute("pursuemail.template", name)
+	tmpl, err := LoadCompiledTemplate(m.Store, name, version)
+	span.RecordError(err)
+	return tmpl, err
+}
+
+// renderEmail is CompiledTemplate.Render in a span of its own.
+func renderEmail(ctx context.Context, emailData api.EmailData, tmpl *CompiledTemplate, vars map[string]interface{}) (api.EmailData, error) {
+	_, span := telemetry.StartSpan(ctx, "EmailData.Render")
+	defer span.Finish()
+	rendered, err := tmpl.Render(emailData, vars)
+	span.RecordError(err)
+	return rendered, err
+}
+
+// Deliver encrypts emailData to the account's public key, if it has one,
+// and hands it to the transport.
+func (m *Mailer) Deliver(ctx context.Context, e *store.EmailAccount, emailData api.EmailData) error {
+	ctx, span := telemetry.StartSpan(ctx, "Mailer.Deliver")
+	defer span.Finish()
+	span.SetAttribute("pursuemail.account_id", e.Id)
+
+	err := m.deliver(ctx, e, emailData)
+	span.RecordError(err)
+	return err
+}
+
+func (m *Mailer) deliver(ctx context.Context, e *store.EmailAccount, emailData api.EmailData) error {
+	sendableEmail, err := ToSendableEmail(emailData)
+	if err != nil {
+		return err
+	}
+	sendableEmail.To = []string{e.Email}
+
+	var msg *Message
+	encryption := "none"
+	if hasPubKey(ctx, e) {
+		encryption = "pgp"
+		_, encSpan := telemetry.StartSpan(ctx, "NewEncryptedMessage")
+		msg, err = NewEncryptedMessage(sendableEmail, e.Email)
+		encSpan.RecordError(err)
+		encSpan.Finish()
+		if err != nil {
+			log.Errorf("Error encrypting message: %v\n", err)
+		}
+	} else {
+		msg, err = NewMessage(sendableEmail)
+	}
+	span := telemetry.SpanFromContext(ctx)
+	span.SetAttribute("pursuemail.encryption", encryption)
+	if err == nil {
+		_, sendSpan := telemetry.StartSpan(ctx, "Transport.Send")
+		sendSpan.SetKind(telemetry.SpanKindClient)
+		err = m.Transport.Send(msg)
+		sendSpan.RecordError(err)
+		sendSpan.Finish()
+	}
+	emailsTotal.Inc(outcome(err), encryption)
+	return err
+}
+
+// hasPubKey is EmailAccount.HasPubKey in a span of its own, since parsing
+// the keyring can be a good part of a send.
+func hasPubKey(ctx context.Context, e *store.EmailAccount) bool {
+	_, span := telemetry.StartSpan(ctx, "HasPubKey")
+	defer span.Finish()
+	has := e.HasPubKey()
+	span.SetAttribute("pursuemail.has_pub_key", has)
+	return has
+}
+
+// ToSendableEmail builds the unencrypted email for emailData, without
+// any recipients.
+func ToSendableEmail(ed api.EmailData) (*emailLib.Email, error) {
+	em := emailLib.NewEmail()
+
+	em.From = ed.From
+	em.Subject = ed.Subject
+	em.Text = []byte(ed.Body)
+	if ed.HTML != "" {
+		em.HTML = []byte(ed.HTML)
+	}
+	if err := attachAll(em, ed.Attachments); err != nil {
+		return nil, err
+	}
+
+	return em, nil
+}
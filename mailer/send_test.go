@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+)
+
+func TestDeliverSpans(t *testing.T) {
+	dir := t.TempDir()
+	pubring, secring := crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME
+	crypto.PUBLIC_KEYRING_FILENAME = filepath.Join(dir, "pubring.gpg")
+	crypto.PRIVATE_KEYRING_FILENAME = filepath.Join(dir, "secring.gpg")
+	defer func() {
+		crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME = pubring, secring
+	}()
+
+	exporter := &telemetry.InMemoryExporter{}
+	telemetry.ConfigureTracing(exporter, 1)
+	defer telemetry.ConfigureTracing(nil, 0)
+
+	// The API rejects the recipient, naming them in the error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		http.Error(w, "Mailbox "+r.FormValue("to")+" is full", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	transport, err := NewHTTPTransport(srv.URL, "", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(store.NewMemory(), transport, Config{})
+
+	account := &store.EmailAccount{Id: "1f0a3c3d-2b11-4d0c-9d7e-9e4ee5c03b1c", Email: "someone@example.com"}
+	err = m.Deliver(context.Background(), account, api.EmailData{
+		From: "sender@example.com", Subject: "Hi", Body: "Hello"})
+	if err == nil || !strings.Contains(err.Error(), "someone@example.com") {
+		t.Fatalf("Deliver err = %v, want the API's rejection", err)
+	}
+
+	spans := map[string]*telemetry.Span{}
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+	deliver, send := spans["Mailer.Deliver"], spans["Transport.Send"]
+	if deliver == nil || send == nil || spans["HasPubKey"] == nil {
+		t.Fatalf("Missing spans in %v", spans)
+	}
+	if send.TraceID != deliver.TraceID || send.ParentSpanID != deliver.SpanID {
+		t.Error("Transport.Send isn't a child of Mailer.Deliver")
+	}
+	if send.Kind != telemetry.SpanKindClient {
+		t.Errorf("Transport.Send kind = %d", send.Kind)
+	}
+	for _, span := range []*telemetry.Span{deliver, send} {
+		if span.Error == "" {
+			t.Errorf("%s has no error", span.Name)
+		}
+		if strings.Contains(span.Error, "someone@example.com") || !strings.Contains(span.Error, "s***@example.com") {
+			t.Errorf("%s error isn't scrubbed: %s", span.Name, span.Error)
+		}
+	}
+
+	attrs := map[string]interface{}{}
+	for _, attr := range deliver.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs["pursuemail.account_id"] != account.Id || attrs["pursuemail.encryption"] != "none" {
+		t.Errorf("Mailer.Deliver attributes = %v", attrs)
+	}
+}
@@ -0,0 +1,362 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+
+	emailLib "github.com/jordan-wright/email"
+)
+
+// How much of a message Send writes before giving the server a fresh
+// timeout
+const smtpWriteChunk = 64 << 10
+
+var (
+	ErrPoolClosed  = errors.New("SMTP pool closed")
+	ErrPoolTimeout = errors.New("Timed out waiting for an SMTP connection")
+
+	ErrAuthNotOffered = errors.New("SMTP server doesn't offer AUTH, but a login is configured")
+)
+
+// Message is a fully assembled email, ready to hand to an SMTP server
+// as-is.
+type Message struct {
+	// Envelope sender and recipients
+	From string
+	To   []string
+
+	// RFC 5322 message, headers and body
+	Data []byte
+}
+
+// NewMessage assembles em and takes the envelope from its From and To.
+func NewMessage(em *emailLib.Email) (*Message, error) {
+	data, err := em.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return newMessage(em.From, em.To, data)
+}
+
+func newMessage(from string, to []string, data []byte) (*Message, error) {
+	msg := &Message{Data: data}
+
+	fromAddr, err := parseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	msg.From = fromAddr
+
+	for _, rcpt := range to {
+		addr, err := parseAddress(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		msg.To = append(msg.To, addr)
+	}
+	if len(msg.To) == 0 {
+		return nil, errors.New("Message has no recipients")
+	}
+	return msg, nil
+}
+
+// SMTPPool is a Transport that keeps up to max connections to a single
+// SMTP server open and reuses them across sends. Unlike emailLib.Pool it
+// sends pre-assembled messages, which PGP/MIME needs.
+type SMTPPool struct {
+	addr      string
+	host      string
+	auth      smtp.Auth
+	tlsMode   string
+	tlsConfig *tls.Config
+
+	// How long Send waits for a connection, and for the server to
+	// answer each command
+	timeout time.Duration
+
+	// Holds one token per open connection
+	slots chan struct{}
+	idle  chan *smtpConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewSMTPPool returns a pool of connections to addr secured according
+// to tlsPolicy, which defaults to requiring STARTTLS.
+func NewSMTPPool(addr string, max int, auth smtp.Auth, tlsPolicy *TLSPolicy, timeout time.Duration) (*SMTPPool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsPolicy == nil {
+		tlsPolicy = &TLSPolicy{Mode: TLSRequired}
+	}
+	if err = tlsPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsPolicy.TLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	if max < 1 {
+		max = 1
+	}
+	p := &SMTPPool{
+		addr:      addr,
+		host:      host,
+		auth:      auth,
+		tlsMode:   tlsPolicy.Mode,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		slots:     make(chan struct{}, max),
+		idle:      make(chan *smtpConn, max),
+	}
+	trackSMTPPool(p, true)
+	return p, nil
+}
+
+// smtpConn is a pooled connection, along with the net.Conn under it so
+// that it can be given deadlines.
+type smtpConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// extend gives the server timeout to answer the next command, so that
+// one that stops responding can't hold up a send forever.
+func (c *smtpConn) extend(timeout time.Duration) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// dial connects and secures the connection as the TLS mode says, before
+// authenticating. With mode required, a server not offering STARTTLS is
+// an error rather than a reason to carry on in plaintext, and so is a
+// server not offering AUTH when there's a login to use. Setting up the
+// connection must finish by ctx's deadline, if it has one.
+func (p *SMTPPool) dial(ctx context.Context) (*smtpConn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+
+	var conn net.Conn
+	var err error
+	if p.tlsMode == TLSImplicit {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: p.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", p.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, p.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if p.tlsMode == TLSOpportunistic || p.tlsMode == TLSRequired {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && p.tlsMode == TLSRequired {
+			c.Close()
+			return nil, ErrStartTLSRequired
+		}
+		if ok {
+			if err = c.StartTLS(p.tlsConfig); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	if p.auth != nil {
+		// Carrying on without logging in would send unauthenticated
+		// mail, which the server will likely reject or treat as spam
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, ErrAuthNotOffered
+		}
+		if err = c.Auth(p.auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpConn{c, conn}, nil
+}
+
+func (p *SMTPPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// get returns an idle connection, or a new one if fewer than max are
+// open, waiting up to timeout for either. Idle connections the server
+// has since dropped are discarded.
+func (p *SMTPPool) get(timeout time.Duration) (*smtpConn, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if p.isClosed() {
+			return nil, ErrPoolClosed
+		}
+
+		select {
+		case c := <-p.idle:
+			if !p.alive(c) {
+				continue
+			}
+			return c, nil
+		default:
+		}
+
+		select {
+		case c := <-p.idle:
+			if !p.alive(c) {
+				continue
+			}
+			return c, nil
+		case p.slots <- struct{}{}:
+			ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+			c, err := p.dial(ctx)
+			cancel()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return c, nil
+		case <-timer.C:
+			return nil, ErrPoolTimeout
+		}
+	}
+}
+
+// alive checks that the server hasn't dropped an idle connection,
+// discarding it if it has.
+func (p *SMTPPool) alive(c *smtpConn) bool {
+	c.extend(p.timeout)
+	if c.Noop() != nil {
+		p.discard(c)
+		return false
+	}
+	return true
+}
+
+func (p *SMTPPool) put(c *smtpConn) {
+	if p.isClosed() {
+		c.extend(p.timeout)
+		c.Quit()
+		<-p.slots
+		return
+	}
+	p.idle <- c
+}
+
+func (p *SMTPPool) discard(c *smtpConn) {
+	c.Close()
+	<-p.slots
+}
+
+// Send delivers msg over a pooled connection, waiting up to the pool's
+// timeout for one to become available, and as long again for each reply
+// from the server. Connections that hit an error are dropped rather than
+// reused.
+func (p *SMTPPool) Send(msg *Message) (err error) {
+	start := time.Now()
+	defer func() { smtpSendSeconds.ObserveSince(start, p.addr, outcome(err)) }()
+
+	c, err := p.get(p.timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		c.extend(p.timeout)
+		if err != nil || c.Reset() != nil {
+			p.discard(c)
+			return
+		}
+		p.put(c)
+	}()
+
+	c.extend(p.timeout)
+	if err = c.Mail(msg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range msg.To {
+		c.extend(p.timeout)
+		if err = c.Rcpt(rcpt); err != nil {
+			return rejected(err)
+		}
+	}
+	c.extend(p.timeout)
+	w, err := c.Data()
+	if err != nil {
+		return rejected(err)
+	}
+	// Large messages get as long as they take, as long as they keep
+	// moving
+	for data := msg.Data; len(data) > 0; {
+		n := len(data)
+		if n > smtpWriteChunk {
+			n = smtpWriteChunk
+		}
+		c.extend(p.timeout)
+		if _, err = w.Write(data[:n]); err != nil {
+			w.Close()
+			return err
+		}
+		data = data[n:]
+	}
+	c.extend(p.timeout)
+	return rejected(w.Close())
+}
+
+// Ping checks that the server can be reached and is taking commands,
+// over a connection of its own so it neither waits for nor takes up one
+// that sends need. It gives up at ctx's deadline, or after the pool's
+// timeout if ctx has none.
+func (p *SMTPPool) Ping(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Noop(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Close closes idle connections and stops new ones from being opened.
+// Connections in use are closed when they're returned.
+func (p *SMTPPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	trackSMTPPool(p, false)
+
+	for {
+		select {
+		case c := <-p.idle:
+			c.extend(p.timeout)
+			c.Quit()
+			<-p.slots
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package mailer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer answers SMTP on a local port, offering exts in its EHLO
+// reply. It stops answering once it gets a command starting with hang.
+type fakeSMTPServer struct {
+	ln   net.Listener
+	exts []string
+	hang string
+
+	mu   sync.Mutex
+	msgs []string
+}
+
+func newFakeSMTPServer(t *testing.T, exts []string, hang string) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeSMTPServer{ln: ln, exts: exts, hang: hang}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeSMTPServer) Addr() string {
+	return srv.ln.Addr().String()
+}
+
+func (srv *fakeSMTPServer) Messages() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.msgs...)
+}
+
+func (srv *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "220 fake ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		if srv.hang != "" && strings.HasPrefix(cmd, srv.hang) {
+			// Hold the connection open until the client gives up
+			io.Copy(io.Discard, r)
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply := "250-fake\r\n"
+			for _, ext := range srv.exts {
+				reply += "250-" + ext + "\r\n"
+			}
+			io.WriteString(conn, reply+"250 SIZE 10485760\r\n")
+		case strings.HasPrefix(cmd, "AUTH"):
+			io.WriteString(conn, "235 Authenticated\r\n")
+		case cmd == "DATA":
+			io.WriteString(conn, "354 Go ahead\r\n")
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			srv.mu.Lock()
+			srv.msgs = append(srv.msgs, msg.String())
+			srv.mu.Unlock()
+			io.WriteString(conn, "250 Queued\r\n")
+		case cmd == "QUIT":
+			io.WriteString(conn, "221 Bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func TestSMTPPoolSend(t *testing.T) {
+	srv := newFakeSMTPServer(t, nil, "")
+	p, err := NewSMTPPool(srv.Addr(), 1, nil, &TLSPolicy{Mode: TLSNone}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	msg := &Message{From: "sender@example.org", To: []string{"someone@example.com"},
+		Data: []byte("Subject: Hi\r\n\r\n" + strings.Repeat("Hello\r\n", 20000))}
+	for i := 0; i < 2; i++ {
+		if err := p.Send(msg); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+	if msgs := srv.Messages(); len(msgs) != 2 || !strings.HasPrefix(msgs[0], "Subject: Hi\r\n") {
+		t.Errorf("Server got %d messages, want 2", len(msgs))
+	}
+}
+
+func TestSMTPPoolSendTimesOut(t *testing.T) {
+	for _, hang := range []string{"EHLO", "MAIL", "RCPT", "DATA"} {
+		srv := newFakeSMTPServer(t, nil, hang)
+		p, err := NewSMTPPool(srv.Addr(), 1, nil, &TLSPolicy{Mode: TLSNone}, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Send(&Message{From: "sender@example.org", To: []string{"someone@example.com"},
+				Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("Server stops answering %s: Send succeeded", hang)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Server stops answering %s: Send is still waiting", hang)
+		}
+		p.Close()
+	}
+}
+
+func TestSMTPPoolAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		exts []string
+		auth bool
+		err  error
+	}{
+		{"login, AUTH offered", []string{"AUTH PLAIN"}, true, nil},
+		{"login, AUTH not offered", nil, true, ErrAuthNotOffered},
+		{"no login", nil, false, nil},
+	}
+	for _, tt := range tests {
+		srv := newFakeSMTPServer(t, tt.exts, "")
+		var auth smtp.Auth
+		if tt.auth {
+			auth = smtp.PlainAuth("", "pursuemail", "secret", "127.0.0.1")
+		}
+		p, err := NewSMTPPool(srv.Addr(), 1, auth, &TLSPolicy{Mode: TLSNone}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Send(&Message{From: "sender@example.org", To: []string{"someone@example.com"},
+			Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+		if err != tt.err {
+			t.Errorf("%s: Send err = %v, want %v", tt.name, err, tt.err)
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"bytes"
+	htmlTemplate "html/template"
+	"io"
+	textTemplate "text/template"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+// CompiledTemplate is a parsed store.EmailTemplate, ready to be rendered for
+// any number of recipients.
+type CompiledTemplate struct {
+	Name    string
+	Version int
+	subject *textTemplate.Template
+	text    *textTemplate.Template
+	html    *htmlTemplate.Template
+}
+
+// Compile parses the template's subject and bodies.
+func Compile(t *store.EmailTemplate) (*CompiledTemplate, error) {
+	var err error
+	ct := &CompiledTemplate{Name: t.Name, Version: t.Version}
+
+	if t.Subject != "" {
+		ct.subject, err = textTemplate.New("subject").Option("missingkey=error").Parse(t.Subject)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.Text != "" {
+		ct.text, err = textTemplate.New("text").Option("missingkey=error").Parse(t.Text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.HTML != "" {
+		ct.html, err = htmlTemplate.New("html").Option("missingkey=error").Parse(t.HTML)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ct, nil
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func execute(tmpl executor, vars map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Render fills in the subject, text and HTML body of ed from tmpl. vars
+// are layered on top of ed.Vars, so per-recipient values win.
+func (tmpl *CompiledTemplate) Render(ed api.EmailData, vars map[string]interface{}) (api.EmailData, error) {
+	data := make(map[string]interface{}, len(ed.Vars)+len(vars))
+	for k, v := range ed.Vars {
+		data[k] = v
+	}
+	for k, v := range vars {
+		data[k] = v
+	}
+
+	var err error
+	if tmpl.subject != nil {
+		if ed.Subject, err = execute(tmpl.subject, data); err != nil {
+			return ed, err
+		}
+	}
+	if tmpl.text != nil {
+		if ed.Body, err = execute(tmpl.text, data); err != nil {
+			return ed, err
+		}
+	}
+	if tmpl.html != nil {
+		if ed.HTML, err = execute(tmpl.html, data); err != nil {
+			return ed, err
+		}
+	}
+	return ed, nil
+}
+
+// LoadCompiledTemplate fetches and compiles the given version of the
+// named template, or its current version if version is 0.
+func LoadCompiledTemplate(st Store, name string, version int) (*CompiledTemplate, error) {
+	var (
+		t   *store.EmailTemplate
+		err error
+	)
+	if version == 0 {
+		t, err = st.GetEmailTemplate(name)
+	} else {
+		t, err = st.GetEmailTemplateVersion(name, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Compile(t)
+}
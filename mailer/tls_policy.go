@@ -0,0 +1,124 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// Plaintext only, even if the server offers STARTTLS. For local
+	// testing.
+	TLSNone = "none"
+
+	// STARTTLS if the server offers it, plaintext otherwise
+	TLSOpportunistic = "opportunistic"
+
+	// STARTTLS, failing the send if the server doesn't offer it
+	TLSRequired = "required"
+
+	// TLS from the start of the connection (SMTPS, usually port 465)
+	TLSImplicit = "implicit"
+)
+
+var ErrStartTLSRequired = errors.New("SMTP server doesn't offer STARTTLS, which the TLS policy requires")
+
+// TLSPolicy is how connections to an SMTP server are secured.
+// Certificates are always verified, against CAFile if set and the
+// system roots otherwise.
+type TLSPolicy struct {
+	Mode string `json:"tls_mode,omitempty"`
+
+	// PEM file of CAs to trust instead of the system roots
+	CAFile string `json:"tls_ca_file,omitempty"`
+
+	// PEM client certificate and key to present to the server
+	ClientCert string `json:"tls_client_cert,omitempty"`
+	ClientKey  string `json:"tls_client_key,omitempty"`
+
+	// Name to verify the server's certificate against, if not its host
+	ServerName string `json:"tls_server_name,omitempty"`
+
+	// "1.2" (the default) or "1.3"
+	MinVersion string `json:"tls_min_version,omitempty"`
+}
+
+func (p *TLSPolicy) Validate() error {
+	switch p.Mode {
+	case TLSNone, TLSOpportunistic, TLSRequired, TLSImplicit:
+	default:
+		return fmt.Errorf("Invalid TLS mode %q, want %s, %s, %s or %s",
+			p.Mode, TLSNone, TLSOpportunistic, TLSRequired, TLSImplicit)
+	}
+	if (p.ClientCert == "") != (p.ClientKey == "") {
+		return errors.New("A TLS client certificate needs both a cert and a key file")
+	}
+	if _, err := tlsVersion(p.MinVersion); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WithDefaults fills in the fields p leaves empty from defaults.
+func (p TLSPolicy) WithDefaults(defaults TLSPolicy) TLSPolicy {
+	if p.Mode == "" {
+		p.Mode = defaults.Mode
+	}
+	if p.CAFile == "" {
+		p.CAFile = defaults.CAFile
+	}
+	if p.ClientCert == "" && p.ClientKey == "" {
+		p.ClientCert, p.ClientKey = defaults.ClientCert, defaults.ClientKey
+	}
+	if p.ServerName == "" {
+		p.ServerName = defaults.ServerName
+	}
+	if p.MinVersion == "" {
+		p.MinVersion = defaults.MinVersion
+	}
+	return p
+}
+
+// TLSConfig builds the tls.Config for connecting to host.
+func (p *TLSPolicy) TLSConfig(host string) (*tls.Config, error) {
+	minVersion, err := tlsVersion(p.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: minVersion}
+	if p.ServerName != "" {
+		tlsConfig.ServerName = p.ServerName
+	}
+
+	if p.CAFile != "" {
+		pem, err := ioutil.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", p.CAFile)
+		}
+	}
+
+	if p.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(p.ClientCert, p.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Invalid minimum TLS version %q, want 1.2 or 1.3", version)
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	TransportSMTP     = "smtp"
+	TransportDirect   = "direct"
+	TransportSendmail = "sendmail"
+	TransportMaildir  = "maildir"
+	TransportMbox     = "mbox"
+	TransportHTTP     = "http"
+)
+
+// Transport delivers fully assembled messages.
+type Transport interface {
+	Send(msg *Message) error
+	Close() error
+}
+
+// TransportConfig selects and sets up a Transport.
+type TransportConfig struct {
+	// How email is delivered: smtp, direct, sendmail, maildir, mbox or
+	// http
+	Transport string
+
+	// SMTP server ("host:port") and credentials for the smtp transport
+	SMTPServer   string
+	SMTPLogin    string
+	SMTPPassword string
+
+	// JSON file listing several SMTP relays to use instead of SMTPServer
+	RelaysFile string
+
+	// How long to wait for a free SMTP connection
+	SMTPTimeout time.Duration
+
+	// How SMTP connections are secured; relays may override it
+	SMTPTLS TLSPolicy
+
+	// sendmail binary for the sendmail transport
+	SendmailPath string
+
+	// Maildir directory or mbox file for the maildir and mbox transports
+	MailPath string
+
+	// Endpoint accepting raw MIME messages (e.g. Mailgun's
+	// /v3/<domain>/messages.mime) and its API key, for the http transport
+	HTTPAPIURL string
+	HTTPAPIKey string
+
+	// For the direct transport: the DNSSEC-validating resolver
+	// ("host:port") to look up MX and TLSA records with, the name to
+	// greet MX hosts with, and the port to deliver to
+	DNSServer  string
+	HELOName   string
+	DirectPort string
+
+	// JSON file listing the DKIM keys to sign outgoing email with
+	DKIMFile string
+}
+
+// NewTransport builds the transport selected by cfg.Transport, signing
+// messages with DKIM if cfg.DKIMFile is set.
+func NewTransport(cfg *TransportConfig) (Transport, error) {
+	transport, err := newTransport(cfg)
+	if err != nil || cfg.DKIMFile == "" {
+		return transport, err
+	}
+	signer, err := LoadDKIMSigner(cfg.DKIMFile)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return NewDKIMTransport(transport, signer), nil
+}
+
+func newTransport(cfg *TransportConfig) (Transport, error) {
+	switch cfg.Transport {
+	case TransportSMTP:
+		if cfg.RelaysFile != "" {
+			return NewRelayTransportFromFile(cfg.RelaysFile, cfg.SMTPTLS, cfg.SMTPTimeout)
+		}
+		host := strings.SplitN(cfg.SMTPServer, ":", 2)[0]
+		var auth smtp.Auth
+		if cfg.SMTPLogin != "" {
+			auth = smtp.PlainAuth("", cfg.SMTPLogin, cfg.SMTPPassword, host)
+		}
+		return NewSMTPPool(cfg.SMTPServer, 1, auth, &cfg.SMTPTLS, cfg.SMTPTimeout)
+	case TransportDirect:
+		return NewDirectTransport(cfg.DNSServer, cfg.HELOName, cfg.DirectPort, cfg.SMTPTimeout), nil
+	case TransportSendmail:
+		return NewSendmailTransport(cfg.SendmailPath), nil
+	case TransportMaildir:
+		return NewMaildirTransport(cfg.MailPath)
+	case TransportMbox:
+		return NewMboxTransport(cfg.MailPath)
+	case TransportHTTP:
+		return NewHTTPTransport(cfg.HTTPAPIURL, cfg.HTTPAPIKey, nil)
+	}
+	return nil, fmt.Errorf("Unknown PURSUEMAIL_TRANSPORT %q", cfg.Transport)
+}
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaildirTransport delivers each message as a file in a Maildir, which
+// most mail clients can open. Meant for development and testing.
+type MaildirTransport struct {
+	dir string
+}
+
+func NewMaildirTransport(dir string) (*MaildirTransport, error) {
+	if dir == "" {
+		return nil, errors.New("The maildir transport needs PURSUEMAIL_MAIL_PATH")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirTransport{dir: dir}, nil
+}
+
+// Send writes msg to tmp/ and then moves it into new/, so readers never
+// see a partial message.
+func (t *MaildirTransport) Send(msg *Message) error {
+	name, err := maildirName()
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(t.dir, "tmp", name)
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(withEnvelope(msg))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(t.dir, "new", name))
+}
+
+func (t *MaildirTransport) Close() error {
+	return nil
+}
+
+func maildirName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.%s.%s", time.Now().Unix(), hex.EncodeToString(b), host), nil
+}
+
+// MboxTransport appends each message to a single mbox file, quoting
+// "From " lines the mboxrd way. Meant for development and testing.
+type MboxTransport struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewMboxTransport(path string) (*MboxTransport, error) {
+	if path == "" {
+		return nil, errors.New("The mbox transport needs PURSUEMAIL_MAIL_PATH")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &MboxTransport{file: f}, nil
+}
+
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+func (t *MboxTransport) Send(msg *Message) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", msg.From, time.Now().UTC().Format(time.ANSIC))
+
+	scanner := bufio.NewScanner(bytes.NewReader(withEnvelope(msg)))
+	scanner.Buffer(nil, len(msg.Data)+1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if mboxFromLine.Match(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.file.Write(buf.Bytes())
+	return err
+}
+
+func (t *MboxTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// withEnvelope prepends the envelope as Return-Path and Delivered-To
+// headers, as a local delivery agent would, and converts to local line
+// endings.
+func withEnvelope(msg *Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\n", msg.From)
+	for _, rcpt := range msg.To {
+		fmt.Fprintf(&buf, "Delivered-To: %s\n", rcpt)
+	}
+	buf.Write(toLF(msg.Data))
+	return buf.Bytes()
+}
@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPTransport posts each raw MIME message to a provider's HTTP API, in
+// the form Mailgun's messages.mime endpoint takes: multipart form data
+// with "to" recipients and the message as a "message" file, using basic
+// auth with user "api" and the API key as the password.
+//
+// Sending the message as-is, rather than as separate fields, keeps
+// PGP/MIME intact.
+type HTTPTransport struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// NewHTTPTransport returns a transport that posts to url. A nil client
+// means one with a 30 second timeout.
+func NewHTTPTransport(url, apiKey string, client *http.Client) (*HTTPTransport, error) {
+	if url == "" {
+		return nil, errors.New("The http transport needs PURSUEMAIL_HTTP_API_URL")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &HTTPTransport{url: url, apiKey: apiKey, client: client}, nil
+}
+
+func (t *HTTPTransport) Send(msg *Message) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, rcpt := range msg.To {
+		if err := w.WriteField("to", rcpt); err != nil {
+			return err
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	if _, err = part.Write(msg.Data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if t.apiKey != "" {
+		req.SetBasicAuth("api", t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Email API responded %s: %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (t *HTTPTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	var got struct {
+		user, pass string
+		to         []string
+		message    string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.user, got.pass, _ = r.BasicAuth()
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got.to = r.MultipartForm.Value["to"]
+		file, _, err := r.FormFile("message")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, _ := ioutil.ReadAll(file)
+		got.message = string(data)
+
+		if got.to[0] == "rejected@example.com" {
+			http.Error(w, "Recipient is on the suppression list", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	transport, err := NewHTTPTransport(srv.URL, "key-123", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{
+		From: "sender@example.com",
+		To:   []string{"a@example.com", "b@example.com"},
+		Data: []byte("From: sender@example.com\r\n\r\nHello\r\n"),
+	}
+	if err := transport.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got.user != "api" || got.pass != "key-123" {
+		t.Errorf("Basic auth = %q, %q", got.user, got.pass)
+	}
+	if !reflect.DeepEqual(got.to, msg.To) {
+		t.Errorf("to = %v, want %v", got.to, msg.To)
+	}
+	if got.message != string(msg.Data) {
+		t.Errorf("message = %q, want %q", got.message, msg.Data)
+	}
+
+	msg.To = []string{"rejected@example.com"}
+	err = transport.Send(msg)
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "suppression list") {
+		t.Errorf("err = %v, want the status and response", err)
+	}
+
+	if _, err := NewHTTPTransport("", "key", nil); err == nil {
+		t.Error("NewHTTPTransport without a URL succeeded")
+	}
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SendmailTransport pipes each message to a local sendmail binary, which
+// takes the recipients from the message's headers.
+type SendmailTransport struct {
+	path string
+}
+
+func NewSendmailTransport(path string) *SendmailTransport {
+	return &SendmailTransport{path: path}
+}
+
+func (t *SendmailTransport) Send(msg *Message) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(t.path, "-t", "-i", "-f", msg.From)
+	cmd.Stdin = bytes.NewReader(toLF(msg.Data))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", t.path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (t *SendmailTransport) Close() error {
+	return nil
+}
+
+// toLF converts a message's CRLF line endings to the local (Unix) ones
+// sendmail and mail files expect.
+func toLF(data []byte) []byte {
+	return bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+}
@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+var (
+	ErrInvalidToken = errors.New("Invalid confirmation link")
+	ErrExpiredToken = errors.New("Confirmation link has expired")
+)
+
+// NewVerificationToken returns a token of the form "<expiry>.<signature>",
+// where the signature covers the account ID, its address and the expiry.
+// Changing the address therefore invalidates outstanding tokens.
+func NewVerificationToken(secret []byte, id, email string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + signVerification(secret, id, email, exp)
+}
+
+func CheckVerificationToken(secret []byte, token, id, email string, now time.Time) error {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return ErrInvalidToken
+	}
+	exp, sig := parts[0], parts[1]
+
+	expected := signVerification(secret, id, email, exp)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalidToken
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if now.After(time.Unix(expUnix, 0)) {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+func signVerification(secret []byte, id, email, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", strings.ToLower(id), strings.ToLower(email), exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Mailer) verificationURL(e *store.EmailAccount) string {
+	token := NewVerificationToken(m.Config.VerifySecret, e.Id, e.Email,
+		time.Now().Add(m.Config.VerifyTTL))
+	return strings.TrimRight(m.Config.PublicURL, "/") + "/api/v1/email/" +
+		url.PathEscape(e.Id) + "/verify?token=" + url.QueryEscape(token)
+}
+
+// CheckCanVerify returns why confirmation emails can't be sent, if they
+// can't, so callers can refuse to put an account in the pending state
+// before changing anything.
+func (m *Mailer) CheckCanVerify() error {
+	if m.Config.SystemFrom == "" {
+		return errors.New("Cannot send confirmation email: PURSUEMAIL_FROM is not set")
+	}
+	return nil
+}
+
+// CheckSystemKey returns an error if there's no private key for
+// SystemFrom. Confirmations and digests to accounts with a public key are
+// encrypted and signed from SystemFrom, so they can't be sent without one.
+func (m *Mailer) CheckSystemKey() error {
+	if m.Config.SystemFrom == "" {
+		return nil
+	}
+	return crypto.CheckPrivKey(m.Config.SystemFrom)
+}
+
+// SendVerificationEmail sends the account a link to confirm its address.
+func (m *Mailer) SendVerificationEmail(ctx context.Context, e *store.EmailAccount) error {
+	if err := m.CheckCanVerify(); err != nil {
+		return err
+	}
+
+	emailData := api.EmailData{
+		From:    m.Config.SystemFrom,
+		Subject: "Please confirm your email address",
+		Body: fmt.Sprintf("Someone, hopefully you, asked to receive email at this address.\n\n"+
+			"To confirm, open this link within %s:\n\n%s\n\n"+
+			"If this wasn't you, ignore this email and nothing will be sent to you.\n",
+			m.Config.VerifyTTL, m.verificationURL(e)),
+	}
+	return m.Deliver(ctx, e, emailData)
+}
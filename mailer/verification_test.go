@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerificationToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	id := "9e4ee5c0-3b1c-4d0c-9d7e-1f0a3c3d2b11"
+	email := "someone@example.com"
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(time.Hour)
+	token := NewVerificationToken(secret, id, email, expires)
+
+	parts := strings.SplitN(token, ".", 2)
+	laterExpiry := strconv.FormatInt(expires.Add(time.Hour).Unix(), 10) + "." + parts[1]
+	flipped := []byte(token)
+	if flipped[len(flipped)-2] == 'A' {
+		flipped[len(flipped)-2] = 'B'
+	} else {
+		flipped[len(flipped)-2] = 'A'
+	}
+
+	tests := []struct {
+		name   string
+		secret []byte
+		token  string
+		id     string
+		email  string
+		now    time.Time
+		want   error
+	}{
+		{"valid", secret, token, id, email, now, nil},
+		{"valid at expiry", secret, token, id, email, expires, nil},
+		{"case-insensitive", secret, token, strings.ToUpper(id), "SomeOne@Example.COM", now, nil},
+		{"expired", secret, token, id, email, expires.Add(time.Second), ErrExpiredToken},
+		{"tampered signature", secret, string(flipped), id, email, now, ErrInvalidToken},
+		{"tampered expiry", secret, laterExpiry, id, email, expires.Add(time.Second), ErrInvalidToken},
+		{"other email", secret, token, id, "someone@example.org", now, ErrInvalidToken},
+		{"other account", secret, token, "00000000-0000-0000-0000-000000000000", email, now, ErrInvalidToken},
+		{"other secret", []byte("another secret"), token, id, email, now, ErrInvalidToken},
+		{"no signature", secret, parts[0], id, email, now, ErrInvalidToken},
+		{"empty", secret, "", id, email, now, ErrInvalidToken},
+		{"garbage expiry", secret, "soon." + parts[1], id, email, now, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		if err := CheckVerificationToken(tt.secret, tt.token, tt.id, tt.email, tt.now); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
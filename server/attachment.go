@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/mailer"
+)
+
+var DefaultAttachmentTypes = []string{
+	"application/pdf",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"text/calendar",
+	"text/csv",
+	"text/plain",
+}
+
+// ValidateAttachments checks attachments against the configured total
+// size cap and MIME type allowlist.
+func ValidateAttachments(cfg *Config, attachments []api.Attachment) error {
+	var total int64
+	for _, a := range attachments {
+		if a.Filename == "" || mailer.SanitizeFilename(a.Filename) != a.Filename {
+			return fmt.Errorf("Invalid attachment filename %q", a.Filename)
+		}
+
+		mediaType, _, err := mime.ParseMediaType(a.ContentType)
+		if err != nil {
+			return fmt.Errorf("Invalid content type for attachment %q: %v", a.Filename, err)
+		}
+		if !cfg.AttachmentTypeAllowed(mediaType) {
+			return fmt.Errorf("Attachment %q has disallowed content type %s", a.Filename, mediaType)
+		}
+
+		total += int64(len(a.Data))
+	}
+	if total > cfg.MaxAttachmentBytes {
+		return fmt.Errorf("Attachments total %d bytes, more than the maximum of %d",
+			total, cfg.MaxAttachmentBytes)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type Scope int
+
+const (
+	ScopePublic Scope = iota
+	ScopeAdmin
+)
+
+// RequestScope returns ScopeAdmin if the request carries the configured
+// admin token as a bearer token, ScopePublic otherwise.
+func RequestScope(cfg *Config, r *http.Request) Scope {
+	if cfg.AdminToken == "" {
+		return ScopePublic
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ScopePublic
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		return ScopePublic
+	}
+	return ScopeAdmin
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// HTTP address to listen on
+	Addr string
+
+	// Origins browser-side callers may use the API from ("*" for any),
+	// and how long browsers may cache CORS preflight responses
+	CORSOrigins []string
+	CORSMaxAge  time.Duration
+
+	// Strict-Transport-Security max-age; 0 leaves the header out
+	HSTSMaxAge time.Duration
+
+	// Bearer token granting privileged access (full account details,
+	// lookups). Privileged endpoints are disabled when empty.
+	AdminToken string
+
+	// The only address template test-sends are delivered to
+	SandboxAddress string
+
+	// Cap on the total decoded size of a send request's attachments
+	MaxAttachmentBytes int64
+
+	// MIME types attachments may have
+	AttachmentTypes []string
+}
+
+func (cfg *Config) AttachmentTypeAllowed(mediaType string) bool {
+	for _, allowed := range cfg.AttachmentTypes {
+		if strings.EqualFold(allowed, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxSendRequestBytes is how large a send request body may be: room for
+// the largest allowed attachments once base64-encoded, plus the default
+// body limit for everything else.
+func (cfg *Config) MaxSendRequestBytes() int64 {
+	return maxReqBodyBytes + (cfg.MaxAttachmentBytes+2)/3*4
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long /readyz waits for its checks before counting them as failed
+const readinessTimeout = 5 * time.Second
+
+const (
+	checkOK      = "ok"
+	checkFailing = "failing"
+)
+
+// Pinger is implemented by transports that can check their connection
+// to the mail server without sending anything.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	// Only shown with the admin token, since errors can give away
+	// internal hosts and addresses
+	Error string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+func healthRespond(w http.ResponseWriter, resp *HealthResponse) {
+	code := http.StatusOK
+	if resp.Status != checkOK {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set(contentType, jsonContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("Error occurred when marshalling response: %s", err)
+	}
+}
+
+// HealthzHandler reports that the process is up and serving requests. It
+// deliberately checks nothing else, so an outage elsewhere doesn't get
+// the process restarted.
+func HealthzHandler() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		healthRespond(w, &HealthResponse{Status: checkOK})
+	}
+}
+
+// ReadyzHandler reports whether this instance can do its job: reach
+// Postgres (if that's the store), reach the SMTP server (if the transport
+// can be probed), and load the keyrings. It responds 503 if any check
+// fails or takes longer than readinessTimeout. Why a check failed is
+// logged, and only included in the response with the admin token.
+func ReadyzHandler(cfg *Config, st store.Store, transport mailer.Transport) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]func(ctx context.Context) error{
+			"keyrings": func(context.Context) error { return crypto.CheckKeyrings() },
+		}
+		if pg, ok := st.(*store.Postgres); ok {
+			checks["postgres"] = pg.Ping
+		}
+		if pinger, ok := transportPinger(transport); ok {
+			checks["smtp"] = pinger.Ping
+		}
+		resp := runChecks(r.Context(), checks)
+		if RequestScope(cfg, r) != ScopeAdmin {
+			for _, check := range resp.Checks {
+				check.Error = ""
+			}
+		}
+		healthRespond(w, resp)
+	}
+}
+
+func transportPinger(transport mailer.Transport) (Pinger, bool) {
+	if t, ok := transport.(*mailer.DKIMTransport); ok {
+		transport = t.Transport
+	}
+	pinger, ok := transport.(Pinger)
+	return pinger, ok
+}
+
+func runChecks(ctx context.Context, checks map[string]func(ctx context.Context) error) *HealthResponse {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	start := time.Now()
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func(name string, check func(ctx context.Context) error) {
+			results <- result{name, check(ctx)}
+		}(name, check)
+	}
+
+	resp := &HealthResponse{Status: checkOK, Checks: map[string]*CheckResult{}}
+	for len(resp.Checks) < len(checks) {
+		select {
+		case res := <-results:
+			check := &CheckResult{
+				Status:    checkOK,
+				LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if res.err != nil {
+				check.Status = checkFailing
+				check.Error = res.err.Error()
+				resp.Status = checkFailing
+				log.Warnf("Readiness check %s failing: %v", res.name, res.err)
+			}
+			resp.Checks[res.name] = check
+		case <-ctx.Done():
+			// Checks that haven't finished are failing
+			for name := range checks {
+				if resp.Checks[name] == nil {
+					resp.Checks[name] = &CheckResult{
+						Status:    checkFailing,
+						LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+						Error:     ctx.Err().Error(),
+					}
+					log.Warnf("Readiness check %s failing: %v", name, ctx.Err())
+				}
+			}
+			resp.Status = checkFailing
+		}
+	}
+	return resp
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/PursuanceProject/pursuemail/mailer"
+)
+
+// pingTransport is a fakeTransport whose Ping fails with err.
+type pingTransport struct {
+	fakeTransport
+	err error
+}
+
+func (t *pingTransport) Ping(ctx context.Context) error {
+	return t.err
+}
+
+func TestReadyzHidesErrors(t *testing.T) {
+	ts := newTestServer(t, false)
+	transport := &pingTransport{err: errors.New("dial tcp 10.0.0.5:587: connect: connection refused")}
+	ts.router = NewRouter(&Config{AdminToken: testAdminToken}, ts.store, mailer.New(ts.store, transport, mailer.Config{}))
+
+	for _, admin := range []bool{false, true} {
+		rec := ts.do("GET", "/readyz", nil, admin, nil)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("admin = %v: /readyz = %d, want %d", admin, rec.Code, http.StatusServiceUnavailable)
+		}
+		var resp HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		smtp := resp.Checks["smtp"]
+		if smtp == nil || smtp.Status != checkFailing || resp.Checks["keyrings"].Status != checkOK {
+			t.Fatalf("admin = %v: unexpected checks %s", admin, rec.Body.String())
+		}
+		if admin && smtp.Error != transport.err.Error() {
+			t.Errorf("Admin got error %q, want %q", smtp.Error, transport.err)
+		}
+		if !admin && smtp.Error != "" {
+			t.Errorf("Public response includes error %q", smtp.Error)
+		}
+	}
+
+	transport.err = nil
+	if rec := ts.do("GET", "/readyz", nil, false, nil); rec.Code != http.StatusOK {
+		t.Errorf("/readyz = %d with all checks passing", rec.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/store"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+
+	// How often keys more than 24 hours old are cleared out
+	IdempotencyExpiryInterval = time.Hour
+)
+
+// responseRecorder buffers a handler's response so it can be both
+// written to the client and stored for replay.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	return rec.body.Write(p)
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+}
+
+// ExpireIdempotencyKeys clears out keys more than 24 hours old every
+// interval until stop is closed.
+func ExpireIdempotencyKeys(st store.Store, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := st.ExpireIdempotencyKeys(); err != nil {
+			log.Errorf("Error expiring idempotency keys. Err: %s", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Idempotent wraps handler so that a request carrying an Idempotency-Key
+// header is only processed once per route; retries with the same key
+// and body get the stored response replayed. Keys expire after 24 hours
+// (see ExpireIdempotencyKeys).
+func Idempotent(st store.Store, route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			ErrorRespond(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := readReqBody(r)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+
+		stored, err := claimIdempotencyKey(st, key, route, hash[:])
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			replayIdempotentResponse(w, stored, hash[:])
+			return
+		}
+
+		rec := newResponseRecorder()
+		handler(rec, r)
+
+		if rec.status >= 500 {
+			// Let the client retry server-side failures
+			st.ForgetIdempotencyKey(key, route)
+		} else {
+			err = st.SaveIdempotentResponse(key, route, rec.status, rec.header.Get(contentType), rec.body.Bytes())
+			if err != nil {
+				// A retry couldn't be replayed this response, so don't
+				// report success
+				ErrorRespond(w, "Couldn't save the response for this Idempotency-Key: "+err.Error(),
+					http.StatusInternalServerError)
+				return
+			}
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// claimIdempotencyKey claims key for a request, or returns what's stored
+// for it if it was already claimed. A key that expires between the two
+// is claimed afresh.
+func claimIdempotencyKey(st store.Store, key, route string, hash []byte) (*store.IdempotentResponse, error) {
+	for tries := 0; ; tries++ {
+		claimed, err := st.ClaimIdempotencyKey(key, route, hash)
+		if err != nil || claimed {
+			return nil, err
+		}
+		stored, err := st.GetIdempotentResponse(key, route)
+		if err == sql.ErrNoRows && tries < 2 {
+			continue
+		}
+		return stored, err
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, stored *store.IdempotentResponse, hash []byte) {
+	if !bytes.Equal(stored.RequestHash, hash) {
+		ErrorRespond(w, "Idempotency-Key was already used with a different request body",
+			http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.Status == 0 {
+		ErrorRespond(w, "A request with this Idempotency-Key is still in progress",
+			http.StatusConflict)
+		return
+	}
+
+	if stored.ContentType != "" {
+		w.Header().Set(contentType, stored.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+// failingSaveStore can't save responses.
+type failingSaveStore struct {
+	*store.Memory
+}
+
+func (st failingSaveStore) SaveIdempotentResponse(key, route string, status int, contentType string, body []byte) error {
+	return errors.New("Database is read-only")
+}
+
+// expiringStore forgets a key just as it's looked up, as if it expired
+// between being claimed and replayed.
+type expiringStore struct {
+	*store.Memory
+}
+
+func (st expiringStore) GetIdempotentResponse(key, route string) (*store.IdempotentResponse, error) {
+	st.Memory.ForgetIdempotencyKey(key, route)
+	return st.Memory.GetIdempotentResponse(key, route)
+}
+
+func TestIdempotent(t *testing.T) {
+	st := store.NewMemory()
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := readReqBody(r)
+		if string(body) == "fail" {
+			ErrorRespond(w, "Failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(contentType, jsonContentType)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"call":` + strconv.Itoa(calls) + `}`))
+	}
+	idempotent := Idempotent(st, "POST /test", handler)
+	other := Idempotent(st, "POST /other", handler)
+
+	hash := sha256.Sum256([]byte("in progress"))
+	if _, err := st.ClaimIdempotencyKey("busy", "POST /test", hash[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		key      string
+		body     string
+		code     int
+		respBody string
+		replayed bool
+		calls    int
+	}{
+		{"no key", idempotent, "", "a", http.StatusCreated, `{"call":1}`, false, 1},
+		{"no key again", idempotent, "", "a", http.StatusCreated, `{"call":2}`, false, 2},
+		{"first", idempotent, "k1", "a", http.StatusCreated, `{"call":3}`, false, 3},
+		{"replay", idempotent, "k1", "a", http.StatusCreated, `{"call":3}`, true, 3},
+		{"different body", idempotent, "k1", "b", http.StatusUnprocessableEntity, "", false, 3},
+		{"other route", other, "k1", "b", http.StatusCreated, `{"call":4}`, false, 4},
+		{"in progress", idempotent, "busy", "in progress", http.StatusConflict, "", false, 4},
+		{"server error", idempotent, "k2", "fail", http.StatusInternalServerError, "", false, 5},
+		// 5xx responses aren't kept, so the retry runs again
+		{"retry after server error", idempotent, "k2", "fail", http.StatusInternalServerError, "", false, 6},
+		{"key too long", idempotent, strings.Repeat("k", maxIdempotencyKeyLen+1), "a", http.StatusBadRequest, "", false, 6},
+		{"save fails", Idempotent(failingSaveStore{st}, "POST /test", handler), "k3", "a", http.StatusInternalServerError, "", false, 7},
+		// k1 is handled again as a new request rather than failing
+		{"expired before replay", Idempotent(expiringStore{st}, "POST /test", handler), "k1", "a", http.StatusCreated, `{"call":8}`, false, 8},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(tt.body))
+		if tt.key != "" {
+			req.Header.Set(idempotencyKeyHeader, tt.key)
+		}
+		rec := httptest.NewRecorder()
+		tt.handler(rec, req)
+
+		if rec.Code != tt.code || calls != tt.calls {
+			t.Errorf("%s: %d %s after %d calls, want %d after %d", tt.name, rec.Code, rec.Body.String(), calls, tt.code, tt.calls)
+		}
+		if tt.respBody != "" && rec.Body.String() != tt.respBody {
+			t.Errorf("%s: body %s, want %s", tt.name, rec.Body.String(), tt.respBody)
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if tt.code < 300 && rec.Header().Get(contentType) != jsonContentType {
+			t.Errorf("%s: Content-Type %q", tt.name, rec.Header().Get(contentType))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/store"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+func jobRespond(w http.ResponseWriter, job *api.EmailJob, code int) {
+	w.Header().Set(contentType, jsonContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Errorf("Error occurred when marshalling response: %s", err)
+	}
+}
+
+func GetEmailJobHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := st.GetEmailJob(mux.Vars(r)["id"])
+		switch err {
+		case nil:
+			jobRespond(w, job, http.StatusOK)
+		case store.ErrJobNotFound:
+			ErrorRespond(w, err.Error(), http.StatusNotFound)
+		default:
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func CancelEmailJobHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := st.CancelEmailJob(mux.Vars(r)["id"])
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case store.ErrJobNotFound:
+			ErrorRespond(w, err.Error(), http.StatusNotFound)
+		case store.ErrJobNotScheduled:
+			ErrorRespond(w, err.Error(), http.StatusConflict)
+		default:
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
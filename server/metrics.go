@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+)
+
+// RegisterQueueMetrics adds gauges for the scheduled jobs and digest
+// items waiting in st.
+func RegisterQueueMetrics(st store.Store) {
+	telemetry.NewGaugeFunc("pursuemail_queue_depth",
+		"Emails waiting to be sent: scheduled jobs and undelivered digest items.",
+		func() []telemetry.GaugeSample {
+			jobs, digestItems, err := st.QueueDepth()
+			if err != nil {
+				return nil
+			}
+			return []telemetry.GaugeSample{
+				{LabelValues: []string{"scheduled_jobs"}, Value: float64(jobs)},
+				{LabelValues: []string{"digest_items"}, Value: float64(digestItems)},
+			}
+		}, "queue")
+}
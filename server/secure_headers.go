@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/telemetry"
+)
+
+// Nothing PursueMail serves loads scripts, styles, images or frames;
+// the confirmation page is plain HTML
+const contentSecurityPolicy = "default-src 'none'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE"
+	corsAllowHeaders  = "Authorization, Content-Type, " + idempotencyKeyHeader + ", " + telemetry.RequestIdHeader + ", " + telemetry.TraceparentHeader
+	corsExposeHeaders = telemetry.RequestIdHeader + ", Idempotent-Replayed"
+)
+
+// SecureHeaders sets security headers on every response and answers
+// CORS requests from the allowed origins ("*" allows any).
+//
+// Responses are never cached, since they carry account details, and
+// confirmation pages aren't allowed to leak their token through the
+// Referer header. HSTS is only sent when hstsMaxAge is positive.
+func SecureHeaders(allowedOrigins []string, corsMaxAge, hstsMaxAge time.Duration, next http.Handler) http.Handler {
+	allowAny := false
+	allowed := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAny = true
+		}
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		if hstsMaxAge > 0 {
+			h.Set("Strict-Transport-Security",
+				"max-age="+strconv.Itoa(int(hstsMaxAge/time.Second))+"; includeSubDomains")
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowAny && !allowed[origin] {
+			if preflight {
+				ErrorRespond(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowAny {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,548 @@
+// Package server is PursueMail's HTTP API.
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/PursuanceProject/pursuemail/telemetry"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType     = "Content-Type"
+	jsonContentType = "application/json; charset=UTF-8"
+)
+
+func NewServer(cfg *Config, st store.Store, m *mailer.Mailer) *http.Server {
+	r := NewRouter(cfg, st, m)
+	http.Handle("/", r)
+
+	// Wrapping the whole router covers 404s and CORS preflights, which
+	// don't reach any route
+	handler := SecureHeaders(cfg.CORSOrigins, cfg.CORSMaxAge, cfg.HSTSMaxAge, r)
+
+	return &http.Server{
+		Addr:    cfg.Addr,
+		Handler: telemetry.TraceRequests(r, telemetry.LogRequests(r, handler)),
+	}
+}
+
+// NewRouter returns the API's routes.
+func NewRouter(cfg *Config, st store.Store, m *mailer.Mailer) *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/api/v1/email", Idempotent(st, "POST /api/v1/email",
+		CreateEmailAccountHandler(st, m))).Methods("POST")
+	r.HandleFunc("/api/v1/email/lookup", LookupEmailAccountHandler(cfg, st)).Methods("POST")
+	r.HandleFunc("/api/v1/email/{id}", GetEmailAccountHandler(cfg, st)).Methods("GET")
+	r.HandleFunc("/api/v1/email/{id}", UpdateEmailAccountHandler(cfg, st, m)).Methods("PUT")
+	r.HandleFunc("/api/v1/email/{id}", DeleteEmailAccountHandler(cfg, st)).Methods("DELETE")
+	r.HandleFunc("/api/v1/email/{id}/verify", ConfirmEmailAccountPageHandler(st, m)).Methods("GET")
+	r.HandleFunc("/api/v1/email/{id}/verify", VerifyEmailAccountHandler(st, m)).Methods("POST")
+	r.HandleFunc("/api/v1/email/{id}/send", SendEmailHandler(cfg, st, m)).Methods("POST")
+	r.HandleFunc("/api/v1/email/bulksend", SendBulkEmailHandler(cfg, st, m)).Methods("POST")
+
+	r.HandleFunc("/api/v1/jobs/{id}", GetEmailJobHandler(st)).Methods("GET")
+	r.HandleFunc("/api/v1/jobs/{id}", CancelEmailJobHandler(st)).Methods("DELETE")
+
+	r.HandleFunc("/api/v1/templates", GetEmailTemplatesHandler(st)).Methods("GET")
+	r.HandleFunc("/api/v1/templates/{name}", GetEmailTemplateHandler(st)).Methods("GET")
+	r.HandleFunc("/api/v1/templates/{name}", PutEmailTemplateHandler(cfg, st)).Methods("PUT")
+	r.HandleFunc("/api/v1/templates/{name}", DeleteEmailTemplateHandler(cfg, st)).Methods("DELETE")
+	r.HandleFunc("/api/v1/templates/{name}/versions", GetEmailTemplateVersionsHandler(st)).Methods("GET")
+	r.HandleFunc("/api/v1/templates/{name}/versions/{version}", GetEmailTemplateVersionHandler(st)).Methods("GET")
+	r.HandleFunc("/api/v1/templates/{name}/preview", PreviewEmailTemplateHandler(cfg, st)).Methods("POST")
+	r.HandleFunc("/api/v1/templates/{name}/test", TestSendEmailTemplateHandler(cfg, st, m)).Methods("POST")
+
+	r.HandleFunc("/metrics", telemetry.MetricsHandler()).Methods("GET")
+	r.HandleFunc("/healthz", HealthzHandler()).Methods("GET")
+	r.HandleFunc("/readyz", ReadyzHandler(cfg, st, m.Transport)).Methods("GET")
+	return r
+}
+
+const maxReqBodyBytes = 1048576
+
+func readReqBody(r *http.Request) ([]byte, error) {
+	return readReqBodyLimit(r, maxReqBodyBytes)
+}
+
+func readReqBodyLimit(r *http.Request, limit int64) ([]byte, error) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit))
+	if err != nil {
+		log.Errorf("Error occurred when reading r.Body: %s", err)
+		return nil, err
+	}
+	return body, nil
+}
+
+// Custom version of http.Error to support json error messages
+func ErrorRespond(w http.ResponseWriter, errMsg string, code int) {
+	resp := &api.ErrorResponse{Error: errMsg}
+
+	w.Header().Set(contentType, jsonContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("Error occurred when marshalling response: %s", err)
+	}
+}
+
+// Respond with the status code matching an error returned by
+// GetEmailAccount
+func accountErrorRespond(w http.ResponseWriter, err error) {
+	switch err {
+	case store.ErrEmailAccountNotFound:
+		ErrorRespond(w, err.Error(), http.StatusNotFound)
+	case store.ErrEmailAccountDeleted:
+		ErrorRespond(w, err.Error(), http.StatusGone)
+	default:
+		ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func CreateEmailAccountHandler(st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		createReq := &api.CreateEmailAccountRequest{}
+		body, err := readReqBody(r)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, createReq); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = createReq.Validate(); err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		newAccount := &store.EmailAccount{
+			Email:      createReq.Email,
+			PubKey:     createReq.PubKey,
+			Status:     store.StatusActive,
+			Timezone:   createReq.Timezone,
+			QuietHours: createReq.QuietHours,
+			DigestMode: createReq.DigestMode,
+		}
+		if createReq.Verify || m.Config.RequireVerification {
+			newAccount.Status = store.StatusPending
+		}
+
+		if newAccount.Status == store.StatusPending {
+			if err = m.CheckCanVerify(); err != nil {
+				ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if createReq.PubKey != "" {
+			if err = crypto.CheckPubKeyFor(strings.TrimSpace(createReq.Email), createReq.PubKey); err != nil {
+				ErrorRespond(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		created, err := st.SaveEmailAccount(newAccount)
+		if err == store.ErrPubKeyConflict {
+			ErrorRespond(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Also re-send the link when someone re-registers an address
+		// that never got confirmed
+		if newAccount.Status == store.StatusPending {
+			err = m.SendVerificationEmail(r.Context(), newAccount)
+			if err != nil {
+				log.Errorf("Error sending confirmation email: %v", err)
+				ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp := &api.CreateEmailAccountResponse{
+			Id:     newAccount.Id,
+			Status: newAccount.Status,
+		}
+
+		status := http.StatusCreated
+		if !created {
+			status = http.StatusOK
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// LookupEmailAccountHandler maps an address back to its account ID. The
+// address is taken from the request body rather than the URL so it
+// doesn't end up in access logs.
+func LookupEmailAccountHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+
+		lookupReq := &api.LookupEmailAccountRequest{}
+		body, err := readReqBody(r)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, lookupReq); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		emailAccount, err := st.GetEmailAccountByEmail(lookupReq.Email)
+		if err != nil {
+			accountErrorRespond(w, err)
+			return
+		}
+
+		resp := &api.LookupEmailAccountResponse{Id: emailAccount.Id}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// GetEmailAccountHandler returns the account with its address redacted,
+// or in full (including the armored public key) for admin callers.
+func GetEmailAccountHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		emailAccount, err := st.GetEmailAccount(id)
+		if err != nil {
+			accountErrorRespond(w, err)
+			return
+		}
+
+		resp := &api.GetEmailAccountResponse{
+			Id:        emailAccount.Id,
+			Email:     telemetry.RedactEmail(emailAccount.Email),
+			HasPubKey: emailAccount.HasPubKey(),
+			Created:   emailAccount.Created,
+
+			Timezone:   emailAccount.Timezone,
+			QuietHours: emailAccount.QuietHours,
+			DigestMode: emailAccount.DigestMode,
+		}
+		if RequestScope(cfg, r) == ScopeAdmin {
+			resp.Email = emailAccount.Email
+			if resp.HasPubKey {
+				resp.PubKey, err = emailAccount.ArmoredPubKey()
+				if err != nil {
+					log.Errorf("Error exporting public key: %v", err)
+					ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// UpdateEmailAccountHandler changes an account's address, key, delivery
+// window and/or digest mode. A changed address must be confirmed again
+// before it can be sent to. Requires the admin token.
+func UpdateEmailAccountHandler(cfg *Config, st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		updateReq := &api.UpdateEmailAccountRequest{}
+		body, err := readReqBody(r)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, updateReq); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = updateReq.Validate(); err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		emailAccount, err := st.GetEmailAccount(id)
+		if err != nil {
+			accountErrorRespond(w, err)
+			return
+		}
+
+		newEmail := strings.TrimSpace(updateReq.Email)
+		if newEmail == "" {
+			newEmail = emailAccount.Email
+		}
+		update := &store.AccountUpdate{
+			Email:      newEmail,
+			PubKey:     updateReq.PubKey,
+			DigestMode: updateReq.DigestMode,
+		}
+
+		// A new address always needs confirming. Check that a
+		// confirmation can be sent before changing anything.
+		update.Verify = !strings.EqualFold(newEmail, emailAccount.Email)
+		if update.Verify {
+			if err = m.CheckCanVerify(); err != nil {
+				ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if updateReq.PubKey != "" {
+			if err = crypto.CheckPubKeyFor(newEmail, updateReq.PubKey); err != nil {
+				ErrorRespond(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if updateReq.Timezone != nil || updateReq.QuietHours != nil {
+			update.SetDeliveryWindow = true
+			update.Timezone, update.QuietHours = emailAccount.Timezone, emailAccount.QuietHours
+			if updateReq.Timezone != nil {
+				update.Timezone = *updateReq.Timezone
+			}
+			if updateReq.QuietHours != nil {
+				update.QuietHours = updateReq.QuietHours
+				if *update.QuietHours == (api.QuietHours{}) {
+					update.QuietHours = nil
+				}
+			}
+		}
+
+		err = st.UpdateEmailAccount(emailAccount, update)
+		if err == store.ErrEmailAccountExists {
+			ErrorRespond(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			// Including the account being deleted in the meantime
+			accountErrorRespond(w, err)
+			return
+		}
+
+		if update.Verify {
+			err = m.SendVerificationEmail(r.Context(), emailAccount)
+			if err != nil {
+				log.Errorf("Error sending confirmation email: %v", err)
+				ErrorRespond(w, "Address changed, but the confirmation email couldn't be sent "+
+					"(re-create the account to resend it): "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteEmailAccountHandler erases an account and its key. Requires the
+// admin token.
+func DeleteEmailAccountHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		emailAccount, err := st.GetEmailAccount(id)
+		if err != nil {
+			accountErrorRespond(w, err)
+			return
+		}
+
+		err = st.DeleteEmailAccount(emailAccount)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Respond with the status code carried by a *mailer.SendError, or 500
+func sendErrorRespond(w http.ResponseWriter, err error) {
+	if sendErr, ok := err.(*mailer.SendError); ok {
+		ErrorRespond(w, err.Error(), sendErr.Code)
+		return
+	}
+	ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+}
+
+func SendEmailHandler(cfg *Config, st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		sendEmailReq := &api.SendEmailRequest{}
+		body, err := readReqBodyLimit(r, cfg.MaxSendRequestBytes())
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, sendEmailReq); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = sendEmailReq.Validate(); err != nil {
+			log.Errorf("Invalid SendEmailRequest: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = ValidateAttachments(cfg, sendEmailReq.EmailData.Attachments); err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		emailAccount, err := m.GetEmailAccount(r.Context(), id)
+		if err != nil {
+			accountErrorRespond(w, err)
+			return
+		}
+
+		if sendAt, ok := sendEmailReq.Schedule.When(time.Now()); ok {
+			sendEmailReq.Schedule = api.Schedule{}
+			if err = m.PinTemplateVersion(r.Context(), &sendEmailReq.EmailData); err != nil {
+				sendErrorRespond(w, err)
+				return
+			}
+			job, err := st.ScheduleEmailJob(api.JobKindSend, emailAccount.Id, sendEmailReq, sendAt)
+			if err != nil {
+				ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			jobRespond(w, job, http.StatusAccepted)
+			return
+		}
+
+		digested, err := m.Send(r.Context(), emailAccount, sendEmailReq)
+		if err != nil {
+			log.Errorf("Error sending email: %v", err)
+			sendErrorRespond(w, err)
+			return
+		}
+
+		if digested {
+			w.Header().Set(contentType, jsonContentType)
+			w.WriteHeader(http.StatusAccepted)
+			resp := &api.SendEmailResponse{DigestMode: emailAccount.DigestMode}
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Errorf("Error occurred when marshalling response: %s", err)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func SendBulkEmailHandler(cfg *Config, st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendBulkEmailReq := &api.SendBulkEmailRequest{}
+		body, err := readReqBodyLimit(r, cfg.MaxSendRequestBytes())
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, sendBulkEmailReq); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = sendBulkEmailReq.Validate()
+		if err == nil {
+			err = ValidateAttachments(cfg, sendBulkEmailReq.EmailData.Attachments)
+		}
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if sendAt, ok := sendBulkEmailReq.Schedule.When(time.Now()); ok {
+			sendBulkEmailReq.Schedule = api.Schedule{}
+			if err = m.PinTemplateVersion(r.Context(), &sendBulkEmailReq.EmailData); err != nil {
+				sendErrorRespond(w, err)
+				return
+			}
+			job, err := st.ScheduleEmailJob(api.JobKindBulkSend, "", sendBulkEmailReq, sendAt)
+			if err != nil {
+				ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			jobRespond(w, job, http.StatusAccepted)
+			return
+		}
+
+		resp, err := m.BulkSend(r.Context(), sendBulkEmailReq)
+		if err != nil {
+			sendErrorRespond(w, err)
+			return
+		}
+
+		if len(resp.FailedIds) == 0 && len(resp.Scheduled) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			status := http.StatusCreated
+			if len(resp.FailedIds) == 0 {
+				status = http.StatusAccepted
+			}
+			w.Header().Set(contentType, jsonContentType)
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Errorf("Error occurred when marshalling response: %s", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+	"github.com/gorilla/mux"
+)
+
+const testAdminToken = "admin-token"
+
+var testVerifySecret = []byte("0123456789abcdef0123456789abcdef")
+
+// fakeTransport keeps the messages it's asked to send.
+type fakeTransport struct {
+	mu   sync.Mutex
+	sent []*mailer.Message
+}
+
+func (t *fakeTransport) Send(msg *mailer.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+func (t *fakeTransport) Sent() []*mailer.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*mailer.Message(nil), t.sent...)
+}
+
+type testServer struct {
+	t         *testing.T
+	router    *mux.Router
+	store     *store.Memory
+	transport *fakeTransport
+}
+
+// newTestServer serves the API from a store.Memory, with keyrings in a
+// temporary directory.
+func newTestServer(t *testing.T, requireVerification bool) *testServer {
+	dir := t.TempDir()
+	pubring, secring := crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME
+	crypto.PUBLIC_KEYRING_FILENAME = filepath.Join(dir, "pubring.gpg")
+	crypto.PRIVATE_KEYRING_FILENAME = filepath.Join(dir, "secring.gpg")
+	t.Cleanup(func() {
+		crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME = pubring, secring
+	})
+
+	st := store.NewMemory()
+	transport := &fakeTransport{}
+	m := mailer.New(st, transport, mailer.Config{
+		SystemFrom:          "pursuemail@example.org",
+		RequireVerification: requireVerification,
+		PublicURL:           "https://pursuemail.example.org/",
+		VerifySecret:        testVerifySecret,
+		VerifyTTL:           time.Hour,
+	})
+	cfg := &Config{AdminToken: testAdminToken}
+	return &testServer{t, NewRouter(cfg, st, m), st, transport}
+}
+
+// do sends a request, as admin if admin is set, and decodes a JSON
+// response into resp if it isn't nil.
+func (ts *testServer) do(method, path string, body interface{}, admin bool, resp interface{}) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	rec := httptest.NewRecorder()
+	ts.router.ServeHTTP(rec, req)
+	if resp != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			ts.t.Fatalf("%s %s: bad response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func (ts *testServer) create(email string) string {
+	ts.t.Helper()
+	var resp api.CreateEmailAccountResponse
+	rec := ts.do("POST", "/api/v1/email", api.CreateEmailAccountRequest{Email: email}, false, &resp)
+	if rec.Code != http.StatusCreated {
+		ts.t.Fatalf("Creating %s: %d %s", email, rec.Code, rec.Body.String())
+	}
+	return resp.Id
+}
+
+func TestAccountHandlers(t *testing.T) {
+	ts := newTestServer(t, false)
+
+	var created api.CreateEmailAccountResponse
+	rec := ts.do("POST", "/api/v1/email", api.CreateEmailAccountRequest{
+		Email: "someone@example.com", Timezone: "Europe/Berlin"}, false, &created)
+	if rec.Code != http.StatusCreated || created.Id == "" || created.Status != store.StatusActive {
+		t.Fatalf("Create: %d %s", rec.Code, rec.Body.String())
+	}
+	id := created.Id
+
+	var again api.CreateEmailAccountResponse
+	rec = ts.do("POST", "/api/v1/email", api.CreateEmailAccountRequest{Email: "SomeOne@example.com"}, false, &again)
+	if rec.Code != http.StatusOK || again.Id != id {
+		t.Errorf("Re-create: %d %s, want 200 with id %s", rec.Code, rec.Body.String(), id)
+	}
+	rec = ts.do("POST", "/api/v1/email", api.CreateEmailAccountRequest{Email: "x@example.com", Timezone: "Nowhere/Special"}, false, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Create with a bad timezone: %d", rec.Code)
+	}
+
+	getTests := []struct {
+		name  string
+		admin bool
+		email string
+	}{
+		{"public", false, "s***@example.com"},
+		{"admin", true, "someone@example.com"},
+	}
+	for _, tt := range getTests {
+		var got api.GetEmailAccountResponse
+		rec = ts.do("GET", "/api/v1/email/"+id, nil, tt.admin, &got)
+		if rec.Code != http.StatusOK || got.Id != id || got.Email != tt.email ||
+			got.Timezone != "Europe/Berlin" || got.DigestMode != api.DigestImmediate || got.HasPubKey {
+			t.Errorf("GET %s: %d %s", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+	req := httptest.NewRequest("GET", "/api/v1/email/"+id, nil)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	wrong := httptest.NewRecorder()
+	ts.router.ServeHTTP(wrong, req)
+	if strings.Contains(wrong.Body.String(), "someone@example.com") {
+		t.Error("GET with the wrong token isn't redacted")
+	}
+
+	lookupTests := []struct {
+		name  string
+		email string
+		admin bool
+		code  int
+	}{
+		{"not admin", "someone@example.com", false, http.StatusUnauthorized},
+		{"admin", "someone@example.com", true, http.StatusOK},
+		{"admin, other case", "SOMEONE@example.com", true, http.StatusOK},
+		{"unknown", "nobody@example.com", true, http.StatusNotFound},
+	}
+	for _, tt := range lookupTests {
+		var got api.LookupEmailAccountResponse
+		rec = ts.do("POST", "/api/v1/email/lookup", api.LookupEmailAccountRequest{Email: tt.email}, tt.admin, &got)
+		if rec.Code != tt.code || (tt.code == http.StatusOK && got.Id != id) {
+			t.Errorf("Lookup %s: %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.code)
+		}
+	}
+
+	otherId := ts.create("other@example.com")
+	berlin, empty := "Europe/Berlin", ""
+	putTests := []struct {
+		name  string
+		id    string
+		req   api.UpdateEmailAccountRequest
+		admin bool
+		code  int
+	}{
+		{"not admin", otherId, api.UpdateEmailAccountRequest{Email: "attacker@example.net"}, false, http.StatusUnauthorized},
+		{"delivery window", id, api.UpdateEmailAccountRequest{
+			QuietHours: &api.QuietHours{Start: "22:00", End: "07:00"}, DigestMode: api.DigestDaily}, true, http.StatusNoContent},
+		{"nothing", id, api.UpdateEmailAccountRequest{}, true, http.StatusBadRequest},
+		{"bad quiet hours", id, api.UpdateEmailAccountRequest{QuietHours: &api.QuietHours{Start: "22:00", End: "22:00"}}, true, http.StatusBadRequest},
+		{"bad digest mode", id, api.UpdateEmailAccountRequest{DigestMode: "weekly"}, true, http.StatusBadRequest},
+		{"taken address", id, api.UpdateEmailAccountRequest{Email: "Other@example.com"}, true, http.StatusConflict},
+		{"unknown account", "00000000-0000-0000-0000-000000000000", api.UpdateEmailAccountRequest{Timezone: &berlin}, true, http.StatusNotFound},
+		{"new address", otherId, api.UpdateEmailAccountRequest{Email: "renamed@example.com", Timezone: &empty}, true, http.StatusNoContent},
+	}
+	for _, tt := range putTests {
+		rec = ts.do("PUT", "/api/v1/email/"+tt.id, tt.req, tt.admin, nil)
+		if rec.Code != tt.code {
+			t.Errorf("PUT %s: %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.code)
+		}
+	}
+
+	var got api.GetEmailAccountResponse
+	ts.do("GET", "/api/v1/email/"+id, nil, true, &got)
+	if got.Email != "someone@example.com" || got.Timezone != "Europe/Berlin" || got.DigestMode != api.DigestDaily ||
+		got.QuietHours == nil || *got.QuietHours != (api.QuietHours{Start: "22:00", End: "07:00"}) {
+		t.Errorf("After PUT: %+v", got)
+	}
+	got = api.GetEmailAccountResponse{}
+	ts.do("GET", "/api/v1/email/"+otherId, nil, true, &got)
+	if got.Email != "renamed@example.com" || got.Timezone != "" {
+		t.Errorf("After changing the address: %+v", got)
+	}
+	// Even without required verification, a new address is confirmed
+	// before it's sent to
+	if sent := ts.transport.Sent(); len(sent) != 1 || sent[0].To[0] != "renamed@example.com" {
+		t.Errorf("Sent %+v, want a confirmation to the new address", sent)
+	}
+	if account, err := ts.store.GetEmailAccount(otherId); err != nil || account.Status != store.StatusPending {
+		t.Errorf("After changing the address: %+v, %v, want pending", account, err)
+	}
+
+	if rec = ts.do("DELETE", "/api/v1/email/"+id, nil, false, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("DELETE without the admin token: %d, want 401", rec.Code)
+	}
+	rec = ts.do("DELETE", "/api/v1/email/"+id, nil, true, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if rec = ts.do(method, "/api/v1/email/"+id, nil, true, nil); rec.Code != http.StatusGone {
+			t.Errorf("%s after DELETE: %d, want 410", method, rec.Code)
+		}
+	}
+	if rec = ts.do("PUT", "/api/v1/email/"+id, api.UpdateEmailAccountRequest{Timezone: &berlin}, true, nil); rec.Code != http.StatusGone {
+		t.Errorf("PUT after DELETE: %d, want 410", rec.Code)
+	}
+	rec = ts.do("POST", "/api/v1/email/lookup", api.LookupEmailAccountRequest{Email: "someone@example.com"}, true, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Lookup after DELETE: %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+func templateErrorRespond(w http.ResponseWriter, err error) {
+	if err == store.ErrTemplateNotFound || err == store.ErrTemplateVersionNotFound {
+		ErrorRespond(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+}
+
+type GetEmailTemplatesResponse struct {
+	Templates []*store.EmailTemplate `json:"templates"`
+}
+
+func GetEmailTemplatesHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		templates, err := st.GetEmailTemplates()
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &GetEmailTemplatesResponse{Templates: templates}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+func GetEmailTemplateHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		tmpl, err := st.GetEmailTemplate(name)
+		if err != nil {
+			templateErrorRespond(w, err)
+			return
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// PutEmailTemplateHandler creates or replaces the named template. It is
+// rejected if any part fails to parse. Requires the admin token.
+func PutEmailTemplateHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		tmpl := &store.EmailTemplate{}
+		body, err := readReqBody(r)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := json.Unmarshal(body, tmpl); err != nil {
+			log.Errorf("Error occurred when unmarshalling data: %s", err)
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl.Name = mux.Vars(r)["name"]
+
+		if err = tmpl.Validate(); err == nil {
+			_, err = mailer.Compile(tmpl)
+		}
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := st.SaveEmailTemplate(tmpl)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// DeleteEmailTemplateHandler removes the named template, keeping its
+// versions. Requires the admin token.
+func DeleteEmailTemplateHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		name := mux.Vars(r)["name"]
+
+		if err := st.DeleteEmailTemplate(name); err != nil {
+			templateErrorRespond(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type GetEmailTemplateVersionsResponse struct {
+	Versions []*store.EmailTemplate `json:"versions"`
+}
+
+func GetEmailTemplateVersionsHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		versions, err := st.GetEmailTemplateVersions(name)
+		if err != nil {
+			templateErrorRespond(w, err)
+			return
+		}
+
+		resp := &GetEmailTemplateVersionsResponse{Versions: versions}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+func GetEmailTemplateVersionHandler(st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		version, err := strconv.Atoi(mux.Vars(r)["version"])
+		if err != nil {
+			templateErrorRespond(w, store.ErrTemplateVersionNotFound)
+			return
+		}
+
+		tmpl, err := st.GetEmailTemplateVersion(name, version)
+		if err != nil {
+			templateErrorRespond(w, err)
+			return
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// RenderEmailTemplateRequest is the body of both the preview and the
+// test-send endpoints.
+type RenderEmailTemplateRequest struct {
+	Version int                    `json:"version,omitempty"`
+	From    string                 `json:"from,omitempty"`
+	Vars    map[string]interface{} `json:"vars,omitempty"`
+}
+
+type PreviewEmailTemplateResponse struct {
+	Version int    `json:"version"`
+	Subject string `json:"subject"`
+	Text    string `json:"text,omitempty"`
+	HTML    string `json:"html,omitempty"`
+	MIME    string `json:"mime"`
+}
+
+// Address used as the recipient of previewed messages
+const previewRecipient = "preview@example.invalid"
+
+// readRenderRequest parses a RenderEmailTemplateRequest and renders the
+// template named in the URL with it.
+func readRenderRequest(st store.Store, w http.ResponseWriter, r *http.Request) (*mailer.CompiledTemplate, api.EmailData, bool) {
+	renderReq := &RenderEmailTemplateRequest{}
+	body, err := readReqBody(r)
+	if err != nil {
+		ErrorRespond(w, err.Error(), http.StatusBadRequest)
+		return nil, api.EmailData{}, false
+	}
+
+	if err := json.Unmarshal(body, renderReq); err != nil {
+		log.Errorf("Error occurred when unmarshalling data: %s", err)
+		ErrorRespond(w, err.Error(), http.StatusBadRequest)
+		return nil, api.EmailData{}, false
+	}
+
+	tmpl, err := mailer.LoadCompiledTemplate(st, mux.Vars(r)["name"], renderReq.Version)
+	if err != nil {
+		templateErrorRespond(w, err)
+		return nil, api.EmailData{}, false
+	}
+
+	emailData, err := tmpl.Render(api.EmailData{From: renderReq.From}, renderReq.Vars)
+	if err != nil {
+		ErrorRespond(w, "Error rendering template: "+err.Error(), http.StatusBadRequest)
+		return nil, api.EmailData{}, false
+	}
+	return tmpl, emailData, true
+}
+
+// PreviewEmailTemplateHandler renders a template with sample variables
+// without sending anything. Requires the admin token.
+func PreviewEmailTemplateHandler(cfg *Config, st store.Store) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		tmpl, emailData, ok := readRenderRequest(st, w, r)
+		if !ok {
+			return
+		}
+
+		sendableEmail, err := mailer.ToSendableEmail(emailData)
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendableEmail.To = []string{previewRecipient}
+		mime, err := sendableEmail.Bytes()
+		if err != nil {
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		resp := &PreviewEmailTemplateResponse{
+			Version: tmpl.Version,
+			Subject: emailData.Subject,
+			Text:    emailData.Body,
+			HTML:    emailData.HTML,
+			MIME:    string(mime),
+		}
+
+		w.Header().Set(contentType, jsonContentType)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Errorf("Error occurred when marshalling response: %s", err)
+			return
+		}
+	}
+}
+
+// TestSendEmailTemplateHandler renders a template and sends it to the
+// configured sandbox address, and nowhere else. Requires the admin
+// token.
+func TestSendEmailTemplateHandler(cfg *Config, st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RequestScope(cfg, r) != ScopeAdmin {
+			ErrorRespond(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		if cfg.SandboxAddress == "" {
+			ErrorRespond(w, "Test sends are disabled: PURSUEMAIL_SANDBOX_ADDRESS is not set",
+				http.StatusServiceUnavailable)
+			return
+		}
+
+		_, emailData, ok := readRenderRequest(st, w, r)
+		if !ok {
+			return
+		}
+		if emailData.From == "" {
+			emailData.From = m.Config.SystemFrom
+		}
+		if emailData.From == "" {
+			ErrorRespond(w, "Email cannot have an empty 'from' address!", http.StatusBadRequest)
+			return
+		}
+
+		sandbox := &store.EmailAccount{Email: cfg.SandboxAddress}
+		if err := m.Deliver(r.Context(), sandbox, emailData); err != nil {
+			log.Errorf("Error sending test email: %v", err)
+			ErrorRespond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
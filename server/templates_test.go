@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+func TestTemplateHandlersRequireAdmin(t *testing.T) {
+	ts := newTestServer(t, false)
+	tmpl := store.EmailTemplate{Subject: "Hi {{.name}}", Text: "Hello {{.name}}"}
+	render := RenderEmailTemplateRequest{Vars: map[string]interface{}{"name": "Ada"}}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		admin  bool
+		code   int
+	}{
+		{"PUT", "PUT", "/api/v1/templates/hello", tmpl, false, http.StatusUnauthorized},
+		{"PUT as admin", "PUT", "/api/v1/templates/hello", tmpl, true, http.StatusCreated},
+		{"GET", "GET", "/api/v1/templates/hello", nil, false, http.StatusOK},
+		{"preview", "POST", "/api/v1/templates/hello/preview", render, false, http.StatusUnauthorized},
+		{"preview as admin", "POST", "/api/v1/templates/hello/preview", render, true, http.StatusOK},
+		{"test-send", "POST", "/api/v1/templates/hello/test", render, false, http.StatusUnauthorized},
+		// No sandbox address is set
+		{"test-send as admin", "POST", "/api/v1/templates/hello/test", render, true, http.StatusServiceUnavailable},
+		{"DELETE", "DELETE", "/api/v1/templates/hello", nil, false, http.StatusUnauthorized},
+		{"DELETE as admin", "DELETE", "/api/v1/templates/hello", nil, true, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if rec := ts.do(tt.method, tt.path, tt.body, tt.admin, nil); rec.Code != tt.code {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.code)
+		}
+	}
+	if sent := ts.transport.Sent(); len(sent) != 0 {
+		t.Errorf("Sent %d messages, want none", len(sent))
+	}
+}
+
+// schedulingStore keeps the requests of the jobs it schedules.
+type schedulingStore struct {
+	*store.Memory
+	reqs []interface{}
+}
+
+func (st *schedulingStore) ScheduleEmailJob(kind, accountId string, req interface{}, sendAt time.Time) (*api.EmailJob, error) {
+	st.reqs = append(st.reqs, req)
+	return st.Memory.ScheduleEmailJob(kind, accountId, req, sendAt)
+}
+
+func TestScheduledSendPinsTemplateVersion(t *testing.T) {
+	st := &schedulingStore{Memory: store.NewMemory()}
+	m := mailer.New(st, &fakeTransport{}, mailer.Config{})
+	router := NewRouter(&Config{AdminToken: testAdminToken}, st, m)
+	ts := &testServer{t, router, st.Memory, nil}
+
+	for _, subject := range []string{"First", "Second"} {
+		if _, err := st.SaveEmailTemplate(&store.EmailTemplate{Name: "hello", Subject: subject, Text: "Hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := ts.create("someone@example.com")
+	later := api.Schedule{DelaySeconds: 3600}
+	emailData := api.EmailData{From: "team@example.org", Template: "hello"}
+
+	tests := []struct {
+		name    string
+		path    string
+		body    interface{}
+		code    int
+		version int
+	}{
+		{"send", "/api/v1/email/" + id + "/send",
+			api.SendEmailRequest{EmailData: emailData, Schedule: later}, http.StatusAccepted, 2},
+		{"bulk send", "/api/v1/email/bulksend",
+			api.SendBulkEmailRequest{Ids: []string{id}, EmailData: emailData, Schedule: later}, http.StatusAccepted, 2},
+		{"pinned by the caller", "/api/v1/email/" + id + "/send", api.SendEmailRequest{
+			EmailData: api.EmailData{From: "team@example.org", Template: "hello", TemplateVersion: 1}, Schedule: later},
+			http.StatusAccepted, 1},
+		{"unknown template", "/api/v1/email/" + id + "/send", api.SendEmailRequest{
+			EmailData: api.EmailData{From: "team@example.org", Template: "nope"}, Schedule: later},
+			http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		scheduled := len(st.reqs)
+		if rec := ts.do("POST", tt.path, tt.body, false, nil); rec.Code != tt.code {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.code)
+			continue
+		}
+		if tt.code != http.StatusAccepted {
+			if len(st.reqs) != scheduled {
+				t.Errorf("%s: scheduled a job", tt.name)
+			}
+			continue
+		}
+
+		var version int
+		switch req := st.reqs[len(st.reqs)-1].(type) {
+		case *api.SendEmailRequest:
+			version = req.EmailData.TemplateVersion
+		case *api.SendBulkEmailRequest:
+			version = req.EmailData.TemplateVersion
+		}
+		if version != tt.version {
+			t.Errorf("%s: scheduled with template version %d, want %d", tt.name, version, tt.version)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+var verifyPageTmpl = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>PursueMail</title></head>
+<body>
+<p>{{.Message}}</p>
+{{- if .Token}}
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// The confirmation page posts its form back to itself
+const verifyPageCSP = "default-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+type verifyPage struct {
+	Message string
+	Token   string
+}
+
+func verifyPageRespond(w http.ResponseWriter, page *verifyPage, code int) {
+	w.Header().Set(contentType, "text/html; charset=UTF-8")
+	if page.Token != "" {
+		w.Header().Set("Content-Security-Policy", verifyPageCSP)
+	}
+	w.WriteHeader(code)
+	if err := verifyPageTmpl.Execute(w, page); err != nil {
+		log.Errorf("Error rendering verification page: %s", err)
+	}
+}
+
+func verifyErrorRespond(w http.ResponseWriter, msg string, code int) {
+	verifyPageRespond(w, &verifyPage{Message: msg}, code)
+}
+
+// checkVerifyRequest looks up the account a confirmation link is for and
+// checks the link's token, responding with an error page if either fails.
+func checkVerifyRequest(st store.Store, m *mailer.Mailer, w http.ResponseWriter, r *http.Request) (*store.EmailAccount, string, bool) {
+	id := mux.Vars(r)["id"]
+
+	emailAccount, err := st.GetEmailAccount(id)
+	switch err {
+	case nil:
+	case store.ErrEmailAccountNotFound:
+		verifyErrorRespond(w, mailer.ErrInvalidToken.Error(), http.StatusNotFound)
+		return nil, "", false
+	case store.ErrEmailAccountDeleted:
+		verifyErrorRespond(w, err.Error(), http.StatusGone)
+		return nil, "", false
+	default:
+		verifyErrorRespond(w, "Something went wrong, please try again later",
+			http.StatusInternalServerError)
+		return nil, "", false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReqBodyBytes)
+	token := r.FormValue("token")
+	err = mailer.CheckVerificationToken(m.Config.VerifySecret, token,
+		emailAccount.Id, emailAccount.Email, time.Now())
+	if err != nil {
+		verifyErrorRespond(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	return emailAccount, token, true
+}
+
+// ConfirmEmailAccountPageHandler is where confirmation links point. It
+// only shows a page with a button that POSTs to VerifyEmailAccountHandler,
+// so mail scanners that open links don't confirm addresses by themselves.
+func ConfirmEmailAccountPageHandler(st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		emailAccount, token, ok := checkVerifyRequest(st, m, w, r)
+		if !ok {
+			return
+		}
+		if emailAccount.Status == store.StatusVerified {
+			verifyErrorRespond(w, "Your email address is already confirmed.", http.StatusOK)
+			return
+		}
+		verifyPageRespond(w, &verifyPage{
+			Message: "Confirm that you want to receive email at this address?",
+			Token:   token,
+		}, http.StatusOK)
+	}
+}
+
+// VerifyEmailAccountHandler marks the account verified. It responds with
+// a small HTML page since it's reached from the confirmation page.
+func VerifyEmailAccountHandler(st store.Store, m *mailer.Mailer) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		emailAccount, _, ok := checkVerifyRequest(st, m, w, r)
+		if !ok {
+			return
+		}
+
+		if emailAccount.Status != store.StatusVerified {
+			if err := st.MarkVerified(emailAccount); err != nil {
+				verifyErrorRespond(w, "Something went wrong, please try again later",
+					http.StatusInternalServerError)
+				return
+			}
+		}
+
+		verifyErrorRespond(w, "Thanks, your email address has been confirmed.", http.StatusOK)
+	}
+}
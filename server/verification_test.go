@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/mailer"
+	"github.com/PursuanceProject/pursuemail/store"
+)
+
+func TestVerifyHandlers(t *testing.T) {
+	ts := newTestServer(t, true)
+
+	var created api.CreateEmailAccountResponse
+	rec := ts.do("POST", "/api/v1/email", api.CreateEmailAccountRequest{Email: "someone@example.com"}, false, &created)
+	if rec.Code != http.StatusCreated || created.Status != store.StatusPending {
+		t.Fatalf("Create: %d %s", rec.Code, rec.Body.String())
+	}
+	sent := ts.transport.Sent()
+	if len(sent) != 1 || len(sent[0].To) != 1 || sent[0].To[0] != "someone@example.com" {
+		t.Fatalf("Sent %+v, want one confirmation", sent)
+	}
+
+	path := "/api/v1/email/" + created.Id + "/verify"
+	token := mailer.NewVerificationToken(testVerifySecret, created.Id, "someone@example.com", time.Now().Add(time.Hour))
+	expired := mailer.NewVerificationToken(testVerifySecret, created.Id, "someone@example.com", time.Now().Add(-time.Second))
+	status := func() string {
+		account, err := ts.store.GetEmailAccount(created.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return account.Status
+	}
+
+	verifyTests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		code   int
+		status string
+	}{
+		{"no token", "GET", path, "", http.StatusBadRequest, store.StatusPending},
+		{"expired", "POST", path, expired, http.StatusBadRequest, store.StatusPending},
+		{"tampered", "POST", path, token + "x", http.StatusBadRequest, store.StatusPending},
+		{"unknown account", "GET", "/api/v1/email/00000000-0000-0000-0000-000000000000/verify", token, http.StatusNotFound, store.StatusPending},
+		// Opening the link only shows the confirmation page
+		{"page", "GET", path, token, http.StatusOK, store.StatusPending},
+		{"confirm", "POST", path, token, http.StatusOK, store.StatusVerified},
+		{"confirm again", "POST", path, token, http.StatusOK, store.StatusVerified},
+	}
+	for _, tt := range verifyTests {
+		var req *http.Request
+		form := url.Values{"token": {tt.token}}
+		if tt.method == "GET" {
+			req = httptest.NewRequest("GET", tt.path+"?"+form.Encode(), nil)
+		} else {
+			req = httptest.NewRequest("POST", tt.path, strings.NewReader(form.Encode()))
+			req.Header.Set(contentType, "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		ts.router.ServeHTTP(rec, req)
+		if rec.Code != tt.code || status() != tt.status {
+			t.Errorf("%s: %d, status %s, want %d, %s", tt.name, rec.Code, status(), tt.code, tt.status)
+		}
+		if tt.name == "page" {
+			if !strings.Contains(rec.Body.String(), `<form method="post">`) ||
+				rec.Header().Get("Content-Security-Policy") != verifyPageCSP {
+				t.Errorf("Confirmation page has no form: %s", rec.Body.String())
+			}
+		}
+	}
+
+	// Changing the address sends a new confirmation, and old links stop
+	// working
+	rec = ts.do("PUT", "/api/v1/email/"+created.Id, api.UpdateEmailAccountRequest{Email: "new@example.com"}, true, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body.String())
+	}
+	if sent := ts.transport.Sent(); len(sent) != 2 || sent[1].To[0] != "new@example.com" {
+		t.Errorf("Sent %+v, want a confirmation to the new address", sent)
+	}
+	if got := status(); got != store.StatusPending {
+		t.Errorf("Status after changing the address = %s", got)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set(contentType, "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	ts.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Old link after changing the address: %d, want 400", rec.Code)
+	}
+}
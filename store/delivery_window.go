@@ -0,0 +1,79 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	log "github.com/Sirupsen/logrus"
+)
+
+func (e *EmailAccount) location() *time.Location {
+	if e.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(e.Timezone)
+	if err != nil {
+		log.Warnf("Unknown timezone %q for %s, using UTC", e.Timezone, e.Id)
+		return time.UTC
+	}
+	return loc
+}
+
+// NextDeliveryTime returns now, or when the account's quiet hours end
+// if now falls within them.
+func (e *EmailAccount) NextDeliveryTime(now time.Time) time.Time {
+	if e.QuietHours == nil {
+		return now
+	}
+	start, end := e.QuietHours.Minutes()
+
+	local := now.In(e.location())
+	m := local.Hour()*60 + local.Minute()
+
+	var quiet bool
+	if start < end {
+		quiet = start <= m && m < end
+	} else {
+		quiet = m >= start || m < end
+	}
+	if !quiet {
+		return now
+	}
+
+	day := local.Day()
+	if m >= end {
+		// Quiet hours started this evening and end tomorrow
+		day++
+	}
+	next := time.Date(local.Year(), local.Month(), day, end/60, end%60, 0, 0, local.Location())
+	if next.Hour()*60+next.Minute() != end {
+		// The clocks skipped the end of quiet hours, and time.Date may
+		// have picked a time before the change. Use the offset from
+		// before it, so 02:30 when the clocks go from 02:00 to 03:00 is
+		// 03:30.
+		_, offset := next.Add(-24 * time.Hour).Zone()
+		wall := time.Date(local.Year(), local.Month(), day, end/60, end%60, 0, 0, time.UTC)
+		next = wall.Add(-time.Duration(offset) * time.Second).In(local.Location())
+	}
+	return next
+}
+
+// quietHoursArgs returns quiet hours as nullable quiet_start and
+// quiet_end arguments.
+func quietHoursArgs(quietHours *api.QuietHours) (start, end sql.NullString) {
+	if quietHours != nil {
+		start = sql.NullString{String: quietHours.Start, Valid: true}
+		end = sql.NullString{String: quietHours.End, Valid: true}
+	}
+	return start, end
+}
+
+// scanQuietHours builds QuietHours from nullable quiet_start and
+// quiet_end columns selected as HH:MM.
+func scanQuietHours(start, end sql.NullString) *api.QuietHours {
+	if !start.Valid || !end.Valid {
+		return nil
+	}
+	return &api.QuietHours{Start: start.String, End: end.String}
+}
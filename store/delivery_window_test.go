@@ -0,0 +1,62 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+)
+
+func TestNextDeliveryTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("No timezone data: %v", err)
+	}
+	at := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	overnight := &api.QuietHours{Start: "22:00", End: "07:00"}
+	daytime := &api.QuietHours{Start: "12:00", End: "13:30"}
+
+	tests := []struct {
+		name       string
+		timezone   string
+		quietHours *api.QuietHours
+		now        time.Time
+		want       time.Time
+	}{
+		{"no quiet hours", "", nil, at(time.UTC, 2026, 3, 1, 23, 0), at(time.UTC, 2026, 3, 1, 23, 0)},
+		{"before window", "", daytime, at(time.UTC, 2026, 3, 1, 11, 59), at(time.UTC, 2026, 3, 1, 11, 59)},
+		{"window start", "", daytime, at(time.UTC, 2026, 3, 1, 12, 0), at(time.UTC, 2026, 3, 1, 13, 30)},
+		{"in window", "", daytime, at(time.UTC, 2026, 3, 1, 13, 29), at(time.UTC, 2026, 3, 1, 13, 30)},
+		{"window end", "", daytime, at(time.UTC, 2026, 3, 1, 13, 30), at(time.UTC, 2026, 3, 1, 13, 30)},
+		{"overnight, evening", "", overnight, at(time.UTC, 2026, 3, 1, 23, 0), at(time.UTC, 2026, 3, 2, 7, 0)},
+		{"overnight, after midnight", "", overnight, at(time.UTC, 2026, 3, 2, 3, 0), at(time.UTC, 2026, 3, 2, 7, 0)},
+		{"overnight, midnight", "", overnight, at(time.UTC, 2026, 3, 2, 0, 0), at(time.UTC, 2026, 3, 2, 7, 0)},
+		{"overnight, daytime", "", overnight, at(time.UTC, 2026, 3, 2, 7, 0), at(time.UTC, 2026, 3, 2, 7, 0)},
+		{"month end", "", overnight, at(time.UTC, 2026, 2, 28, 22, 0), at(time.UTC, 2026, 3, 1, 7, 0)},
+		{"year end", "", overnight, at(time.UTC, 2026, 12, 31, 23, 59), at(time.UTC, 2027, 1, 1, 7, 0)},
+		{"unknown timezone is UTC", "Mars/Olympus_Mons", overnight, at(time.UTC, 2026, 3, 1, 23, 0), at(time.UTC, 2026, 3, 2, 7, 0)},
+		// 23:00 UTC is 08:00 the next day in Tokyo, after quiet hours
+		{"account timezone", "Asia/Tokyo", overnight, at(time.UTC, 2026, 3, 1, 23, 0), at(time.UTC, 2026, 3, 1, 23, 0)},
+		{"account timezone, quiet", "Asia/Tokyo", overnight, at(time.UTC, 2026, 3, 1, 14, 0), at(tokyo, 2026, 3, 2, 7, 0)},
+		// Clocks in New York went forward at 02:00 on 2026-03-08 and
+		// back at 02:00 on 2026-11-01
+		{"overnight into DST", "America/New_York", overnight, at(newYork, 2026, 3, 7, 23, 0), at(time.UTC, 2026, 3, 8, 11, 0)},
+		{"overnight out of DST", "America/New_York", overnight, at(newYork, 2026, 10, 31, 23, 0), at(time.UTC, 2026, 11, 1, 12, 0)},
+		{"end skipped by DST", "America/New_York", &api.QuietHours{Start: "01:00", End: "02:30"},
+			at(newYork, 2026, 3, 8, 1, 30), at(newYork, 2026, 3, 8, 3, 30)},
+		{"start skipped by DST", "America/New_York", &api.QuietHours{Start: "02:30", End: "06:00"},
+			at(newYork, 2026, 3, 8, 3, 0), at(newYork, 2026, 3, 8, 6, 0)},
+	}
+	for _, tt := range tests {
+		e := &EmailAccount{Timezone: tt.timezone, QuietHours: tt.quietHours}
+		if got := e.NextDeliveryTime(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: NextDeliveryTime(%v) = %v, want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
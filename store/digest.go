@@ -0,0 +1,246 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+)
+
+// Claims on digest items older than this were left by an instance that
+// stopped mid-send, and are taken over
+const digestClaimTimeout = 10 * time.Minute
+
+// A digest that fails is retried after digestRetryBase, doubling each
+// time up to digestRetryMax. Its items are dropped after
+// maxDigestAttempts failures in a row.
+const (
+	digestRetryBase   = 5 * time.Minute
+	digestRetryMax    = 6 * time.Hour
+	maxDigestAttempts = 10
+)
+
+// UndeliverableError wraps a send error that retrying won't fix, such as
+// the recipient's server rejecting the address. A digest that fails with
+// one has its items dropped straight away.
+type UndeliverableError struct {
+	Err error
+}
+
+func (e *UndeliverableError) Error() string {
+	return e.Err.Error()
+}
+
+// digestRetryDelay returns how long to wait after a digest's attempts-th
+// failure in a row.
+func digestRetryDelay(attempts int) time.Duration {
+	delay := digestRetryBase
+	for i := 1; i < attempts && delay < digestRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > digestRetryMax {
+		delay = digestRetryMax
+	}
+	return delay
+}
+
+// giveUpOnDigest reports whether a digest that has now failed attempts
+// times in a row, most recently with err, should be dropped.
+func giveUpOnDigest(attempts int, err error) bool {
+	_, undeliverable := err.(*UndeliverableError)
+	return undeliverable || attempts >= maxDigestAttempts
+}
+
+// DigestItem is an email waiting to go out in its account's next digest.
+type DigestItem struct {
+	EmailData  api.EmailData
+	SecureOnly bool
+	Created    time.Time
+}
+
+// Digests reports whether non-urgent email to the account is collected
+// into digests rather than sent right away.
+func (e *EmailAccount) Digests() bool {
+	return e.DigestMode != "" && e.DigestMode != api.DigestImmediate
+}
+
+// QueueDigestItem adds an already-rendered email to the account's next
+// digest.
+func (pg *Postgres) QueueDigestItem(e *EmailAccount, emailData api.EmailData, secureOnly bool) error {
+	emailData.Template, emailData.TemplateVersion, emailData.Vars = "", 0, nil
+	data, err := json.Marshal(emailData)
+	if err != nil {
+		return err
+	}
+
+	_, err = pg.db.Exec(`
+		INSERT INTO digest_item (account_id, email_data, secure_only)
+		VALUES ($1, $2, $3)
+	`, e.Id, string(data), secureOnly)
+	if err != nil {
+		log.Errorf("Error inserting digest_item. Err: %s", err)
+		return err
+	}
+	return nil
+}
+
+// DueDigests returns the IDs of the accounts whose oldest queued item has
+// waited a full digest interval. Accounts since switched to immediate
+// mode are always due. Items being sent by another instance don't count,
+// and accounts whose last digest failed wait until it's time to retry.
+func (pg *Postgres) DueDigests() ([]string, error) {
+	rows, err := pg.db.Query(`
+		SELECT
+			d.account_id
+		FROM
+			digest_item d JOIN email_account a ON a.id = d.account_id
+			LEFT JOIN digest_retry r ON r.account_id = d.account_id
+		WHERE
+			(d.claimed IS NULL OR d.claimed < now() - make_interval(secs => $1))
+			AND (r.retry_after IS NULL OR r.retry_after <= now())
+		GROUP BY
+			d.account_id, a.digest_mode
+		HAVING
+			min(d.created) <= now() - CASE a.digest_mode
+				WHEN 'hourly' THEN interval '1 hour'
+				WHEN 'daily' THEN interval '1 day'
+				ELSE interval '0'
+			END
+	`, digestClaimTimeout.Seconds())
+	if err != nil {
+		log.Errorf("Error getting due digests. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ClaimDigestItems hands the account's queued items, oldest first, to
+// send. They're claimed in one short transaction and, once send returns,
+// removed if it succeeded or released to be retried later in another, so
+// no transaction stays open while sending. Items claimed by another
+// instance are skipped. Failures are counted, and the items are dropped
+// once the digest has failed for good (see giveUpOnDigest).
+func (pg *Postgres) ClaimDigestItems(accountId string, send func(items []*DigestItem) error) error {
+	rows, err := pg.db.Query(`
+		UPDATE digest_item
+		SET claimed = now()
+		WHERE id IN (
+			SELECT id FROM digest_item
+			WHERE account_id = $1
+			  AND (claimed IS NULL OR claimed < now() - make_interval(secs => $2))
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, email_data, secure_only, created
+	`, accountId, digestClaimTimeout.Seconds())
+	if err != nil {
+		log.Errorf("Error claiming digest_items. Err: %s", err)
+		return err
+	}
+
+	ids := []string{}
+	items := []*DigestItem{}
+	for rows.Next() {
+		var id string
+		var item DigestItem
+		var data []byte
+		if err = rows.Scan(&id, &data, &item.SecureOnly, &item.Created); err == nil {
+			err = json.Unmarshal(data, &item.EmailData)
+		}
+		if err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			break
+		}
+		ids = append(ids, id)
+		items = append(items, &item)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		pg.releaseDigestItems(ids)
+		return err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.Before(items[j].Created) })
+
+	if err = send(items); err != nil {
+		pg.digestFailed(accountId, ids, err)
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err = pg.db.Exec(`DELETE FROM digest_item WHERE id = ANY($1::uuid[])`, pq.Array(ids))
+	if err != nil {
+		log.Errorf("Error deleting sent digest_items. Err: %s", err)
+		return err
+	}
+	// The digest went out, so the next failure starts the count again
+	_, err = pg.db.Exec(`DELETE FROM digest_retry WHERE account_id = $1`, accountId)
+	if err != nil {
+		log.Errorf("Error deleting digest_retry. Err: %s", err)
+	}
+	return err
+}
+
+// digestFailed records that the account's digest of the given items
+// failed with sendErr, and either releases the items to be retried after
+// a delay or, if the digest has failed for good, drops them.
+func (pg *Postgres) digestFailed(accountId string, ids []string, sendErr error) {
+	var attempts int
+	err := pg.db.QueryRow(`
+		INSERT INTO digest_retry (account_id, attempts, last_error, retry_after)
+		VALUES ($1, 1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (account_id) DO UPDATE
+		SET attempts = digest_retry.attempts + 1,
+			last_error = EXCLUDED.last_error,
+			retry_after = now() + least(
+				make_interval(secs => $3 * power(2, digest_retry.attempts)),
+				make_interval(secs => $4))
+		RETURNING attempts
+	`, accountId, sendErr.Error(), digestRetryBase.Seconds(), digestRetryMax.Seconds()).Scan(&attempts)
+	if err != nil {
+		log.Errorf("Error updating digest_retry. Err: %s", err)
+	}
+	if !giveUpOnDigest(attempts, sendErr) {
+		pg.releaseDigestItems(ids)
+		return
+	}
+
+	log.Errorf("Dropping %d digest items for %s after %d failed attempts. Err: %s",
+		len(ids), accountId, attempts, sendErr)
+	_, err = pg.db.Exec(`DELETE FROM digest_item WHERE id = ANY($1::uuid[])`, pq.Array(ids))
+	if err == nil {
+		_, err = pg.db.Exec(`DELETE FROM digest_retry WHERE account_id = $1`, accountId)
+	}
+	if err != nil {
+		log.Errorf("Error dropping digest_items. Err: %s", err)
+	}
+}
+
+// releaseDigestItems unclaims items whose digest wasn't sent, so the next
+// flush retries them.
+func (pg *Postgres) releaseDigestItems(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	_, err := pg.db.Exec(`UPDATE digest_item SET claimed = NULL WHERE id = ANY($1::uuid[])`, pq.Array(ids))
+	if err != nil {
+		log.Errorf("Error releasing digest_items. Err: %s", err)
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+)
+
+func TestDigestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{4, 40 * time.Minute},
+		{7, 320 * time.Minute},
+		{8, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if delay := digestRetryDelay(tt.attempts); delay != tt.delay {
+			t.Errorf("digestRetryDelay(%d) = %v, want %v", tt.attempts, delay, tt.delay)
+		}
+	}
+}
+
+func TestMemoryDigestRetries(t *testing.T) {
+	mem := NewMemory()
+	account := &EmailAccount{Email: "someone@example.com", DigestMode: api.DigestImmediate}
+	if _, err := mem.SaveEmailAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	queue := func() {
+		t.Helper()
+		if err := mem.QueueDigestItem(account, api.EmailData{Subject: "Hi"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due := func() bool {
+		t.Helper()
+		ids, err := mem.DueDigests()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(ids) == 1 && ids[0] == account.Id
+	}
+	flush := func(sendErr error) int {
+		t.Helper()
+		sent := 0
+		err := mem.ClaimDigestItems(account.Id, func(items []*DigestItem) error {
+			sent = len(items)
+			return sendErr
+		})
+		if err != sendErr {
+			t.Fatalf("ClaimDigestItems err = %v, want %v", err, sendErr)
+		}
+		return sent
+	}
+	// retryNow makes a failed digest due again without waiting
+	retryNow := func() {
+		mem.digestRetries[account.Id].retryAfter = time.Now()
+	}
+	unavailable := errors.New("421 Service not available")
+
+	queue()
+	if !due() || flush(unavailable) != 1 {
+		t.Fatal("The first digest wasn't tried")
+	}
+	if due() {
+		t.Error("A failed digest is due again straight away")
+	}
+	retryNow()
+	queue()
+	if !due() || flush(nil) != 2 {
+		t.Fatal("The retried digest didn't have both items")
+	}
+	if mem.digestRetries[account.Id] != nil {
+		t.Error("A sent digest's failures weren't forgotten")
+	}
+
+	queue()
+	for i := 1; i < maxDigestAttempts; i++ {
+		if flush(unavailable) != 1 {
+			t.Fatalf("Attempt %d didn't have the item", i)
+		}
+		if retry := mem.digestRetries[account.Id]; retry.attempts != i || retry.lastError != unavailable.Error() {
+			t.Fatalf("After attempt %d: %+v", i, retry)
+		}
+		retryNow()
+	}
+	flush(unavailable)
+	if due() || len(mem.digestItems[account.Id]) != 0 || mem.digestRetries[account.Id] != nil {
+		t.Errorf("Items weren't dropped after %d failures", maxDigestAttempts)
+	}
+
+	queue()
+	flush(&UndeliverableError{errors.New("550 No such user")})
+	if due() || len(mem.digestItems[account.Id]) != 0 {
+		t.Error("Undeliverable items weren't dropped")
+	}
+}
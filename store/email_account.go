@@ -0,0 +1,447 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	StatusActive   = "active"
+	StatusPending  = "pending"
+	StatusVerified = "verified"
+)
+
+type EmailAccount struct {
+	Id      string    `json:"id,omitempty"`
+	Email   string    `json:"email"`
+	PubKey  string    `json:"pubkey,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+
+	// IANA timezone QuietHours are in; UTC if empty
+	Timezone   string          `json:"timezone,omitempty"`
+	QuietHours *api.QuietHours `json:"quiet_hours,omitempty"`
+
+	// How often non-urgent email is sent, batched as a digest
+	DigestMode string `json:"digest_mode,omitempty"`
+}
+
+var (
+	ErrEmailAccountNotFound = errors.New("Email account not found")
+	ErrEmailAccountDeleted  = errors.New("Email account has been deleted")
+	ErrEmailAccountExists   = errors.New("Another email account already has that address")
+	ErrPubKeyConflict       = errors.New("An account with that address already exists with a different public key")
+)
+
+func (pg *Postgres) GetEmailAccount(id string) (*EmailAccount, error) {
+	if !uuidRegex.MatchString(id) {
+		return nil, ErrEmailAccountNotFound
+	}
+	accounts, err := pg.GetEmailAccounts([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		deleted, err := pg.isTombstoned(id)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return nil, ErrEmailAccountDeleted
+		}
+		return nil, ErrEmailAccountNotFound
+	}
+	if len(accounts) != 1 {
+		return nil, fmt.Errorf("%d accounts with id %v, not 1!", len(accounts), id)
+	}
+	return accounts[0], nil
+}
+
+// GetEmailAccountByEmail looks up an account by address, ignoring case.
+func (pg *Postgres) GetEmailAccountByEmail(email string) (*EmailAccount, error) {
+	var ea EmailAccount
+	err := pg.db.QueryRow(`
+		SELECT
+			id, email, status, created
+		FROM
+			email_account
+		WHERE
+			lower(email) = lower($1)
+	`, normalizeEmail(email)).Scan(&ea.Id, &ea.Email, &ea.Status, &ea.Created)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrEmailAccountNotFound
+	}
+	if err != nil {
+		log.Errorf("Error getting email_account by email. Err: %s", err)
+		return nil, err
+	}
+	return &ea, nil
+}
+
+func (pg *Postgres) isTombstoned(id string) (bool, error) {
+	var exists bool
+	err := pg.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM email_account_tombstone WHERE id = $1)
+	`, id).Scan(&exists)
+	if err != nil {
+		log.Errorf("Error checking email_account_tombstone. Err: %s", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+func (pg *Postgres) GetEmailAccounts(ids []string) ([]*EmailAccount, error) {
+	idsParam := "{" + strings.Join(ids, ",") + "}"
+	rows, err := pg.db.Query(`
+		SELECT
+			id, email, status, created, coalesce(timezone, ''),
+			to_char(quiet_start, 'HH24:MI'), to_char(quiet_end, 'HH24:MI'), digest_mode
+		FROM
+			email_account
+		WHERE
+			id = ANY($1::uuid[])
+	`, idsParam)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Errorf("Error getting email_accounts. Err: %s", err)
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	emailAccounts := []*EmailAccount{}
+	for rows.Next() {
+		var ea EmailAccount
+		var quietStart, quietEnd sql.NullString
+
+		err := rows.Scan(&ea.Id, &ea.Email, &ea.Status, &ea.Created, &ea.Timezone,
+			&quietStart, &quietEnd, &ea.DigestMode)
+
+		if err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+
+		ea.QuietHours = scanQuietHours(quietStart, quietEnd)
+		emailAccounts = append(emailAccounts, &ea)
+	}
+
+	log.Debugf("GetEmailAccounts returning %v accounts", len(emailAccounts))
+	return emailAccounts, nil
+}
+
+// SaveEmailAccount saves Email, PubKey, delivery window and digest mode,
+// and attaches the Id that is returned. If an account with the same
+// address (ignoring case) already exists, its Id and Status are attached
+// instead and created is false; nothing is imported then, and a PubKey
+// other than the one it already has is ErrPubKeyConflict.
+func (pg *Postgres) SaveEmailAccount(e *EmailAccount) (created bool, err error) {
+	e.Email = normalizeEmail(e.Email)
+	if e.Status == "" {
+		e.Status = StatusActive
+	}
+	if e.DigestMode == "" {
+		e.DigestMode = api.DigestImmediate
+	}
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		log.Errorf("Error beginning transaction. Err: %s", err)
+		return false, err
+	}
+
+	quietStart, quietEnd := quietHoursArgs(e.QuietHours)
+
+	created = true
+	err = tx.QueryRow(`
+		INSERT INTO email_account(email, status, timezone, quiet_start, quiet_end, digest_mode)
+		VALUES ($1, $2, NULLIF($3, ''), $4::time, $5::time, $6)
+		ON CONFLICT ((lower(email))) DO NOTHING
+		RETURNING id, created
+	`, e.Email, e.Status, e.Timezone, quietStart, quietEnd, e.DigestMode).Scan(&e.Id, &e.Created)
+
+	if err == sql.ErrNoRows {
+		created = false
+		err = tx.QueryRow(`
+			SELECT id, email, status, created
+			FROM email_account
+			WHERE lower(email) = lower($1)
+		`, e.Email).Scan(&e.Id, &e.Email, &e.Status, &e.Created)
+		if err == nil {
+			err = checkExistingPubKey(e)
+		}
+	} else if err == nil {
+		err = importPubKeyFor(e.Email, e.PubKey)
+	}
+
+	if err != nil {
+		log.Errorf("Error adding email_account. Err: %s", err)
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Errorf("Got error rolling back transaction. Err: %s", rollbackErr)
+		}
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Error committing transaction. Err: %s", err)
+		return false, err
+	}
+	return created, nil
+}
+
+// AccountUpdate is a change to an account. Zero fields are left as they
+// are.
+type AccountUpdate struct {
+	Email  string
+	PubKey string
+
+	// Whether a new address must be confirmed before it can be sent to.
+	// If not, the account is active at its new address.
+	Verify bool
+
+	// If SetDeliveryWindow is true, the new timezone (empty for UTC) and
+	// quiet hours (nil for none)
+	SetDeliveryWindow bool
+	Timezone          string
+	QuietHours        *api.QuietHours
+
+	DigestMode string
+}
+
+// UpdateEmailAccount applies u to the account in one transaction, which
+// only commits once a new PubKey has been imported. The row is locked and
+// u applied to it as stored, so concurrent updates don't undo each other.
+// A new address loses the old one's verification, and the key for the
+// old address is removed from the keyring once the change is committed.
+func (pg *Postgres) UpdateEmailAccount(e *EmailAccount, u *AccountUpdate) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		log.Errorf("Error beginning transaction. Err: %s", err)
+		return err
+	}
+
+	var locked EmailAccount
+	var quietStart, quietEnd sql.NullString
+	err = tx.QueryRow(`
+		SELECT
+			id, email, status, created, coalesce(timezone, ''),
+			to_char(quiet_start, 'HH24:MI'), to_char(quiet_end, 'HH24:MI'), digest_mode
+		FROM
+			email_account
+		WHERE
+			id = $1
+		FOR UPDATE
+	`, e.Id).Scan(&locked.Id, &locked.Email, &locked.Status, &locked.Created, &locked.Timezone,
+		&quietStart, &quietEnd, &locked.DigestMode)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		deleted, err := pg.isTombstoned(e.Id)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return ErrEmailAccountDeleted
+		}
+		return ErrEmailAccountNotFound
+	}
+	if err != nil {
+		log.Errorf("Error locking email_account. Err: %s", err)
+		tx.Rollback()
+		return err
+	}
+	locked.QuietHours = scanQuietHours(quietStart, quietEnd)
+
+	updated := locked
+	changed := applyUpdate(&updated, u)
+	quietStartArg, quietEndArg := quietHoursArgs(updated.QuietHours)
+
+	_, err = tx.Exec(`
+		UPDATE email_account
+		SET email = $2, status = $3,
+			verified = CASE WHEN $3 = 'verified' THEN verified END,
+			timezone = NULLIF($4, ''), quiet_start = $5::time, quiet_end = $6::time,
+			digest_mode = $7
+		WHERE id = $1
+	`, e.Id, updated.Email, updated.Status, updated.Timezone, quietStartArg, quietEndArg,
+		updated.DigestMode)
+	if isUniqueViolation(err) {
+		tx.Rollback()
+		return ErrEmailAccountExists
+	}
+	if err == nil {
+		err = importPubKeyFor(updated.Email, u.PubKey)
+	}
+	if err != nil {
+		log.Errorf("Error updating email_account. Err: %s", err)
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Errorf("Got error rolling back transaction. Err: %s", rollbackErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Error committing transaction. Err: %s", err)
+		return err
+	}
+
+	*e = updated
+	if changed {
+		return deletePubKey(locked.Email)
+	}
+	return nil
+}
+
+// DeleteEmailAccount erases the account and its public key, leaving
+// behind a tombstone so that the Id is known to have existed.
+func (pg *Postgres) DeleteEmailAccount(e *EmailAccount) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		log.Errorf("Error beginning transaction. Err: %s", err)
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM email_account WHERE id = $1`, e.Id)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO email_account_tombstone(id)
+			VALUES ($1)
+			ON CONFLICT DO NOTHING
+		`, e.Id)
+	}
+	if err != nil {
+		log.Errorf("Error deleting email_account. Err: %s", err)
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Errorf("Got error rolling back transaction. Err: %s", rollbackErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Error committing transaction. Err: %s", err)
+		return err
+	}
+
+	return deletePubKey(e.Email)
+}
+
+// CanReceive reports whether email may be sent to the account without
+// the caller overriding verification. Accounts awaiting confirmation
+// never can; unverified ones (including bare addresses) only when
+// verification isn't required.
+func (e *EmailAccount) CanReceive(requireVerified bool) bool {
+	switch e.Status {
+	case StatusVerified:
+		return true
+	case StatusPending:
+		return false
+	default:
+		return !requireVerified
+	}
+}
+
+// MarkVerified records that the account's address has been confirmed.
+func (pg *Postgres) MarkVerified(e *EmailAccount) error {
+	_, err := pg.db.Exec(`
+		UPDATE email_account
+		SET status = $2, verified = now()
+		WHERE id = $1
+	`, e.Id, StatusVerified)
+	if err != nil {
+		log.Errorf("Error updating email_account status. Err: %s", err)
+		return err
+	}
+	e.Status = StatusVerified
+	return nil
+}
+
+func (e *EmailAccount) HasPubKey() bool {
+	return crypto.HasPubKey(e.Email)
+}
+
+// ArmoredPubKey returns the account's public key from the keyring in
+// ASCII-armored form.
+func (e *EmailAccount) ArmoredPubKey() (string, error) {
+	return crypto.ArmoredPubKey(e.Email)
+}
+
+// applyUpdate makes u's changes to e, and reports whether its address
+// changed.
+func applyUpdate(e *EmailAccount, u *AccountUpdate) (changed bool) {
+	if email := normalizeEmail(u.Email); email != "" {
+		changed = !strings.EqualFold(email, e.Email)
+		e.Email = email
+	}
+	if changed {
+		e.Status = StatusActive
+		if u.Verify {
+			e.Status = StatusPending
+		}
+	}
+	if u.SetDeliveryWindow {
+		e.Timezone, e.QuietHours = u.Timezone, u.QuietHours
+	}
+	if u.DigestMode != "" {
+		e.DigestMode = u.DigestMode
+	}
+	return changed
+}
+
+func importPubKey(pubKey string) error {
+	if pubKey == "" {
+		return nil
+	}
+	if err := crypto.ImportPublicKey(pubKey); err != nil {
+		log.Errorf("Error importing public key. Err: %s", err)
+		return err
+	}
+	return nil
+}
+
+// importPubKeyFor imports pubKey, if given, once it's checked to be a key
+// for email and no other address.
+func importPubKeyFor(email, pubKey string) error {
+	if pubKey == "" {
+		return nil
+	}
+	if err := crypto.CheckPubKeyFor(email, pubKey); err != nil {
+		return err
+	}
+	return importPubKey(pubKey)
+}
+
+// checkExistingPubKey is the duplicate path of SaveEmailAccount: a key
+// sent with it must be the one the account already has.
+func checkExistingPubKey(e *EmailAccount) error {
+	if e.PubKey == "" || crypto.SamePubKey(e.Email, e.PubKey) {
+		return nil
+	}
+	return ErrPubKeyConflict
+}
+
+// deletePubKey removes the key for email from the keyring, if there is
+// one.
+func deletePubKey(email string) error {
+	if !crypto.HasPubKey(email) {
+		return nil
+	}
+	if err := crypto.DeletePublicKey(email); err != nil {
+		log.Errorf("Error deleting public key. Err: %s", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrJobNotFound     = errors.New("Job not found")
+	ErrJobNotScheduled = errors.New("Job is no longer scheduled")
+)
+
+// ScheduleEmailJob persists req to be sent at sendAt. accountId is empty
+// for bulk sends.
+func (pg *Postgres) ScheduleEmailJob(kind, accountId string, req interface{}, sendAt time.Time) (*api.EmailJob, error) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &api.EmailJob{
+		Kind:      kind,
+		AccountId: accountId,
+		Request:   request,
+		Status:    api.JobScheduled,
+		SendAt:    sendAt,
+	}
+	err = pg.db.QueryRow(`
+		INSERT INTO email_job (kind, account_id, request, send_at)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4)
+		RETURNING id, created, updated
+	`, kind, accountId, string(request), sendAt).Scan(&job.Id, &job.Created, &job.Updated)
+	if err != nil {
+		log.Errorf("Error inserting email_job. Err: %s", err)
+		return nil, err
+	}
+	return job, nil
+}
+
+func (pg *Postgres) GetEmailJob(id string) (*api.EmailJob, error) {
+	if !uuidRegex.MatchString(id) {
+		return nil, ErrJobNotFound
+	}
+
+	var job api.EmailJob
+	var accountId sql.NullString
+	var result []byte
+	err := pg.db.QueryRow(`
+		SELECT
+			id, kind, account_id, status, send_at, result, created, updated
+		FROM
+			email_job
+		WHERE
+			id = $1
+	`, id).Scan(&job.Id, &job.Kind, &accountId, &job.Status, &job.SendAt, &result,
+		&job.Created, &job.Updated)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		log.Errorf("Error getting email_job. Err: %s", err)
+		return nil, err
+	}
+	job.AccountId = accountId.String
+	job.Result = result
+	return &job, nil
+}
+
+// CancelEmailJob cancels the job if the scheduler hasn't picked it up
+// yet, and returns ErrJobNotScheduled otherwise.
+func (pg *Postgres) CancelEmailJob(id string) error {
+	job, err := pg.GetEmailJob(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := pg.db.Exec(`
+		UPDATE email_job
+		SET status = $2, updated = now()
+		WHERE id = $1 AND status = $3
+	`, job.Id, api.JobCancelled, api.JobScheduled)
+	if err != nil {
+		log.Errorf("Error cancelling email_job. Err: %s", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrJobNotScheduled
+	}
+	return nil
+}
+
+// ClaimDueJobs marks up to limit due jobs as dispatching, which also
+// makes them uncancellable, and returns them. Jobs are claimed with SKIP
+// LOCKED, so several PursueMail instances can share a database.
+func (pg *Postgres) ClaimDueJobs(limit int) ([]*api.EmailJob, error) {
+	rows, err := pg.db.Query(`
+		UPDATE email_job
+		SET status = $1, updated = now()
+		WHERE id IN (
+			SELECT id FROM email_job
+			WHERE status = $2 AND send_at <= now()
+			ORDER BY send_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, account_id, request, send_at
+	`, api.JobDispatching, api.JobScheduled, limit)
+	if err != nil {
+		log.Errorf("Error claiming email_jobs. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*api.EmailJob{}
+	for rows.Next() {
+		job := &api.EmailJob{Status: api.JobDispatching}
+		var accountId sql.NullString
+		var request []byte
+		err := rows.Scan(&job.Id, &job.Kind, &accountId, &request, &job.SendAt)
+		if err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+		job.AccountId = accountId.String
+		job.Request = request
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// FinishEmailJob records the outcome of a dispatched job. result may be
+// nil.
+func (pg *Postgres) FinishEmailJob(id, status string, result []byte) error {
+	_, err := pg.db.Exec(`
+		UPDATE email_job
+		SET status = $2, result = $3, updated = now()
+		WHERE id = $1
+	`, id, status, nullableJSON(result))
+	if err != nil {
+		log.Errorf("Error updating email_job %s. Err: %s", id, err)
+	}
+	return err
+}
+
+// RenewJobLease records that the dispatching job id is still being
+// worked on, so FailInterruptedJobs leaves it alone.
+func (pg *Postgres) RenewJobLease(id string) error {
+	_, err := pg.db.Exec(`
+		UPDATE email_job SET updated = now() WHERE id = $1 AND status = $2
+	`, id, api.JobDispatching)
+	if err != nil {
+		log.Errorf("Error renewing lease on email_job %s. Err: %s", id, err)
+	}
+	return err
+}
+
+// FailInterruptedJobs marks jobs left dispatching whose lease hasn't been
+// renewed within leaseTimeout as failed, and returns how many there
+// were. Some of their emails may have gone out, so retrying them could
+// send duplicates.
+func (pg *Postgres) FailInterruptedJobs(leaseTimeout time.Duration) (int64, error) {
+	res, err := pg.db.Exec(`
+		UPDATE email_job
+		SET status = $1, result = $2, updated = now()
+		WHERE status = $3 AND updated < now() - make_interval(secs => $4)
+	`, api.JobFailed, `{"error": "interrupted while dispatching"}`, api.JobDispatching,
+		leaseTimeout.Seconds())
+	if err != nil {
+		log.Errorf("Error failing interrupted email_jobs. Err: %s", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func nullableJSON(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
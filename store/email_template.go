@@ -0,0 +1,238 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrTemplateNotFound        = errors.New("Email template not found")
+	ErrTemplateVersionNotFound = errors.New("Email template version not found")
+)
+
+var templateNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,100}$`)
+
+// EmailTemplate is a named template for the subject, plain text body and
+// HTML body of an email. Subject and Text use text/template; HTML uses
+// html/template so variables are escaped.
+//
+// Each save creates a new, immutable version; Version is the one these
+// fields belong to.
+type EmailTemplate struct {
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text,omitempty"`
+	HTML    string    `json:"html,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Updated time.Time `json:"updated,omitempty"`
+}
+
+// Validate checks the template's name and that it has a body. Whether
+// the bodies parse is checked when they're compiled.
+func (t *EmailTemplate) Validate() error {
+	if !templateNameRegex.MatchString(t.Name) {
+		return errors.New("Template names must be 1-100 letters, digits, '.', '_' or '-'")
+	}
+	if t.Text == "" && t.HTML == "" {
+		return errors.New("Template needs a text or an HTML body")
+	}
+	return nil
+}
+
+func (pg *Postgres) GetEmailTemplate(name string) (*EmailTemplate, error) {
+	var t EmailTemplate
+	err := pg.db.QueryRow(`
+		SELECT
+			name, version, subject, text_body, html_body, created, updated
+		FROM
+			email_template
+		WHERE
+			name = $1 AND deleted IS NULL
+	`, name).Scan(&t.Name, &t.Version, &t.Subject, &t.Text, &t.HTML, &t.Created, &t.Updated)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		log.Errorf("Error getting email_template. Err: %s", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (pg *Postgres) GetEmailTemplates() ([]*EmailTemplate, error) {
+	rows, err := pg.db.Query(`
+		SELECT
+			name, version, subject, text_body, html_body, created, updated
+		FROM
+			email_template
+		WHERE
+			deleted IS NULL
+		ORDER BY
+			name
+	`)
+	if err != nil {
+		log.Errorf("Error getting email_templates. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*EmailTemplate{}
+	for rows.Next() {
+		var t EmailTemplate
+
+		err := rows.Scan(&t.Name, &t.Version, &t.Subject, &t.Text, &t.HTML, &t.Created, &t.Updated)
+		if err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+
+		templates = append(templates, &t)
+	}
+	return templates, rows.Err()
+}
+
+// GetEmailTemplateVersion fetches a specific version of the named
+// template. Updated is the time that version was created. Versions of
+// deleted templates are still found, for jobs scheduled with them.
+func (pg *Postgres) GetEmailTemplateVersion(name string, version int) (*EmailTemplate, error) {
+	var t EmailTemplate
+	err := pg.db.QueryRow(`
+		SELECT
+			v.name, v.version, v.subject, v.text_body, v.html_body, t.created, v.created
+		FROM
+			email_template_version v JOIN email_template t ON t.name = v.name
+		WHERE
+			v.name = $1 AND v.version = $2
+	`, name, version).Scan(&t.Name, &t.Version, &t.Subject, &t.Text, &t.HTML, &t.Created, &t.Updated)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTemplateVersionNotFound
+	}
+	if err != nil {
+		log.Errorf("Error getting email_template_version. Err: %s", err)
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (pg *Postgres) GetEmailTemplateVersions(name string) ([]*EmailTemplate, error) {
+	rows, err := pg.db.Query(`
+		SELECT
+			v.name, v.version, v.subject, v.text_body, v.html_body, t.created, v.created
+		FROM
+			email_template_version v JOIN email_template t ON t.name = v.name
+		WHERE
+			v.name = $1 AND t.deleted IS NULL
+		ORDER BY
+			v.version
+	`, name)
+	if err != nil {
+		log.Errorf("Error getting email_template_versions. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*EmailTemplate{}
+	for rows.Next() {
+		var t EmailTemplate
+
+		err := rows.Scan(&t.Name, &t.Version, &t.Subject, &t.Text, &t.HTML, &t.Created, &t.Updated)
+		if err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+
+		versions = append(versions, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrTemplateNotFound
+	}
+	return versions, nil
+}
+
+// SaveEmailTemplate creates the template, or adds a new version of it if
+// one with the same Name exists. created reports which happened; Version
+// is set to the new version. Saving a deleted template's name brings it
+// back, carrying on from its last version so old versions never change.
+func (pg *Postgres) SaveEmailTemplate(t *EmailTemplate) (created bool, err error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		log.Errorf("Error beginning transaction. Err: %s", err)
+		return false, err
+	}
+
+	var wasDeleted bool
+	err = tx.QueryRow(`
+		SELECT deleted IS NOT NULL FROM email_template WHERE name = $1 FOR UPDATE
+	`, t.Name).Scan(&wasDeleted)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	if err == nil {
+		err = tx.QueryRow(`
+			INSERT INTO email_template(name, version, subject, text_body, html_body)
+			VALUES ($1, 1, $2, $3, $4)
+			ON CONFLICT (name) DO UPDATE
+			SET version = email_template.version + 1,
+				subject = EXCLUDED.subject,
+				text_body = EXCLUDED.text_body,
+				html_body = EXCLUDED.html_body,
+				created = CASE WHEN email_template.deleted IS NULL
+					THEN email_template.created ELSE now() END,
+				updated = now(),
+				deleted = NULL
+			RETURNING version, created, updated, (xmax = 0)
+		`, t.Name, t.Subject, t.Text, t.HTML).Scan(&t.Version, &t.Created, &t.Updated, &created)
+		created = created || wasDeleted
+	}
+
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO email_template_version(name, version, subject, text_body, html_body, created)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, t.Name, t.Version, t.Subject, t.Text, t.HTML, t.Updated)
+	}
+
+	if err != nil {
+		log.Errorf("Error saving email_template. Err: %s", err)
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Errorf("Got error rolling back transaction. Err: %s", rollbackErr)
+		}
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Error committing transaction. Err: %s", err)
+		return false, err
+	}
+	return created, nil
+}
+
+// DeleteEmailTemplate marks the template deleted. Its versions are kept,
+// so jobs scheduled with a specific version still go out.
+func (pg *Postgres) DeleteEmailTemplate(name string) error {
+	res, err := pg.db.Exec(`
+		UPDATE email_template SET deleted = now()
+		WHERE name = $1 AND deleted IS NULL
+	`, name)
+	if err != nil {
+		log.Errorf("Error deleting email_template. Err: %s", err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Claims still in progress after this were left by an instance that
+// stopped mid-request, and are taken over
+const idempotencyClaimTimeout = 2 * time.Minute
+
+// IdempotentResponse is what's stored for an Idempotency-Key: the hash
+// of the request that first used it and, once that request has been
+// handled, the response to replay. Status is 0 while it's in progress.
+type IdempotentResponse struct {
+	RequestHash []byte
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// ExpireIdempotencyKeys forgets keys more than 24 hours old.
+func (pg *Postgres) ExpireIdempotencyKeys() error {
+	_, err := pg.db.Exec(`
+		DELETE FROM idempotency_key
+		WHERE created < now() - interval '24 hours'
+	`)
+	if err != nil {
+		log.Errorf("Error expiring idempotency keys. Err: %s", err)
+	}
+	return err
+}
+
+// ClaimIdempotencyKey records that a request with the given body hash is
+// being handled under key and route. It returns false if the key was
+// already used for the route, unless that request never finished and
+// its claim has timed out.
+func (pg *Postgres) ClaimIdempotencyKey(key, route string, requestHash []byte) (bool, error) {
+	res, err := pg.db.Exec(`
+		INSERT INTO idempotency_key(key, route, request_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key, route) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, created = now()
+		WHERE idempotency_key.status IS NULL
+		  AND idempotency_key.created < now() - make_interval(secs => $4)
+	`, key, route, requestHash, idempotencyClaimTimeout.Seconds())
+	if err != nil {
+		log.Errorf("Error adding idempotency_key. Err: %s", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ForgetIdempotencyKey releases a claimed key so the request can be
+// retried.
+func (pg *Postgres) ForgetIdempotencyKey(key, route string) error {
+	_, err := pg.db.Exec(`
+		DELETE FROM idempotency_key WHERE key = $1 AND route = $2
+	`, key, route)
+	if err != nil {
+		log.Errorf("Error deleting idempotency_key. Err: %s", err)
+	}
+	return err
+}
+
+// SaveIdempotentResponse stores the response to the request that claimed
+// key, for replaying to retries.
+func (pg *Postgres) SaveIdempotentResponse(key, route string, status int, contentType string, body []byte) error {
+	_, err := pg.db.Exec(`
+		UPDATE idempotency_key
+		SET status = $3, content_type = $4, response = $5
+		WHERE key = $1 AND route = $2
+	`, key, route, status, contentType, body)
+	if err != nil {
+		log.Errorf("Error storing idempotent response. Err: %s", err)
+	}
+	return err
+}
+
+func (pg *Postgres) GetIdempotentResponse(key, route string) (*IdempotentResponse, error) {
+	var (
+		resp   IdempotentResponse
+		status sql.NullInt64
+		ctype  sql.NullString
+	)
+	err := pg.db.QueryRow(`
+		SELECT request_hash, status, content_type, response
+		FROM idempotency_key
+		WHERE key = $1 AND route = $2
+	`, key, route).Scan(&resp.RequestHash, &status, &ctype, &resp.Body)
+	if err == sql.ErrNoRows {
+		// Expired since it was claimed
+		return nil, err
+	}
+	if err != nil {
+		log.Errorf("Error getting idempotency_key. Err: %s", err)
+		return nil, err
+	}
+	resp.Status = int(status.Int64)
+	resp.ContentType = ctype.String
+	return &resp, nil
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyClaimTimeout(t *testing.T) {
+	mem := NewMemory()
+	claim := func(key string) bool {
+		t.Helper()
+		claimed, err := mem.ClaimIdempotencyKey(key, "POST /test", []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claimed
+	}
+	age := func(key string) {
+		mem.idempotency[idempotencyMapKey(key, "POST /test")].created = time.Now().Add(-idempotencyClaimTimeout - time.Second)
+	}
+
+	if !claim("busy") || claim("busy") {
+		t.Fatal("A new key should be claimed once")
+	}
+	age("busy")
+	if !claim("busy") {
+		t.Error("A claim left in progress past the timeout wasn't taken over")
+	}
+	if claim("busy") {
+		t.Error("A taken-over claim was claimed again")
+	}
+
+	if !claim("done") {
+		t.Fatal("Couldn't claim a new key")
+	}
+	if err := mem.SaveIdempotentResponse("done", "POST /test", 201, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	age("done")
+	if claim("done") {
+		t.Error("A key with a saved response was claimed again")
+	}
+}
@@ -0,0 +1,669 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Memory is a Store that keeps everything in memory, so PursueMail can
+// run without a database. Nothing survives a restart, and instances
+// can't share one, so it's for small single-instance deployments and
+// tests.
+type Memory struct {
+	mu sync.Mutex
+
+	accounts   map[string]*EmailAccount
+	byEmail    map[string]string
+	tombstones map[string]bool
+
+	templates map[string]*memoryTemplate
+
+	jobs map[string]*memoryJob
+
+	digestItems   map[string][]*DigestItem
+	digesting     map[string]bool
+	digestRetries map[string]*memoryDigestRetry
+
+	idempotency map[string]*memoryIdempotencyKey
+}
+
+var _ Store = (*Memory)(nil)
+
+type memoryJob struct {
+	api.EmailJob
+	request []byte
+}
+
+// memoryTemplate is every version of a template. Deleted templates keep
+// their versions, for jobs scheduled with them.
+type memoryTemplate struct {
+	versions []*EmailTemplate
+	created  time.Time
+	deleted  bool
+}
+
+// memoryDigestRetry is how an account's digest has been failing.
+type memoryDigestRetry struct {
+	attempts   int
+	lastError  string
+	retryAfter time.Time
+}
+
+type memoryIdempotencyKey struct {
+	IdempotentResponse
+	created time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		accounts:      map[string]*EmailAccount{},
+		byEmail:       map[string]string{},
+		tombstones:    map[string]bool{},
+		templates:     map[string]*memoryTemplate{},
+		jobs:          map[string]*memoryJob{},
+		digestItems:   map[string][]*DigestItem{},
+		digesting:     map[string]bool{},
+		digestRetries: map[string]*memoryDigestRetry{},
+		idempotency:   map[string]*memoryIdempotencyKey{},
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func copyAccount(e *EmailAccount) *EmailAccount {
+	c := *e
+	c.PubKey = ""
+	if e.QuietHours != nil {
+		qh := *e.QuietHours
+		c.QuietHours = &qh
+	}
+	return &c
+}
+
+func (mem *Memory) GetEmailAccount(id string) (*EmailAccount, error) {
+	if !uuidRegex.MatchString(id) {
+		return nil, ErrEmailAccountNotFound
+	}
+	id = strings.ToLower(id)
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if e := mem.accounts[id]; e != nil {
+		return copyAccount(e), nil
+	}
+	if mem.tombstones[id] {
+		return nil, ErrEmailAccountDeleted
+	}
+	return nil, ErrEmailAccountNotFound
+}
+
+func (mem *Memory) GetEmailAccounts(ids []string) ([]*EmailAccount, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	emailAccounts := []*EmailAccount{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !uuidRegex.MatchString(id) {
+			return nil, ErrEmailAccountNotFound
+		}
+		id = strings.ToLower(id)
+		if e := mem.accounts[id]; e != nil && !seen[id] {
+			seen[id] = true
+			emailAccounts = append(emailAccounts, copyAccount(e))
+		}
+	}
+	return emailAccounts, nil
+}
+
+func (mem *Memory) GetEmailAccountByEmail(email string) (*EmailAccount, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	id, ok := mem.byEmail[strings.ToLower(normalizeEmail(email))]
+	if !ok {
+		return nil, ErrEmailAccountNotFound
+	}
+	return copyAccount(mem.accounts[id]), nil
+}
+
+func (mem *Memory) SaveEmailAccount(e *EmailAccount) (created bool, err error) {
+	e.Email = normalizeEmail(e.Email)
+	if e.Status == "" {
+		e.Status = StatusActive
+	}
+	if e.DigestMode == "" {
+		e.DigestMode = api.DigestImmediate
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	key := strings.ToLower(e.Email)
+	if id, ok := mem.byEmail[key]; ok {
+		existing := mem.accounts[id]
+		e.Id, e.Email, e.Status, e.Created = existing.Id, existing.Email, existing.Status, existing.Created
+		return false, checkExistingPubKey(e)
+	}
+
+	if e.Id, err = newUUID(); err != nil {
+		return false, err
+	}
+	if err = importPubKeyFor(e.Email, e.PubKey); err != nil {
+		return false, err
+	}
+	e.Created = time.Now()
+	mem.accounts[e.Id] = copyAccount(e)
+	mem.byEmail[key] = e.Id
+	return true, nil
+}
+
+func (mem *Memory) UpdateEmailAccount(e *EmailAccount, u *AccountUpdate) error {
+	mem.mu.Lock()
+	id := strings.ToLower(e.Id)
+	stored := mem.accounts[id]
+	if stored == nil {
+		deleted := mem.tombstones[id]
+		mem.mu.Unlock()
+		if deleted {
+			return ErrEmailAccountDeleted
+		}
+		return ErrEmailAccountNotFound
+	}
+
+	updated := *copyAccount(stored)
+	changed := applyUpdate(&updated, u)
+	key := strings.ToLower(updated.Email)
+	if owner, ok := mem.byEmail[key]; ok && owner != stored.Id {
+		mem.mu.Unlock()
+		return ErrEmailAccountExists
+	}
+	if err := importPubKeyFor(updated.Email, u.PubKey); err != nil {
+		mem.mu.Unlock()
+		return err
+	}
+	oldEmail := stored.Email
+	delete(mem.byEmail, strings.ToLower(oldEmail))
+	mem.byEmail[key] = stored.Id
+	*stored = *copyAccount(&updated)
+	mem.mu.Unlock()
+
+	*e = updated
+	if changed {
+		return deletePubKey(oldEmail)
+	}
+	return nil
+}
+
+func (mem *Memory) DeleteEmailAccount(e *EmailAccount) error {
+	id := strings.ToLower(e.Id)
+
+	mem.mu.Lock()
+	if stored := mem.accounts[id]; stored != nil {
+		delete(mem.byEmail, strings.ToLower(stored.Email))
+		delete(mem.accounts, id)
+	}
+	delete(mem.digestItems, id)
+	delete(mem.digestRetries, id)
+	mem.tombstones[id] = true
+	mem.mu.Unlock()
+
+	return deletePubKey(e.Email)
+}
+
+// updateAccount applies update to the stored copy of e, if there is one,
+// and then to e.
+func (mem *Memory) updateAccount(e *EmailAccount, update func(e *EmailAccount)) {
+	mem.mu.Lock()
+	if stored := mem.accounts[strings.ToLower(e.Id)]; stored != nil {
+		update(stored)
+	}
+	mem.mu.Unlock()
+	update(e)
+}
+
+func (mem *Memory) MarkVerified(e *EmailAccount) error {
+	mem.updateAccount(e, func(e *EmailAccount) {
+		e.Status = StatusVerified
+	})
+	return nil
+}
+
+// Templates
+
+func (mem *Memory) GetEmailTemplate(name string) (*EmailTemplate, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	tmpl := mem.templates[name]
+	if tmpl == nil || tmpl.deleted {
+		return nil, ErrTemplateNotFound
+	}
+	return tmpl.version(len(tmpl.versions)), nil
+}
+
+// version returns a copy of the given version, with the template's
+// Created time.
+func (tmpl *memoryTemplate) version(version int) *EmailTemplate {
+	t := *tmpl.versions[version-1]
+	t.Created = tmpl.created
+	return &t
+}
+
+func (mem *Memory) GetEmailTemplates() ([]*EmailTemplate, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	names := make([]string, 0, len(mem.templates))
+	for name, tmpl := range mem.templates {
+		if !tmpl.deleted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	templates := []*EmailTemplate{}
+	for _, name := range names {
+		tmpl := mem.templates[name]
+		templates = append(templates, tmpl.version(len(tmpl.versions)))
+	}
+	return templates, nil
+}
+
+func (mem *Memory) GetEmailTemplateVersion(name string, version int) (*EmailTemplate, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	tmpl := mem.templates[name]
+	if tmpl == nil || version < 1 || version > len(tmpl.versions) {
+		return nil, ErrTemplateVersionNotFound
+	}
+	return tmpl.version(version), nil
+}
+
+func (mem *Memory) GetEmailTemplateVersions(name string) ([]*EmailTemplate, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	tmpl := mem.templates[name]
+	if tmpl == nil || tmpl.deleted {
+		return nil, ErrTemplateNotFound
+	}
+
+	copies := make([]*EmailTemplate, 0, len(tmpl.versions))
+	for version := 1; version <= len(tmpl.versions); version++ {
+		copies = append(copies, tmpl.version(version))
+	}
+	return copies, nil
+}
+
+func (mem *Memory) SaveEmailTemplate(t *EmailTemplate) (created bool, err error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	now := time.Now()
+	tmpl := mem.templates[t.Name]
+	if tmpl == nil {
+		tmpl = &memoryTemplate{}
+		mem.templates[t.Name] = tmpl
+	}
+	created = len(tmpl.versions) == 0 || tmpl.deleted
+	if created {
+		tmpl.created = now
+		tmpl.deleted = false
+	}
+	t.Version = len(tmpl.versions) + 1
+	t.Created, t.Updated = tmpl.created, now
+
+	// Each version keeps the time it was saved as both Created and
+	// Updated; the template's Created is kept separately
+	saved := *t
+	saved.Created = now
+	tmpl.versions = append(tmpl.versions, &saved)
+	return created, nil
+}
+
+func (mem *Memory) DeleteEmailTemplate(name string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	tmpl := mem.templates[name]
+	if tmpl == nil || tmpl.deleted {
+		return ErrTemplateNotFound
+	}
+	tmpl.deleted = true
+	return nil
+}
+
+// Jobs
+
+func copyJob(job *memoryJob) *api.EmailJob {
+	c := job.EmailJob
+	c.Request = append([]byte(nil), job.request...)
+	if job.Result != nil {
+		c.Result = append(json.RawMessage(nil), job.Result...)
+	}
+	return &c
+}
+
+func (mem *Memory) ScheduleEmailJob(kind, accountId string, req interface{}, sendAt time.Time) (*api.EmailJob, error) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &memoryJob{
+		EmailJob: api.EmailJob{
+			Id:        id,
+			Kind:      kind,
+			AccountId: strings.ToLower(accountId),
+			Status:    api.JobScheduled,
+			SendAt:    sendAt,
+			Created:   now,
+			Updated:   now,
+		},
+		request: request,
+	}
+
+	mem.mu.Lock()
+	mem.jobs[id] = job
+	mem.mu.Unlock()
+
+	return copyJob(job), nil
+}
+
+// GetEmailJob returns the job without its request, like Postgres does.
+func (mem *Memory) GetEmailJob(id string) (*api.EmailJob, error) {
+	if !uuidRegex.MatchString(id) {
+		return nil, ErrJobNotFound
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	job := mem.jobs[strings.ToLower(id)]
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	c := copyJob(job)
+	c.Request = nil
+	return c, nil
+}
+
+func (mem *Memory) CancelEmailJob(id string) error {
+	if !uuidRegex.MatchString(id) {
+		return ErrJobNotFound
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	job := mem.jobs[strings.ToLower(id)]
+	if job == nil {
+		return ErrJobNotFound
+	}
+	if job.Status != api.JobScheduled {
+		return ErrJobNotScheduled
+	}
+	job.Status = api.JobCancelled
+	job.Updated = time.Now()
+	return nil
+}
+
+func (mem *Memory) ClaimDueJobs(limit int) ([]*api.EmailJob, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	now := time.Now()
+	due := []*memoryJob{}
+	for _, job := range mem.jobs {
+		if job.Status == api.JobScheduled && !job.SendAt.After(now) {
+			due = append(due, job)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].SendAt.Before(due[j].SendAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	jobs := []*api.EmailJob{}
+	for _, job := range due {
+		job.Status = api.JobDispatching
+		job.Updated = now
+		jobs = append(jobs, copyJob(job))
+	}
+	return jobs, nil
+}
+
+func (mem *Memory) FinishEmailJob(id, status string, result []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if job := mem.jobs[strings.ToLower(id)]; job != nil {
+		job.Status = status
+		job.Result = append(json.RawMessage(nil), result...)
+		if result == nil {
+			job.Result = nil
+		}
+		job.Updated = time.Now()
+	}
+	return nil
+}
+
+func (mem *Memory) RenewJobLease(id string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if job := mem.jobs[strings.ToLower(id)]; job != nil && job.Status == api.JobDispatching {
+		job.Updated = time.Now()
+	}
+	return nil
+}
+
+func (mem *Memory) FailInterruptedJobs(leaseTimeout time.Duration) (int64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	var n int64
+	cutoff := time.Now().Add(-leaseTimeout)
+	for _, job := range mem.jobs {
+		if job.Status == api.JobDispatching && job.Updated.Before(cutoff) {
+			job.Status = api.JobFailed
+			job.Result = json.RawMessage(`{"error": "interrupted while dispatching"}`)
+			job.Updated = time.Now()
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Digests
+
+func (mem *Memory) QueueDigestItem(e *EmailAccount, emailData api.EmailData, secureOnly bool) error {
+	emailData.Template, emailData.TemplateVersion, emailData.Vars = "", 0, nil
+
+	// Round-trip through JSON so the item doesn't share anything with
+	// the caller's request
+	data, err := json.Marshal(emailData)
+	if err != nil {
+		return err
+	}
+	item := &DigestItem{SecureOnly: secureOnly, Created: time.Now()}
+	if err = json.Unmarshal(data, &item.EmailData); err != nil {
+		return err
+	}
+
+	id := strings.ToLower(e.Id)
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.accounts[id] == nil {
+		return ErrEmailAccountNotFound
+	}
+	mem.digestItems[id] = append(mem.digestItems[id], item)
+	return nil
+}
+
+func (mem *Memory) DueDigests() ([]string, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	now := time.Now()
+	ids := []string{}
+	for id, items := range mem.digestItems {
+		if len(items) == 0 || mem.digesting[id] {
+			continue
+		}
+		if retry := mem.digestRetries[id]; retry != nil && retry.retryAfter.After(now) {
+			continue
+		}
+		var interval time.Duration
+		switch mem.accounts[id].DigestMode {
+		case api.DigestHourly:
+			interval = time.Hour
+		case api.DigestDaily:
+			interval = 24 * time.Hour
+		}
+		if !items[0].Created.After(now.Add(-interval)) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (mem *Memory) ClaimDigestItems(accountId string, send func(items []*DigestItem) error) error {
+	id := strings.ToLower(accountId)
+
+	mem.mu.Lock()
+	if mem.digesting[id] {
+		mem.mu.Unlock()
+		return send([]*DigestItem{})
+	}
+	items := mem.digestItems[id]
+	delete(mem.digestItems, id)
+	mem.digesting[id] = true
+	mem.mu.Unlock()
+
+	err := send(append([]*DigestItem(nil), items...))
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	delete(mem.digesting, id)
+	if mem.accounts[id] == nil {
+		return err
+	}
+	if err == nil {
+		if len(items) > 0 {
+			delete(mem.digestRetries, id)
+		}
+		return nil
+	}
+
+	retry := mem.digestRetries[id]
+	if retry == nil {
+		retry = &memoryDigestRetry{}
+		mem.digestRetries[id] = retry
+	}
+	retry.attempts++
+	retry.lastError = err.Error()
+	retry.retryAfter = time.Now().Add(digestRetryDelay(retry.attempts))
+	if giveUpOnDigest(retry.attempts, err) {
+		log.Errorf("Dropping %d digest items for %s after %d failed attempts. Err: %s",
+			len(items), id, retry.attempts, err)
+		delete(mem.digestRetries, id)
+		return err
+	}
+	// Put them back in front of anything queued meanwhile
+	mem.digestItems[id] = append(items, mem.digestItems[id]...)
+	return err
+}
+
+// Idempotency keys
+
+func (mem *Memory) ExpireIdempotencyKeys() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	cutoff := time.Now().Add(-24 * time.Hour)
+	for k, v := range mem.idempotency {
+		if v.created.Before(cutoff) {
+			delete(mem.idempotency, k)
+		}
+	}
+	return nil
+}
+
+func idempotencyMapKey(key, route string) string {
+	return route + "\x00" + key
+}
+
+func (mem *Memory) ClaimIdempotencyKey(key, route string, requestHash []byte) (bool, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	k := idempotencyMapKey(key, route)
+	if stored, ok := mem.idempotency[k]; ok &&
+		(stored.Status != 0 || time.Since(stored.created) < idempotencyClaimTimeout) {
+		return false, nil
+	}
+	mem.idempotency[k] = &memoryIdempotencyKey{
+		IdempotentResponse: IdempotentResponse{RequestHash: append([]byte(nil), requestHash...)},
+		created:            time.Now(),
+	}
+	return true, nil
+}
+
+func (mem *Memory) ForgetIdempotencyKey(key, route string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	delete(mem.idempotency, idempotencyMapKey(key, route))
+	return nil
+}
+
+func (mem *Memory) SaveIdempotentResponse(key, route string, status int, contentType string, body []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if stored := mem.idempotency[idempotencyMapKey(key, route)]; stored != nil {
+		stored.Status = status
+		stored.ContentType = contentType
+		stored.Body = append([]byte(nil), body...)
+	}
+	return nil
+}
+
+func (mem *Memory) GetIdempotentResponse(key, route string) (*IdempotentResponse, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	stored := mem.idempotency[idempotencyMapKey(key, route)]
+	if stored == nil {
+		return nil, sql.ErrNoRows
+	}
+	resp := stored.IdempotentResponse
+	return &resp, nil
+}
+
+func (mem *Memory) QueueDepth() (jobs, digestItems int64, err error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for _, job := range mem.jobs {
+		if job.Status == api.JobScheduled {
+			jobs++
+		}
+	}
+	for _, items := range mem.digestItems {
+		digestItems += int64(len(items))
+	}
+	return jobs, digestItems, nil
+}
@@ -0,0 +1,249 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	"github.com/PursuanceProject/pursuemail/crypto"
+)
+
+// The tests below check behavior both stores must share. TestMemory runs
+// them against Memory, and TestPostgres against a real database when
+// there is one.
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func testStore(t *testing.T, st Store) {
+	dir := t.TempDir()
+	pubring, secring := crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME
+	crypto.PUBLIC_KEYRING_FILENAME = filepath.Join(dir, "pubring.gpg")
+	crypto.PRIVATE_KEYRING_FILENAME = filepath.Join(dir, "secring.gpg")
+	t.Cleanup(func() {
+		crypto.PUBLIC_KEYRING_FILENAME, crypto.PRIVATE_KEYRING_FILENAME = pubring, secring
+	})
+
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, st) })
+	t.Run("Templates", func(t *testing.T) { testTemplates(t, st) })
+	t.Run("Jobs", func(t *testing.T) { testJobs(t, st) })
+	t.Run("Idempotency", func(t *testing.T) { testIdempotency(t, st) })
+}
+
+func testAccounts(t *testing.T, st Store) {
+	const unknownId = "00000000-0000-4000-8000-000000000000"
+
+	account := &EmailAccount{Email: " Someone@Example.com "}
+	created, err := st.SaveEmailAccount(account)
+	if err != nil || !created {
+		t.Fatalf("SaveEmailAccount = %v, %v", created, err)
+	}
+	if account.Email != "Someone@Example.com" || account.Status != StatusActive || account.DigestMode != api.DigestImmediate {
+		t.Errorf("Saved account %+v", account)
+	}
+
+	again := &EmailAccount{Email: "someone@example.com"}
+	if created, err := st.SaveEmailAccount(again); err != nil || created || again.Id != account.Id || again.Email != account.Email {
+		t.Errorf("Saving the address in another case = %v, %v, %+v", created, err, again)
+	}
+	if found, err := st.GetEmailAccountByEmail("SOMEONE@example.COM"); err != nil || found.Id != account.Id {
+		t.Errorf("GetEmailAccountByEmail = %+v, %v", found, err)
+	}
+
+	other := &EmailAccount{Email: "other@example.com"}
+	if _, err := st.SaveEmailAccount(other); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := st.GetEmailAccounts([]string{account.Id, other.Id, account.Id, unknownId})
+	if err != nil || len(accounts) != 2 {
+		t.Errorf("GetEmailAccounts = %d accounts, %v, want 2", len(accounts), err)
+	}
+
+	err = st.UpdateEmailAccount(account, &AccountUpdate{DigestMode: api.DigestDaily})
+	if err != nil || account.DigestMode != api.DigestDaily {
+		t.Errorf("UpdateEmailAccount = %v, digest mode %q", err, account.DigestMode)
+	}
+	if found, err := st.GetEmailAccount(account.Id); err != nil || found.DigestMode != api.DigestDaily {
+		t.Errorf("Updated account = %+v, %v", found, err)
+	}
+	if err := st.UpdateEmailAccount(account, &AccountUpdate{Email: "OTHER@example.com"}); err != ErrEmailAccountExists {
+		t.Errorf("Taking another account's address: err = %v, want %v", err, ErrEmailAccountExists)
+	}
+	if err := st.UpdateEmailAccount(account, &AccountUpdate{Email: "moved@example.com", Verify: true}); err != nil || account.Status != StatusPending {
+		t.Errorf("Changing address = %v, status %q", err, account.Status)
+	}
+	if _, err := st.GetEmailAccountByEmail("someone@example.com"); err != ErrEmailAccountNotFound {
+		t.Errorf("Old address lookup: err = %v, want %v", err, ErrEmailAccountNotFound)
+	}
+
+	if err := st.MarkVerified(account); err != nil || account.Status != StatusVerified {
+		t.Errorf("MarkVerified = %v, status %q", err, account.Status)
+	}
+	if found, err := st.GetEmailAccount(account.Id); err != nil || found.Status != StatusVerified {
+		t.Errorf("Verified account = %+v, %v", found, err)
+	}
+
+	if err := st.DeleteEmailAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetEmailAccount(account.Id); err != ErrEmailAccountDeleted {
+		t.Errorf("Deleted account: err = %v, want %v", err, ErrEmailAccountDeleted)
+	}
+	if err := st.UpdateEmailAccount(account, &AccountUpdate{DigestMode: api.DigestHourly}); err != ErrEmailAccountDeleted {
+		t.Errorf("Updating a deleted account: err = %v, want %v", err, ErrEmailAccountDeleted)
+	}
+	if _, err := st.GetEmailAccountByEmail("moved@example.com"); err != ErrEmailAccountNotFound {
+		t.Errorf("Deleted address lookup: err = %v, want %v", err, ErrEmailAccountNotFound)
+	}
+	for _, id := range []string{unknownId, "not-a-uuid"} {
+		if _, err := st.GetEmailAccount(id); err != ErrEmailAccountNotFound {
+			t.Errorf("GetEmailAccount(%q): err = %v, want %v", id, err, ErrEmailAccountNotFound)
+		}
+	}
+}
+
+func testTemplates(t *testing.T, st Store) {
+	save := func(subject string) (*EmailTemplate, bool) {
+		t.Helper()
+		tmpl := &EmailTemplate{Name: "welcome", Subject: subject, Text: "Hello {{.Name}}"}
+		created, err := st.SaveEmailTemplate(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tmpl, created
+	}
+
+	if tmpl, created := save("Welcome"); !created || tmpl.Version != 1 {
+		t.Errorf("First save = version %d, created %v", tmpl.Version, created)
+	}
+	if tmpl, created := save("Welcome!"); created || tmpl.Version != 2 {
+		t.Errorf("Second save = version %d, created %v", tmpl.Version, created)
+	}
+	if tmpl, err := st.GetEmailTemplate("welcome"); err != nil || tmpl.Version != 2 || tmpl.Subject != "Welcome!" {
+		t.Errorf("GetEmailTemplate = %+v, %v", tmpl, err)
+	}
+	if templates, err := st.GetEmailTemplates(); err != nil || len(templates) != 1 || templates[0].Name != "welcome" {
+		t.Errorf("GetEmailTemplates = %v, %v", templates, err)
+	}
+	if versions, err := st.GetEmailTemplateVersions("welcome"); err != nil || len(versions) != 2 || versions[0].Subject != "Welcome" {
+		t.Errorf("GetEmailTemplateVersions = %v, %v", versions, err)
+	}
+
+	if err := st.DeleteEmailTemplate("welcome"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteEmailTemplate("welcome"); err != ErrTemplateNotFound {
+		t.Errorf("Deleting twice: err = %v, want %v", err, ErrTemplateNotFound)
+	}
+	if _, err := st.GetEmailTemplate("welcome"); err != ErrTemplateNotFound {
+		t.Errorf("Deleted template: err = %v, want %v", err, ErrTemplateNotFound)
+	}
+	if _, err := st.GetEmailTemplateVersions("welcome"); err != ErrTemplateNotFound {
+		t.Errorf("Deleted template's versions: err = %v, want %v", err, ErrTemplateNotFound)
+	}
+	// Jobs scheduled with a version still need it
+	if tmpl, err := st.GetEmailTemplateVersion("welcome", 1); err != nil || tmpl.Subject != "Welcome" {
+		t.Errorf("Deleted template's version 1 = %+v, %v", tmpl, err)
+	}
+	if _, err := st.GetEmailTemplateVersion("welcome", 3); err != ErrTemplateVersionNotFound {
+		t.Errorf("Missing version: err = %v, want %v", err, ErrTemplateVersionNotFound)
+	}
+
+	if tmpl, created := save("Welcome back"); !created || tmpl.Version != 3 {
+		t.Errorf("Saving a deleted template = version %d, created %v", tmpl.Version, created)
+	}
+}
+
+func testJobs(t *testing.T, st Store) {
+	req := api.SendBulkEmailRequest{Emails: []string{"someone@example.com"}}
+	due, err := st.ScheduleEmailJob(api.JobKindBulkSend, "", req, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := st.ScheduleEmailJob(api.JobKindBulkSend, "", req, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := st.GetEmailJob(due.Id); err != nil || job.Status != api.JobScheduled || job.Kind != api.JobKindBulkSend {
+		t.Errorf("GetEmailJob = %+v, %v", job, err)
+	}
+
+	if err := st.CancelEmailJob(later.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CancelEmailJob(later.Id); err != ErrJobNotScheduled {
+		t.Errorf("Cancelling twice: err = %v, want %v", err, ErrJobNotScheduled)
+	}
+
+	jobs, err := st.ClaimDueJobs(10)
+	if err != nil || len(jobs) != 1 || jobs[0].Id != due.Id || jobs[0].Status != api.JobDispatching {
+		t.Fatalf("ClaimDueJobs = %v, %v", jobs, err)
+	}
+	var claimed api.SendBulkEmailRequest
+	if err := json.Unmarshal(jobs[0].Request, &claimed); err != nil || len(claimed.Emails) != 1 {
+		t.Errorf("Claimed request %s, %v", jobs[0].Request, err)
+	}
+	if jobs, err := st.ClaimDueJobs(10); err != nil || len(jobs) != 0 {
+		t.Errorf("Claimed %d jobs again, %v", len(jobs), err)
+	}
+	if err := st.CancelEmailJob(due.Id); err != ErrJobNotScheduled {
+		t.Errorf("Cancelling a claimed job: err = %v, want %v", err, ErrJobNotScheduled)
+	}
+
+	if err := st.FinishEmailJob(due.Id, api.JobSent, []byte(`{"sent": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if job, err := st.GetEmailJob(due.Id); err != nil || job.Status != api.JobSent || len(job.Result) == 0 {
+		t.Errorf("Finished job = %+v, %v", job, err)
+	}
+
+	for _, id := range []string{"00000000-0000-4000-8000-000000000000", "not-a-uuid"} {
+		if _, err := st.GetEmailJob(id); err != ErrJobNotFound {
+			t.Errorf("GetEmailJob(%q): err = %v, want %v", id, err, ErrJobNotFound)
+		}
+		if err := st.CancelEmailJob(id); err != ErrJobNotFound {
+			t.Errorf("CancelEmailJob(%q): err = %v, want %v", id, err, ErrJobNotFound)
+		}
+	}
+}
+
+func testIdempotency(t *testing.T, st Store) {
+	const route = "POST /api/v1/email"
+	claim := func() bool {
+		t.Helper()
+		claimed, err := st.ClaimIdempotencyKey("key", route, []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claimed
+	}
+
+	if _, err := st.GetIdempotentResponse("key", route); err != sql.ErrNoRows {
+		t.Errorf("Unknown key: err = %v, want %v", err, sql.ErrNoRows)
+	}
+	if !claim() || claim() {
+		t.Fatal("A new key should be claimed once")
+	}
+	if resp, err := st.GetIdempotentResponse("key", route); err != nil || resp.Status != 0 || string(resp.RequestHash) != "hash" {
+		t.Errorf("Response in progress = %+v, %v", resp, err)
+	}
+
+	if err := st.SaveIdempotentResponse("key", route, 201, "application/json", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := st.GetIdempotentResponse("key", route)
+	if err != nil || resp.Status != 201 || resp.ContentType != "application/json" || string(resp.Body) != `{}` {
+		t.Errorf("Saved response = %+v, %v", resp, err)
+	}
+
+	if err := st.ForgetIdempotencyKey("key", route); err != nil {
+		t.Fatal(err)
+	}
+	if !claim() {
+		t.Error("A forgotten key couldn't be claimed")
+	}
+}
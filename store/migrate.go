@@ -0,0 +1,283 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Schema migrations live in migrations/ as NNNN_name.up.sql and
+// NNNN_name.down.sql. Applied versions are recorded in schema_migrations.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Key of the advisory lock held while migrating, so instances starting
+// at the same time don't run the same migration twice
+const migrationLockKey = 0x70757273 // "purs"
+
+// Migration is one versioned change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it has been.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied *time.Time
+}
+
+// Migrations returns the embedded migrations, oldest first.
+func Migrations() ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("Badly named migration %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("Migrations %s and %s share version %d", m.Name, match[2], version)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("Migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock,
+// after making sure schema_migrations exists.
+func (pg *Postgres) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := pg.db.Conn(ctx)
+	if err != nil {
+		log.Errorf("Error getting connection for migrations. Err: %s", err)
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		log.Errorf("Error taking migration lock. Err: %s", err)
+		return err
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		if err != nil {
+			log.Errorf("Error releasing migration lock. Err: %s", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version  integer   NOT NULL PRIMARY KEY,
+			name     text      NOT NULL,
+			applied  timestamp WITH time zone NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		log.Errorf("Error creating schema_migrations. Err: %s", err)
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied FROM schema_migrations`)
+	if err != nil {
+		log.Errorf("Error getting schema_migrations. Err: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			log.Errorf("Error with scan. Err: %v", err)
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// runMigration runs m up or down and records it in schema_migrations, in
+// one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, m *Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Errorf("Error beginning transaction. Err: %s", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err = tx.ExecContext(ctx, m.Up); err == nil {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+			`, m.Version, m.Name)
+		}
+	} else {
+		if _, err = tx.ExecContext(ctx, m.Down); err == nil {
+			_, err = tx.ExecContext(ctx, `
+				DELETE FROM schema_migrations WHERE version = $1
+			`, m.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Migration %04d_%s failed: %v", m.Version, m.Name, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Errorf("Error committing transaction. Err: %s", err)
+		return err
+	}
+	return nil
+}
+
+// Migrate applies every migration that hasn't been applied yet, oldest
+// first, and returns how many it applied. The migrations before
+// schema_migrations existed are safe to re-run, so databases set up with
+// the old scripts are brought up to date too.
+func (pg *Postgres) Migrate(ctx context.Context) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = pg.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		warnUnknownMigrations(migrations, applied)
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			log.Infof("Applying migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first,
+// and returns how many it reverted.
+func (pg *Postgres) MigrateDown(ctx context.Context, steps int) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = pg.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		warnUnknownMigrations(migrations, applied)
+
+		for i := len(migrations) - 1; i >= 0 && n < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			log.Infof("Reverting migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MigrationStatus lists every migration and when it was applied.
+func (pg *Postgres) MigrationStatus(ctx context.Context) ([]*MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []*MigrationStatus{}
+	err = pg.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		warnUnknownMigrations(migrations, applied)
+
+		for _, m := range migrations {
+			status := &MigrationStatus{Version: m.Version, Name: m.Name}
+			if at, ok := applied[m.Version]; ok {
+				status.Applied = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// warnUnknownMigrations logs applied migrations this build doesn't know
+// about, which happens when running an older build against a newer
+// schema.
+func warnUnknownMigrations(migrations []*Migration, applied map[int]time.Time) {
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			log.Warnf("Database has migration %04d applied, which this build doesn't know about", version)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS email_account_tombstone (
+  id          uuid      NOT NULL PRIMARY KEY,
+  deleted     timestamp WITH time zone DEFAULT now()
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS email_account_lower_email_key;
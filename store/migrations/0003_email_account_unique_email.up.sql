@@ -0,0 +1,20 @@
+/* Addresses must be unique ignoring case. Rather than pick which of
+   several accounts with the same address survives, refuse to migrate
+   and list them, so an operator can merge or delete them and tell
+   callers which ID to use. */
+DO $$
+DECLARE
+  duplicates text;
+BEGIN
+  SELECT string_agg(ids, '; ') INTO duplicates FROM (
+    SELECT lower(email) AS email, string_agg(id::text, ', ' ORDER BY created, id) AS ids
+    FROM email_account
+    GROUP BY lower(email)
+    HAVING count(*) > 1
+  ) d;
+  IF duplicates IS NOT NULL THEN
+    RAISE EXCEPTION 'email_account has several accounts for the same address (IDs, oldest first: %). Delete all but one of each before migrating', duplicates;
+  END IF;
+END
+$$;
+CREATE UNIQUE INDEX IF NOT EXISTS email_account_lower_email_key ON email_account (lower(email));
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS idempotency_key (
+  key           text      NOT NULL,
+  route         text      NOT NULL,
+  request_hash  bytea     NOT NULL,
+  status        integer,  /* NULL while the first request is in flight */
+  content_type  text,
+  response      bytea,
+  created       timestamp WITH time zone DEFAULT now(),
+  PRIMARY KEY (key, route)
+);
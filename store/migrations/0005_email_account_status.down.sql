@@ -0,0 +1,2 @@
+ALTER TABLE email_account DROP COLUMN IF EXISTS verified;
+ALTER TABLE email_account DROP COLUMN IF EXISTS status;
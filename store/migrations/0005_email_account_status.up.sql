@@ -0,0 +1,4 @@
+/* 'active' accounts were created without address verification */
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'
+  CHECK (status IN ('active', 'pending', 'verified'));
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS verified timestamp WITH time zone;
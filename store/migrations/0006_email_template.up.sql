@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS email_template (
+  name        text      NOT NULL PRIMARY KEY,
+  subject     text      NOT NULL DEFAULT '',
+  text_body   text      NOT NULL DEFAULT '',
+  html_body   text      NOT NULL DEFAULT '',
+  created     timestamp WITH time zone DEFAULT now(),
+  updated     timestamp WITH time zone DEFAULT now()
+);
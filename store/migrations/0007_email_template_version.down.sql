@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS email_template_version;
+ALTER TABLE email_template DROP COLUMN IF EXISTS version;
@@ -0,0 +1,15 @@
+/* Every edit of a template is kept as an immutable version. The
+   email_template row holds a copy of the current one. */
+CREATE TABLE IF NOT EXISTS email_template_version (
+  name        text      NOT NULL REFERENCES email_template(name) ON DELETE CASCADE,
+  version     integer   NOT NULL,
+  subject     text      NOT NULL DEFAULT '',
+  text_body   text      NOT NULL DEFAULT '',
+  html_body   text      NOT NULL DEFAULT '',
+  created     timestamp WITH time zone DEFAULT now(),
+  PRIMARY KEY (name, version)
+);
+ALTER TABLE email_template ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+INSERT INTO email_template_version(name, version, subject, text_body, html_body, created)
+  SELECT name, version, subject, text_body, html_body, updated FROM email_template
+  ON CONFLICT DO NOTHING;
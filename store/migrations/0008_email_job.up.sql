@@ -0,0 +1,15 @@
+/* Sends scheduled for later. request holds the JSON send request; result
+   what happened once the scheduler ran it. */
+CREATE TABLE IF NOT EXISTS email_job (
+  id          uuid      PRIMARY KEY DEFAULT uuid_generate_v4(),
+  kind        text      NOT NULL CHECK (kind IN ('send', 'bulksend')),
+  account_id  uuid,
+  request     jsonb     NOT NULL,
+  status      text      NOT NULL DEFAULT 'scheduled'
+    CHECK (status IN ('scheduled', 'dispatching', 'sent', 'failed', 'cancelled')),
+  send_at     timestamp WITH time zone NOT NULL,
+  result      jsonb,
+  created     timestamp WITH time zone DEFAULT now(),
+  updated     timestamp WITH time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS email_job_due_idx ON email_job (send_at) WHERE status = 'scheduled';
@@ -0,0 +1,3 @@
+ALTER TABLE email_account DROP COLUMN IF EXISTS quiet_end;
+ALTER TABLE email_account DROP COLUMN IF EXISTS quiet_start;
+ALTER TABLE email_account DROP COLUMN IF EXISTS timezone;
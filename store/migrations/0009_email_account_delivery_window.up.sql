@@ -0,0 +1,6 @@
+/* Optional IANA timezone (e.g. 'America/New_York') and daily quiet hours,
+   in that timezone, during which bulk sends may be held back. UTC is
+   assumed when timezone is NULL. */
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS timezone text;
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS quiet_start time;
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS quiet_end time;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS digest_item;
+ALTER TABLE email_account DROP COLUMN IF EXISTS digest_mode;
@@ -0,0 +1,12 @@
+/* Accounts not in 'immediate' mode get non-urgent emails collected as
+   digest_items and sent as one combined email per hour or day. */
+ALTER TABLE email_account ADD COLUMN IF NOT EXISTS digest_mode text NOT NULL DEFAULT 'immediate'
+  CHECK (digest_mode IN ('immediate', 'hourly', 'daily'));
+CREATE TABLE IF NOT EXISTS digest_item (
+  id          uuid      PRIMARY KEY DEFAULT uuid_generate_v4(),
+  account_id  uuid      NOT NULL REFERENCES email_account(id) ON DELETE CASCADE,
+  email_data  jsonb     NOT NULL,
+  secure_only boolean   NOT NULL DEFAULT false,
+  created     timestamp WITH time zone DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS digest_item_account_idx ON digest_item (account_id, created);
@@ -0,0 +1,10 @@
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'pursuemail_runtime') THEN
+    ALTER DEFAULT PRIVILEGES IN SCHEMA public
+      REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM pursuemail_runtime;
+    REVOKE ALL ON ALL TABLES IN SCHEMA public FROM pursuemail_runtime;
+    REVOKE USAGE ON SCHEMA public FROM pursuemail_runtime;
+  END IF;
+END
+$$;
@@ -0,0 +1,17 @@
+/* The service connects as a member of pursuemail_runtime (see
+   db/sql/pre.sql), which can read and write rows but not change the
+   schema. Tables added by later migrations get the same grants.
+   Databases without the role, like throwaway CI and dev ones, are left
+   as they are. */
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'pursuemail_runtime') THEN
+    GRANT USAGE ON SCHEMA public TO pursuemail_runtime;
+    GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO pursuemail_runtime;
+    REVOKE ALL ON schema_migrations FROM pursuemail_runtime;
+    GRANT SELECT ON schema_migrations TO pursuemail_runtime;
+    ALTER DEFAULT PRIVILEGES IN SCHEMA public
+      GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO pursuemail_runtime;
+  END IF;
+END
+$$;
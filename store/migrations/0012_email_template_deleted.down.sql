@@ -0,0 +1,2 @@
+DELETE FROM email_template WHERE deleted IS NOT NULL;
+ALTER TABLE email_template DROP COLUMN IF EXISTS deleted;
@@ -0,0 +1,3 @@
+/* Deleted templates are marked rather than removed, so their versions
+   stay available to jobs scheduled with them. */
+ALTER TABLE email_template ADD COLUMN IF NOT EXISTS deleted timestamp WITH time zone;
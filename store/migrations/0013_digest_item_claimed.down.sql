@@ -0,0 +1 @@
+ALTER TABLE digest_item DROP COLUMN IF EXISTS claimed;
@@ -0,0 +1,3 @@
+/* Set while an instance is sending the item, so the claim doesn't hold
+   a transaction open across SMTP delivery. */
+ALTER TABLE digest_item ADD COLUMN IF NOT EXISTS claimed timestamp WITH time zone;
@@ -0,0 +1,8 @@
+/* Failed digests are retried with a growing delay, and their items are
+   dropped after too many failures in a row. */
+CREATE TABLE IF NOT EXISTS digest_retry (
+  account_id  uuid      PRIMARY KEY REFERENCES email_account(id) ON DELETE CASCADE,
+  attempts    integer   NOT NULL,
+  last_error  text      NOT NULL,
+  retry_after timestamp WITH time zone NOT NULL
+);
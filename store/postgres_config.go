@@ -0,0 +1,154 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SSLDisable    = "disable"
+	SSLRequire    = "require"
+	SSLVerifyCA   = "verify-ca"
+	SSLVerifyFull = "verify-full"
+)
+
+// PostgresConfig says how to connect to Postgres. DSN, a postgres:// URL
+// or key=value connection string, replaces the connection settings below
+// it if set; the pool limits apply either way.
+type PostgresConfig struct {
+	DSN string
+
+	// Host can also be the directory of a Unix socket
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Database string
+
+	// SSLMode is one of disable, require, verify-ca or verify-full.
+	// SSLRootCert is the CA file the server's certificate is checked
+	// against (the system's CAs if empty); SSLCert and SSLKey are a client
+	// certificate to present.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// Zero means no limit, except for MaxIdleConns, where it means
+	// database/sql's default of 2
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (cfg *PostgresConfig) Validate() error {
+	if cfg.MaxOpenConns < 0 || cfg.MaxIdleConns < 0 {
+		return fmt.Errorf("Postgres connection limits can't be negative")
+	}
+	if cfg.ConnMaxLifetime < 0 || cfg.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("Postgres connection lifetimes can't be negative")
+	}
+	if cfg.DSN != "" {
+		return nil
+	}
+
+	switch cfg.SSLMode {
+	case SSLDisable, SSLRequire, SSLVerifyCA, SSLVerifyFull:
+	case "allow", "prefer":
+		return fmt.Errorf("Postgres sslmode %q isn't supported by the driver; use %s, %s, %s or %s",
+			cfg.SSLMode, SSLDisable, SSLRequire, SSLVerifyCA, SSLVerifyFull)
+	default:
+		return fmt.Errorf("Unknown Postgres sslmode %q", cfg.SSLMode)
+	}
+	if (cfg.SSLCert == "") != (cfg.SSLKey == "") {
+		return fmt.Errorf("A Postgres client certificate needs both a cert and a key file")
+	}
+	return nil
+}
+
+// ConnString returns DSN if it's set, and otherwise a key=value
+// connection string built from the other settings.
+func (cfg *PostgresConfig) ConnString() string {
+	if cfg.DSN != "" {
+		return cfg.DSN
+	}
+
+	settings := map[string]string{
+		"host":        cfg.Host,
+		"port":        cfg.Port,
+		"user":        cfg.User,
+		"password":    cfg.Password,
+		"dbname":      cfg.Database,
+		"sslmode":     cfg.SSLMode,
+		"sslrootcert": cfg.SSLRootCert,
+		"sslcert":     cfg.SSLCert,
+		"sslkey":      cfg.SSLKey,
+	}
+	keys := make([]string, 0, len(settings))
+	for key, value := range settings {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+quoteConnValue(settings[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteConnValue quotes a value for a key=value connection string, so
+// spaces, quotes and backslashes in it (in a password, say) survive.
+func quoteConnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+var connPasswordRegex = regexp.MustCompile(`password\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactConnString returns a connection string with its password hidden,
+// for logging.
+func RedactConnString(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		query := u.Query()
+		if query.Get("password") != "" {
+			query.Set("password", "xxxxx")
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	}
+	return connPasswordRegex.ReplaceAllString(dsn, "password=xxxxx")
+}
+
+// OpenPostgres connects to the database cfg describes, with its pool
+// limits, and checks that it can be reached.
+func OpenPostgres(cfg *PostgresConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// TestPostgres runs the tests in memory_test.go against the database
+// PURSUEMAIL_TEST_DATABASE_URL points to, emptying its tables first, so
+// never point it at a database whose data you want. It's skipped if the
+// variable isn't set.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("PURSUEMAIL_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("PURSUEMAIL_TEST_DATABASE_URL isn't set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pg := NewPostgres(db)
+	if _, err := pg.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		TRUNCATE email_account, email_account_tombstone, idempotency_key,
+			email_template, email_template_version, email_job, digest_item,
+			digest_retry
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, pg)
+}
@@ -0,0 +1,156 @@
+// Package store keeps PursueMail's accounts, templates, scheduled jobs,
+// digest items and idempotency keys. Postgres keeps them in a database;
+// Memory keeps them in memory, for small deployments and tests.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PursuanceProject/pursuemail/api"
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+)
+
+// AccountStore keeps email accounts. Addresses are unique ignoring case,
+// and deleted accounts' IDs are remembered so lookups can tell them from
+// IDs that never existed.
+type AccountStore interface {
+	GetEmailAccount(id string) (*EmailAccount, error)
+	GetEmailAccounts(ids []string) ([]*EmailAccount, error)
+	GetEmailAccountByEmail(email string) (*EmailAccount, error)
+	SaveEmailAccount(e *EmailAccount) (created bool, err error)
+	UpdateEmailAccount(e *EmailAccount, u *AccountUpdate) error
+	DeleteEmailAccount(e *EmailAccount) error
+	MarkVerified(e *EmailAccount) error
+}
+
+// TemplateStore keeps email templates and every version of them.
+type TemplateStore interface {
+	GetEmailTemplate(name string) (*EmailTemplate, error)
+	GetEmailTemplates() ([]*EmailTemplate, error)
+	GetEmailTemplateVersion(name string, version int) (*EmailTemplate, error)
+	GetEmailTemplateVersions(name string) ([]*EmailTemplate, error)
+	SaveEmailTemplate(t *EmailTemplate) (created bool, err error)
+	DeleteEmailTemplate(name string) error
+}
+
+// JobStore keeps scheduled sends.
+type JobStore interface {
+	ScheduleEmailJob(kind, accountId string, req interface{}, sendAt time.Time) (*api.EmailJob, error)
+	GetEmailJob(id string) (*api.EmailJob, error)
+	CancelEmailJob(id string) error
+	ClaimDueJobs(limit int) ([]*api.EmailJob, error)
+	FinishEmailJob(id, status string, result []byte) error
+	RenewJobLease(id string) error
+	FailInterruptedJobs(leaseTimeout time.Duration) (int64, error)
+}
+
+// DigestStore keeps email waiting to go out in digests.
+type DigestStore interface {
+	QueueDigestItem(e *EmailAccount, emailData api.EmailData, secureOnly bool) error
+	DueDigests() ([]string, error)
+	ClaimDigestItems(accountId string, send func(items []*DigestItem) error) error
+}
+
+// IdempotencyStore keeps the responses to requests made with an
+// Idempotency-Key.
+type IdempotencyStore interface {
+	ExpireIdempotencyKeys() error
+	ClaimIdempotencyKey(key, route string, requestHash []byte) (bool, error)
+	ForgetIdempotencyKey(key, route string) error
+	SaveIdempotentResponse(key, route string, status int, contentType string, body []byte) error
+	GetIdempotentResponse(key, route string) (*IdempotentResponse, error)
+}
+
+// Store is everything PursueMail keeps.
+type Store interface {
+	AccountStore
+	TemplateStore
+	JobStore
+	DigestStore
+	IdempotencyStore
+
+	// QueueDepth counts the emails waiting to be sent: scheduled jobs
+	// and undelivered digest items.
+	QueueDepth() (jobs, digestItems int64, err error)
+}
+
+// Postgres is a Store backed by a Postgres database. Migrate sets up its
+// schema.
+type Postgres struct {
+	db *sql.DB
+}
+
+var _ Store = (*Postgres)(nil)
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+// DB returns the underlying database handle.
+func (pg *Postgres) DB() *sql.DB {
+	return pg.db
+}
+
+// Ping checks that the database can be reached.
+func (pg *Postgres) Ping(ctx context.Context) error {
+	return pg.db.PingContext(ctx)
+}
+
+// CheckRuntimeRole returns an error if the role pg is connected as has
+// more rights than running the service needs: if it is, or is a member
+// of, a role that's a superuser or can create roles or bypass row
+// security, or if it owns (or is a member of a role owning) tables in
+// the schema, which lets it change or drop them.
+func (pg *Postgres) CheckRuntimeRole(ctx context.Context) error {
+	var privileged, owners sql.NullString
+	err := pg.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT string_agg(rolname, ', ') FROM pg_roles
+			 WHERE (rolsuper OR rolcreaterole OR rolbypassrls)
+			   AND pg_has_role(current_user, oid, 'MEMBER')),
+			(SELECT string_agg(DISTINCT pg_get_userbyid(c.relowner), ', ')
+			 FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+			 WHERE n.nspname = 'public'
+			   AND pg_has_role(current_user, c.relowner, 'MEMBER'))
+	`).Scan(&privileged, &owners)
+	if err != nil {
+		log.Errorf("Error checking database role. Err: %s", err)
+		return err
+	}
+	if privileged.Valid {
+		return fmt.Errorf("The database role is or inherits a privileged role (%s)", privileged.String)
+	}
+	if owners.Valid {
+		return fmt.Errorf("The database role is or inherits the owner of the schema's tables (%s)", owners.String)
+	}
+	return nil
+}
+
+func (pg *Postgres) QueueDepth() (jobs, digestItems int64, err error) {
+	err = pg.db.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM email_job WHERE status = $1),
+			(SELECT count(*) FROM digest_item)
+	`, api.JobScheduled).Scan(&jobs, &digestItems)
+	if err != nil {
+		log.Errorf("Error counting queued emails. Err: %s", err)
+	}
+	return jobs, digestItems, err
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func normalizeEmail(email string) string {
+	return strings.TrimSpace(email)
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
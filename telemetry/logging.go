@@ -0,0 +1,243 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+
+	// How email addresses appear in logs
+	LogEmailsRedact = "redact"
+	LogEmailsHash   = "hash"
+	LogEmailsPlain  = "plain"
+
+	RequestIdHeader = "X-Request-Id"
+	maxRequestIdLen = 128
+)
+
+var emailPattern = regexp.MustCompile(
+	"[A-Za-z0-9.!#$%&'*+/=?^_`{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)+")
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// ConfigureLogging sets logrus' level and format, and scrubs email
+// addresses from everything it logs, messages and fields alike, since
+// they turn up in errors from SMTP servers and the database too.
+func ConfigureLogging(level, format, emails string, hashKey []byte) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	var formatter log.Formatter
+	switch format {
+	case LogFormatJSON:
+		formatter = &log.JSONFormatter{}
+	case LogFormatText:
+		formatter = &log.TextFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format %q", format)
+	}
+
+	switch emails {
+	case LogEmailsRedact, LogEmailsHash:
+		formatter = &scrubbingFormatter{Formatter: formatter,
+			emailScrubber: emailScrubber{mode: emails, hashKey: hashKey}}
+	case LogEmailsPlain:
+	default:
+		return fmt.Errorf("Unknown email log mode %q", emails)
+	}
+
+	// Spans leave the process, so they're never sent plain addresses
+	if emails == LogEmailsHash {
+		spanScrubber = emailScrubber{mode: emails, hashKey: hashKey}
+	} else {
+		spanScrubber = emailScrubber{mode: LogEmailsRedact}
+	}
+
+	log.SetLevel(lvl)
+	log.SetFormatter(formatter)
+	return nil
+}
+
+// scrubbingFormatter replaces email addresses before handing entries to
+// the real formatter.
+type scrubbingFormatter struct {
+	log.Formatter
+	emailScrubber
+}
+
+func (f *scrubbingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	scrubbed := *entry
+	scrubbed.Message = f.scrub(entry.Message)
+	scrubbed.Data = make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			scrubbed.Data[k] = f.scrub(v)
+		case error:
+			scrubbed.Data[k] = errors.New(f.scrub(v.Error()))
+		case fmt.Stringer:
+			scrubbed.Data[k] = f.scrub(v.String())
+		default:
+			scrubbed.Data[k] = v
+		}
+	}
+	return f.Formatter.Format(&scrubbed)
+}
+
+// emailScrubber replaces the email addresses in strings, by redacting or
+// hashing them.
+type emailScrubber struct {
+	mode    string
+	hashKey []byte
+}
+
+func (sc emailScrubber) scrub(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return emailPattern.ReplaceAllStringFunc(s, func(address string) string {
+		if sc.mode == LogEmailsHash {
+			return hashEmail(address, sc.hashKey)
+		}
+		return RedactEmail(address)
+	})
+}
+
+// RedactEmail masks all but the first character of the local part,
+// e.g. "s***@pursuanceproject.org".
+func RedactEmail(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 1 {
+		return "***"
+	}
+	return address[:1] + "***" + address[at:]
+}
+
+// hashEmail stands in for address with a keyed hash, so log lines about
+// the same address can be correlated without revealing it.
+func hashEmail(address string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(address)))
+	return "email:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+type requestIdKey struct{}
+
+// RequestId returns the ID LogRequests gave the request, or "".
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// statusRecorder notes the status and size of a response as it's
+// written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += n
+	return n, err
+}
+
+// LogRequests wraps next, which serves routes, logging one line per
+// request: method, route template, status, latency, request ID, and
+// trace ID if the request is traced. The latency is also recorded in
+// httpRequestSeconds.
+// Paths and query strings aren't logged, since they can carry IDs and
+// tokens, and neither are request bodies.
+//
+// The request ID is taken from the X-Request-Id header if the caller set
+// a sane one, and generated otherwise. It's echoed in the response and
+// available to handlers through RequestId.
+func LogRequests(routes *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIdHeader)
+		if len(id) > maxRequestIdLen || !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id))
+
+		route := routeTemplate(routes, r)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		latency := time.Since(start)
+		httpRequestSeconds.Observe(latency.Seconds(), route, r.Method, strconv.Itoa(rec.status))
+
+		entry := log.WithFields(log.Fields{
+			"method":     r.Method,
+			"route":      route,
+			"status":     rec.status,
+			"bytes":      rec.bytes,
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+			"request_id": id,
+		})
+		if span := SpanFromContext(r.Context()); span != nil {
+			entry = entry.WithField("trace_id", hex.EncodeToString(span.TraceID[:]))
+		}
+		if rec.status >= 500 {
+			entry.Warn("HTTP request")
+		} else {
+			entry.Info("HTTP request")
+		}
+	})
+}
+
+// routeTemplate returns the path template of the route in routes that
+// matches r, or "unmatched".
+func routeTemplate(routes *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if routes.Match(r, &match) && match.Route != nil {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,247 @@
+// Package telemetry holds what PursueMail uses to be observed: metrics
+// in the Prometheus text format, OpenTelemetry-style tracing, and log
+// configuration.
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Just enough of a Prometheus client to serve counters, histograms and
+// gauges in the text exposition format. Labels describe routes,
+// transports and outcomes; never put a recipient in one.
+
+var httpRequestSeconds = NewHistogramVec("pursuemail_http_request_duration_seconds",
+	"Time taken to handle HTTP requests, by route template, method and status.",
+	[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	"route", "method", "status")
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+// MetricsHandler serves every registered metric.
+func MetricsHandler() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry.mu.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(bw)
+		}
+		if err := bw.Flush(); err != nil {
+			log.Errorf("Error writing metrics: %s", err)
+		}
+	}
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *metricDesc) writeHeader(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+}
+
+// labelPairs formats label values, plus any extra `name="value"` pairs,
+// for a series line.
+func (d *metricDesc) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra))
+	for i, value := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabelValue(value)+`"`)
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("%s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter with one series per set of label values.
+type CounterVec struct {
+	metricDesc
+
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricDesc: metricDesc{name, help, labels},
+		values:     map[string]float64{},
+		series:     map[string][]string{},
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key]++
+	c.series[key] = labelValues
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.series[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// HistogramVec is a histogram with one series per set of label values.
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricDesc: metricDesc{name, help, labels},
+		buckets:    buckets,
+		series:     map[string]*histogram{},
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince observes the time since start, in seconds.
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				h.labelPairs(s.labelValues, `le="`+formatFloat(bound)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(s.labelValues), s.count)
+	}
+}
+
+// GaugeSample is one series of a gauge made with NewGaugeFunc.
+type GaugeSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// gaugeFunc is a gauge whose samples are collected when it's scraped.
+type gaugeFunc struct {
+	metricDesc
+	collect func() []GaugeSample
+}
+
+// NewGaugeFunc registers a gauge whose samples collect returns each time
+// it's scraped.
+func NewGaugeFunc(name, help string, collect func() []GaugeSample, labels ...string) {
+	register(&gaugeFunc{metricDesc: metricDesc{name, help, labels}, collect: collect})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w, "gauge")
+	for _, s := range g.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelPairs(s.LabelValues), formatFloat(s.Value))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,552 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// Just enough of OpenTelemetry tracing to follow a send through its
+// stages: spans, W3C trace context (traceparent) propagation, and
+// exporting over OTLP/HTTP with the JSON encoding. Tracing is off, and
+// every span nil, until ConfigureTracing is called.
+
+const (
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+
+	TraceparentHeader = "traceparent"
+)
+
+// Span kinds, numbered as in OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent reads a W3C traceparent header value.
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, false
+	}
+	version, err := hex.DecodeString(value[:2])
+	// Version ff is invalid, version 00 has nothing after the flags, and
+	// later versions may only add dash-separated fields
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(value) != 55) ||
+		(len(value) > 55 && value[55] != '-') {
+		return sc, false
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(value[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(value[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(value[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is one timed stage of a trace. All its methods do nothing on a nil
+// Span, which is what StartSpan returns while tracing is off.
+type Span struct {
+	SpanContext
+	ParentSpanID [8]byte
+
+	Name  string
+	Kind  int
+	Start time.Time
+	End   time.Time
+
+	mu         sync.Mutex
+	Attributes []SpanAttribute
+	Error      string
+	ended      bool
+}
+
+// SetAttribute sets an attribute on the span. Email addresses in string
+// values are scrubbed, as they are from logs.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if str, ok := value.(string); ok {
+		value = spanScrubber.scrub(str)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes = append(s.Attributes, SpanAttribute{key, value})
+}
+
+func (s *Span) SetKind(kind int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Kind = kind
+}
+
+// RecordError marks the span as failed if err isn't nil. Email addresses
+// in the error, which SMTP servers and the database like to include, are
+// scrubbed as they are from logs.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	msg := spanScrubber.scrub(err.Error())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = msg
+}
+
+// Finish ends the span and hands it to the exporter if it's sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Sampled {
+		if exporter := currentTracer().exporter; exporter != nil {
+			exporter.ExportSpan(s)
+		}
+	}
+}
+
+// SpanExporter sends finished spans somewhere.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+	Shutdown() error
+}
+
+type tracerConfig struct {
+	exporter    SpanExporter
+	sampleRatio float64
+}
+
+var tracer struct {
+	mu  sync.RWMutex
+	cfg tracerConfig
+
+	randMu sync.Mutex
+	rand   *mathrand.Rand
+}
+
+// spanScrubber scrubs email addresses from span errors and attributes.
+// ConfigureLogging sets it to match the logs, except that addresses are
+// redacted even when logs keep them.
+var spanScrubber = emailScrubber{mode: LogEmailsRedact}
+
+func currentTracer() tracerConfig {
+	tracer.mu.RLock()
+	defer tracer.mu.RUnlock()
+	return tracer.cfg
+}
+
+// ConfigureTracing starts recording spans, sampling sampleRatio of the
+// traces that start here. Traces that come with a traceparent keep the
+// caller's sampling decision.
+func ConfigureTracing(exporter SpanExporter, sampleRatio float64) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.cfg = tracerConfig{exporter: exporter, sampleRatio: sampleRatio}
+	tracer.rand = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+}
+
+// NewSpanExporter returns the exporter named by kind, or nil if kind is
+// empty.
+func NewSpanExporter(kind, otlpEndpoint string) (SpanExporter, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case TraceExporterOTLP:
+		return NewOTLPExporter(otlpEndpoint, nil), nil
+	case TraceExporterStdout:
+		return NewStdoutExporter(nil), nil
+	}
+	return nil, fmt.Errorf("Unknown trace exporter %q", kind)
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span as a child of the one in ctx, if any. Call
+// Finish on it when the stage is done.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.SpanContext
+	}
+	return startSpan(ctx, name, SpanKindInternal, parent)
+}
+
+func startSpan(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	cfg := currentTracer()
+	if cfg.exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{Name: name, Kind: kind, Start: time.Now()}
+	if parent.IsValid() {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.TraceID[:])
+		tracer.randMu.Lock()
+		span.Sampled = tracer.rand.Float64() < cfg.sampleRatio
+		tracer.randMu.Unlock()
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// TraceRequests wraps next, which serves routes, in a server span per
+// request, continuing the caller's trace if it sent a traceparent
+// header.
+func TraceRequests(routes *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := parseTraceparent(r.Header.Get(TraceparentHeader))
+		route := routeTemplate(routes, r)
+		ctx, span := startSpan(r.Context(), r.Method+" "+route, SpanKindServer, parent)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.Finish()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.RecordError(fmt.Errorf("HTTP %d", rec.status))
+		}
+	})
+}
+
+// InMemoryExporter keeps spans for tests to inspect.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *InMemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far, in the order they finished.
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+func (e *InMemoryExporter) Shutdown() error {
+	return nil
+}
+
+// StdoutExporter writes each span as a line of OTLP JSON.
+type StdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter writes to w, or to stdout if w is nil.
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &StdoutExporter{w: w}
+}
+
+func (e *StdoutExporter) ExportSpan(span *Span) {
+	b, err := json.Marshal(toOTLPSpan(span))
+	if err != nil {
+		log.Errorf("Error marshalling span: %s", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(b, '\n'))
+}
+
+func (e *StdoutExporter) Shutdown() error {
+	return nil
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter posts spans in batches to an OTLP/HTTP traces endpoint
+// (e.g. http://localhost:4318/v1/traces), as JSON. Spans are dropped
+// rather than holding up sends if the collector can't keep up.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+
+	queue chan *Span
+	done  chan struct{}
+
+	closeOnce sync.Once
+}
+
+func NewOTLPExporter(endpoint string, client *http.Client) *OTLPExporter {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	e := &OTLPExporter{
+		endpoint: endpoint,
+		client:   client,
+		queue:    make(chan *Span, otlpQueueSize),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		log.Debugf("OTLP export queue full; dropping span %s", span.Name)
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				e.post(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.post(batch)
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	req := otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", "pursuemail"),
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "pursuemail"}}},
+	}}}
+	for _, span := range spans {
+		req.ResourceSpans[0].ScopeSpans[0].Spans = append(
+			req.ResourceSpans[0].ScopeSpans[0].Spans, toOTLPSpan(span))
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.Errorf("Error marshalling spans: %s", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Error exporting %d spans: %v", len(spans), err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warnf("Error exporting %d spans: %s", len(spans), resp.Status)
+	}
+}
+
+// Shutdown sends any spans still queued.
+func (e *OTLPExporter) Shutdown() error {
+	e.closeOnce.Do(func() { close(e.queue) })
+	<-e.done
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding. IDs are hex and 64-bit integers are
+// strings, as the spec asks.
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP status code for an error
+const otlpStatusError = 2
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	case string:
+		kv.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func toOTLPSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(span.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.SpanID[:]),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.ParentSpanID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+	}
+	for _, attr := range span.Attributes {
+		s.Attributes = append(s.Attributes, otlpAttribute(attr.Key, attr.Value))
+	}
+	if span.Error != "" {
+		s.Status = &otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		// Later versions may add fields
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.value)
+		if ok != tt.ok || (ok && sc.Sampled != tt.sampled) {
+			t.Errorf("parseTraceparent(%q) = %+v, %v, want ok = %v, sampled = %v", tt.value, sc, ok, tt.ok, tt.sampled)
+		}
+		if ok && tt.value[:2] == "00" && sc.Traceparent() != tt.value {
+			t.Errorf("Traceparent() = %q, want %q", sc.Traceparent(), tt.value)
+		}
+	}
+}
+
+func TestSpansScrubEmails(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	ConfigureTracing(exporter, 1)
+	defer ConfigureTracing(nil, 0)
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	_, child := StartSpan(ctx, "child")
+	child.SetAttribute("rcpt", "to someone@example.com")
+	child.SetAttribute("count", 2)
+	child.RecordError(errors.New("550 5.1.1 <someone@example.com>: no such user"))
+	child.Finish()
+	parent.Finish()
+	parent.Finish()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 || spans[0] != child || spans[1] != parent {
+		t.Fatalf("Exported %v, want the child then the parent once", spans)
+	}
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID {
+		t.Error("child isn't in its parent's trace")
+	}
+	if want := "550 5.1.1 <s***@example.com>: no such user"; child.Error != want {
+		t.Errorf("Error = %q, want %q", child.Error, want)
+	}
+	if child.Attributes[0].Value != "to s***@example.com" || child.Attributes[1].Value != 2 {
+		t.Errorf("Attributes = %v", child.Attributes)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	ConfigureTracing(nil, 0)
+	ctx, span := StartSpan(context.Background(), "off")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("StartSpan made a span with tracing off")
+	}
+	// A nil span ignores everything
+	span.SetAttribute("a", "b")
+	span.RecordError(errors.New("error"))
+	span.Finish()
+}
+
+func TestTraceRequests(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	ConfigureTracing(exporter, 0)
+	defer ConfigureTracing(nil, 0)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/email/{id}", func(w http.ResponseWriter, req *http.Request) {
+		if SpanFromContext(req.Context()) == nil {
+			t.Error("Handler has no span")
+		}
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	handler := TraceRequests(r, r)
+
+	// Not sampled here, but the caller's decision wins
+	req := httptest.NewRequest("GET", "/api/v1/email/123", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/email/123", nil))
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("Exported %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /api/v1/email/{id}" || span.Kind != SpanKindServer {
+		t.Errorf("Span %q kind %d", span.Name, span.Kind)
+	}
+	if span.Traceparent()[:36] != "00-4bf92f3577b34da6a3ce929d0e0e4736-" {
+		t.Errorf("Span isn't in the caller's trace: %s", span.Traceparent())
+	}
+	if span.Error != "HTTP 500" {
+		t.Errorf("Error = %q", span.Error)
+	}
+}